@@ -15,6 +15,9 @@
 package clusterlist
 
 import (
+	"context"
+	"errors"
+
 	"github.com/kubewharf/kelemetry/pkg/manager"
 )
 
@@ -28,6 +31,14 @@ type Lister interface {
 	List() []string
 }
 
+// Refresher is optionally implemented by a Lister that can reload its cluster list on demand.
+type Refresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// ErrRefreshUnsupported is returned by Refresh if the selected implementation does not implement Refresher.
+var ErrRefreshUnsupported = errors.New("cluster list implementation does not support refresh")
+
 type mux struct {
 	*manager.Mux
 }
@@ -35,3 +46,11 @@ type mux struct {
 func (mux *mux) List() []string {
 	return mux.Impl().(Lister).List()
 }
+
+func (mux *mux) Refresh(ctx context.Context) error {
+	if refresher, ok := mux.Impl().(Refresher); ok {
+		return refresher.Refresh(ctx)
+	}
+
+	return ErrRefreshUnsupported
+}
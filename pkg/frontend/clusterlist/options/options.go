@@ -16,6 +16,10 @@ package options
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 
 	"github.com/spf13/pflag"
 
@@ -28,11 +32,18 @@ func init() {
 }
 
 type options struct {
-	clusters []string
+	clusters     []string
+	clustersFile string
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.StringSliceVar(&options.clusters, "jaeger-cluster-names", []string{}, "cluster names allowed")
+	fs.StringVar(
+		&options.clustersFile,
+		"jaeger-cluster-names-file",
+		"",
+		"file of additional cluster names allowed, one per line, re-read when the cluster list is refreshed",
+	)
 }
 
 func (options *options) EnableFlag() *bool { return nil }
@@ -40,18 +51,54 @@ func (options *options) EnableFlag() *bool { return nil }
 type Lister struct {
 	manager.MuxImplBase
 	options options
+
+	clustersMu sync.RWMutex
+	clusters   []string
 }
 
-var _ clusterlist.Lister = &Lister{}
+var (
+	_ clusterlist.Lister    = &Lister{}
+	_ clusterlist.Refresher = &Lister{}
+)
 
 func (_ *Lister) MuxImplName() (name string, isDefault bool) { return "options", true }
 
 func (lister *Lister) Options() manager.Options { return &lister.options }
 
-func (lister *Lister) Init() error { return nil }
+func (lister *Lister) Init() error { return lister.Refresh(context.Background()) }
 
 func (lister *Lister) Start(ctx context.Context) error { return nil }
 
 func (lister *Lister) Close(ctx context.Context) error { return nil }
 
-func (lister *Lister) List() []string { return lister.options.clusters }
+func (lister *Lister) List() []string {
+	lister.clustersMu.RLock()
+	defer lister.clustersMu.RUnlock()
+
+	return lister.clusters
+}
+
+// Refresh re-reads --jaeger-cluster-names-file.
+// The cluster list is unchanged if the file cannot be read.
+func (lister *Lister) Refresh(ctx context.Context) error {
+	clusters := append([]string{}, lister.options.clusters...)
+
+	if lister.options.clustersFile != "" {
+		content, err := os.ReadFile(lister.options.clustersFile)
+		if err != nil {
+			return fmt.Errorf("cannot read cluster names file: %w", err)
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			if name := strings.TrimSpace(line); name != "" && !strings.HasPrefix(name, "#") {
+				clusters = append(clusters, name)
+			}
+		}
+	}
+
+	lister.clustersMu.Lock()
+	defer lister.clustersMu.Unlock()
+
+	lister.clusters = clusters
+	return nil
+}
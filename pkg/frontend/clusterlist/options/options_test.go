@@ -0,0 +1,50 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package options_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/clusterlist/options"
+)
+
+func TestRefreshRereadsClusterNamesFile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "clusters")
+	assert.NoError(os.WriteFile(file, []byte("a\n# comment\n\nb\n"), 0o600))
+
+	lister := &options.Lister{}
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	lister.Options().Setup(fs)
+	assert.NoError(fs.Parse([]string{"--jaeger-cluster-names=static", "--jaeger-cluster-names-file=" + file}))
+
+	assert.NoError(lister.Init())
+	assert.Equal([]string{"static", "a", "b"}, lister.List())
+
+	assert.NoError(os.WriteFile(file, []byte("c\n"), 0o600))
+	assert.NoError(lister.Refresh(context.Background()))
+	assert.Equal([]string{"static", "c"}, lister.List())
+
+	assert.NoError(os.Remove(file))
+	assert.Error(lister.Refresh(context.Background()))
+	assert.Equal([]string{"static", "c"}, lister.List(), "a failed refresh keeps the previous list")
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+// admission limits the number of concurrently handled requests.
+// Requests beyond the limit wait in a queue for at most maxWait.
+type admission struct {
+	clock   clock.Clock
+	maxWait time.Duration
+
+	// slots is nil if admission is unbounded.
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+func newAdmission(clock clock.Clock, limit int, maxWait time.Duration) *admission {
+	adm := &admission{
+		clock:   clock,
+		maxWait: maxWait,
+	}
+	if limit > 0 {
+		adm.slots = make(chan struct{}, limit)
+	}
+	return adm
+}
+
+// acquire blocks until the request is admitted.
+// Returns false if the request waited longer than maxWait or ctx was canceled.
+// The returned release function must be called exactly once if acquire succeeds.
+func (adm *admission) acquire(ctx context.Context) (release func(), ok bool) {
+	if adm.slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case adm.slots <- struct{}{}:
+	default:
+		adm.waiting.Add(1)
+		defer adm.waiting.Add(-1)
+
+		timer := adm.clock.NewTimer(adm.maxWait)
+		defer timer.Stop()
+
+		select {
+		case adm.slots <- struct{}{}:
+		case <-timer.C():
+			return nil, false
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	return func() { <-adm.slots }, true
+}
+
+func (adm *admission) queueDepth() int64 { return adm.waiting.Load() }
+
+// clientAdmission limits the number of concurrently handled requests from each client,
+// independent of the global admission, so that a single client cannot take all slots.
+type clientAdmission struct {
+	// limit is non-positive if admission per client is unbounded.
+	limit int
+
+	lock     sync.Mutex
+	inflight map[string]int
+}
+
+func newClientAdmission(limit int) *clientAdmission {
+	return &clientAdmission{
+		limit:    limit,
+		inflight: map[string]int{},
+	}
+}
+
+// acquire admits the request if the client has fewer than limit requests in flight.
+// Unlike admission, requests beyond the limit do not wait since the client is already occupying enough slots.
+// The returned release function must be called exactly once if acquire succeeds.
+func (adm *clientAdmission) acquire(client string) (release func(), ok bool) {
+	if adm.limit <= 0 {
+		return func() {}, true
+	}
+
+	adm.lock.Lock()
+	defer adm.lock.Unlock()
+
+	if adm.inflight[client] >= adm.limit {
+		return nil, false
+	}
+	adm.inflight[client]++
+
+	return func() {
+		adm.lock.Lock()
+		defer adm.lock.Unlock()
+
+		adm.inflight[client]--
+		if adm.inflight[client] == 0 {
+			delete(adm.inflight, client)
+		}
+	}, true
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import "strings"
+
+// defaultResourceAliases maps kubectl short names and singular names of core resources to the plural resource names
+// stored in the resource tag.
+var defaultResourceAliases = map[string]string{
+	"po":     "pods",
+	"pod":    "pods",
+	"no":     "nodes",
+	"node":   "nodes",
+	"ns":     "namespaces",
+	"svc":    "services",
+	"ep":     "endpoints",
+	"cm":     "configmaps",
+	"secret": "secrets",
+	"sa":     "serviceaccounts",
+	"pv":     "persistentvolumes",
+	"pvc":    "persistentvolumeclaims",
+	"ev":     "events",
+	"deploy": "deployments",
+	"rs":     "replicasets",
+	"sts":    "statefulsets",
+	"ds":     "daemonsets",
+	"job":    "jobs",
+	"cj":     "cronjobs",
+	"ing":    "ingresses",
+	"hpa":    "horizontalpodautoscalers",
+	"pdb":    "poddisruptionbudgets",
+}
+
+// buildResourceAliases merges --trace-server-resource-aliases over the defaults.
+func buildResourceAliases(overrides map[string]string) map[string]string {
+	aliases := make(map[string]string, len(defaultResourceAliases)+len(overrides))
+	for alias, resource := range defaultResourceAliases {
+		aliases[alias] = resource
+	}
+	for alias, resource := range overrides {
+		aliases[strings.ToLower(alias)] = resource
+	}
+	return aliases
+}
+
+// canonicalResource returns the resource name that an alias refers to, or the input if it is not an alias.
+func (server *server) canonicalResource(resource string) string {
+	if canonical, isAlias := server.resourceAliases[strings.ToLower(resource)]; isAlias {
+		return canonical
+	}
+	return resource
+}
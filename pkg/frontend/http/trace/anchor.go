@@ -0,0 +1,65 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	// The timeline starts at the earliest span, which is the Jaeger UI behavior.
+	anchorTraceStart = "trace_start"
+	// The timeline starts at the start of the query window.
+	anchorWindowStart = "window_start"
+)
+
+// anchorClippedTag records the original start time of spans clipped to the anchor, in RFC3339 format.
+const anchorClippedTag = "anchorClippedStartTime"
+
+// resolveAnchor returns the timeline origin requested by the anchor param,
+// or the zero time if the timeline is not anchored.
+func (server *server) resolveAnchor(query traceQuery) (time.Time, error) {
+	switch query.Anchor {
+	case "", anchorTraceStart:
+		return time.Time{}, nil
+	case anchorWindowStart:
+		startTime, _, err := server.resolveWindow(query)
+		return startTime, err
+	default:
+		return time.Time{}, fmt.Errorf("invalid anchor param %q, must be %q or %q", query.Anchor, anchorTraceStart, anchorWindowStart)
+	}
+}
+
+// anchorTrace clips spans starting before the anchor to start at the anchor,
+// so that the Jaeger UI timeline starts at the anchor instead of the earliest span.
+// Spans ending before the anchor become zero-duration spans at the anchor.
+func anchorTrace(trace *model.Trace, anchor time.Time) {
+	for _, span := range trace.Spans {
+		if !span.StartTime.Before(anchor) {
+			continue
+		}
+
+		end := spanEnd(span)
+		span.Tags = append(span.Tags, model.String(anchorClippedTag, span.StartTime.Format(time.RFC3339Nano)))
+		span.StartTime = anchor
+		span.Duration = 0
+		if end.After(anchor) {
+			span.Duration = end.Sub(anchor)
+		}
+	}
+}
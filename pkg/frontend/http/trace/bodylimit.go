@@ -0,0 +1,88 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type oversizedRequestMetric struct{}
+
+func (*oversizedRequestMetric) MetricName() string { return "extension_trace_oversized_request" }
+
+// checkRequestBody rejects bodies larger than --trace-server-max-request-body-bytes for a handler reporting to the request metric,
+// returning the error class if the body is rejected.
+// Bodies without a Content-Length are truncated at the limit, so handlers must check isBodyTooLarge on read errors.
+// Bodies with Content-Encoding: gzip are decompressed and limited to --trace-server-max-decompressed-body-bytes.
+func (server *server) checkRequestBody(ctx *gin.Context) (ErrorClass, error) {
+	limit := server.options.maxRequestBodyBytes
+	if limit > 0 {
+		if ctx.Request.ContentLength > limit {
+			server.OversizedRequestMetric.With(&oversizedRequestMetric{}).Count(1)
+			return classRequestTooLarge, fmt.Errorf("request body exceeds %d bytes", limit)
+		}
+
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+	}
+
+	return server.decompressRequestBody(ctx)
+}
+
+func (server *server) decompressRequestBody(ctx *gin.Context) (ErrorClass, error) {
+	encoding := strings.TrimSpace(ctx.Request.Header.Get("Content-Encoding"))
+	switch {
+	case encoding == "" || strings.EqualFold(encoding, "identity"):
+		return "", nil
+	case !strings.EqualFold(encoding, "gzip"):
+		return classUnsupportedEncoding, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	reader, err := gzip.NewReader(ctx.Request.Body)
+	if err != nil {
+		if server.isBodyTooLarge(err) {
+			return classRequestTooLarge, err
+		}
+		return classInvalidBody, fmt.Errorf("malformed gzip body: %w", err)
+	}
+
+	var body io.ReadCloser = reader
+	if limit := server.options.maxDecompressedBodyBytes; limit > 0 {
+		body = http.MaxBytesReader(ctx.Writer, reader, limit)
+	}
+
+	ctx.Request.Body = body
+	ctx.Request.ContentLength = -1
+	ctx.Request.Header.Del("Content-Encoding")
+	ctx.Request.Header.Del("Content-Length")
+	return "", nil
+}
+
+// isBodyTooLarge checks whether a body read error was caused by checkRequestBody, recording the metric if so.
+func (server *server) isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+
+	server.OversizedRequestMetric.With(&oversizedRequestMetric{}).Count(1)
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sort"
+
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+// ErrorClass categorizes a failed request.
+// The class name is the error label of the request metric.
+type ErrorClass string
+
+const (
+	classConflictingParams   ErrorClass = "ConflictingParams"
+	classDuplicateParam      ErrorClass = "DuplicateParam"
+	classUnknownParam        ErrorClass = "UnknownParam"
+	classInvalidParam        ErrorClass = "InvalidParam"
+	classEmptyParam          ErrorClass = "EmptyParam"
+	classInvalidTimestamp    ErrorClass = "InvalidTimestamp"
+	classUnknownTimezone     ErrorClass = "UnknownTimezone"
+	classBeyondRetention     ErrorClass = "BeyondRetention"
+	classInvalidFormat       ErrorClass = "InvalidFormat"
+	classFormatDisabled      ErrorClass = "FormatDisabled"
+	classUnknownDisplayMode  ErrorClass = "UnknownDisplayMode"
+	classTooManyTraces       ErrorClass = "TooManyTraces"
+	classFanoutTooLarge      ErrorClass = "FanoutTooLarge"
+	classResponseTooLarge    ErrorClass = "ResponseTooLarge"
+	classRequestTooLarge     ErrorClass = "RequestTooLarge"
+	classUnsupportedEncoding ErrorClass = "UnsupportedEncoding"
+	classInvalidBody         ErrorClass = "InvalidBody"
+	classUnknownCluster      ErrorClass = "UnknownCluster"
+	classNoTraceMatch        ErrorClass = "NoTraceMatch"
+	classUnknownSpan         ErrorClass = "UnknownSpan"
+	classUnknownToken        ErrorClass = "UnknownToken"
+	classMultiTraceMatch     ErrorClass = "MultiTraceMatch"
+	classNoRootSpan          ErrorClass = "NoRootSpan"
+	classTraceError          ErrorClass = "TraceError"
+	classMarshalError        ErrorClass = "MarshalError"
+	classExportError         ErrorClass = "ExportError"
+	classClusterListError    ErrorClass = "ClusterListError"
+	classConfigUnavailable   ErrorClass = "ConfigUnavailable"
+	classOverloaded          ErrorClass = "Overloaded"
+	classClientOverloaded    ErrorClass = "ClientOverloaded"
+	classTooManyStreams      ErrorClass = "TooManyStreams"
+	classMaintenance         ErrorClass = "Maintenance"
+	classShuttingDown        ErrorClass = "ShuttingDown"
+	classTimeout             ErrorClass = "Timeout"
+)
+
+// errorStatuses is the HTTP status of each error class.
+// New error classes must be added here.
+var errorStatuses = map[ErrorClass]int{
+	classConflictingParams:   400,
+	classDuplicateParam:      400,
+	classUnknownParam:        400,
+	classInvalidParam:        400,
+	classEmptyParam:          400,
+	classInvalidTimestamp:    400,
+	classUnknownTimezone:     400,
+	classBeyondRetention:     400,
+	classInvalidFormat:       400,
+	classFormatDisabled:      400,
+	classUnknownDisplayMode:  400,
+	classTooManyTraces:       400,
+	classFanoutTooLarge:      400,
+	classResponseTooLarge:    413,
+	classRequestTooLarge:     413,
+	classUnsupportedEncoding: 415,
+	classInvalidBody:         400,
+	classUnknownCluster:      404,
+	classNoTraceMatch:        404,
+	classUnknownSpan:         404,
+	classUnknownToken:        404,
+	classMultiTraceMatch:     500,
+	classNoRootSpan:          500,
+	classTraceError:          500,
+	classClientOverloaded:    429,
+	classMarshalError:        500,
+	classExportError:         502,
+	classClusterListError:    500,
+	classConfigUnavailable:   501,
+	classOverloaded:          503,
+	classTooManyStreams:      503,
+	classMaintenance:         503,
+	classShuttingDown:        503,
+	classTimeout:             504,
+}
+
+// ErrorClasses returns all error classes sorted by name.
+func ErrorClasses() []ErrorClass {
+	classes := make([]ErrorClass, 0, len(errorStatuses))
+	for class := range errorStatuses {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i] < classes[j] })
+	return classes
+}
+
+// Status returns the HTTP status code of the error class.
+func (class ErrorClass) Status() int {
+	if status, known := errorStatuses[class]; known {
+		return status
+	}
+	return 500
+}
+
+// fail labels the request metric with the error class and returns the HTTP status of the class.
+func (metric *requestMetric) fail(class ErrorClass) int {
+	metric.Error = metrics.MakeLabeledError(string(class))
+	return class.Status()
+}
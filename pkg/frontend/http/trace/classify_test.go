@@ -0,0 +1,345 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	tfconfig "github.com/kubewharf/kelemetry/pkg/frontend/tf/config"
+)
+
+func TestErrorClassesHaveLabelAndStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	classes := trace.ErrorClasses()
+	assert.NotEmpty(classes)
+	for _, class := range classes {
+		assert.NotEmpty(string(class))
+		assert.GreaterOrEqual(class.Status(), 400, "class %q", class)
+		assert.Less(class.Status(), 600, "class %q", class)
+	}
+}
+
+// TestErrorPathsAreClassified asserts that functions reporting to the request metric
+// never return a hard-coded error status or set the error label directly,
+// so that every error path goes through an error class.
+func TestErrorPathsAreClassified(t *testing.T) {
+	assert := assert.New(t)
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	assert.NoError(err)
+
+	for _, pkg := range pkgs {
+		for fileName, file := range pkg.Files {
+			ast.Inspect(file, func(node ast.Node) bool {
+				switch node := node.(type) {
+				case *ast.FuncDecl:
+					if !hasRequestMetricParam(node) {
+						return false
+					}
+				case *ast.ReturnStmt:
+					for _, result := range node.Results {
+						if lit, isLit := result.(*ast.BasicLit); isLit && lit.Kind == token.INT {
+							status, err := strconv.Atoi(lit.Value)
+							assert.NoError(err)
+							assert.Less(status, 400, "hard-coded error status at %s", fset.Position(lit.Pos()))
+						}
+						if sel, isSel := result.(*ast.SelectorExpr); isSel && strings.HasPrefix(sel.Sel.Name, "Status") {
+							if pkgIdent, isIdent := sel.X.(*ast.Ident); isIdent && pkgIdent.Name == "http" {
+								assert.Fail("hard-coded error status", "%s at %s", sel.Sel.Name, fset.Position(sel.Pos()))
+							}
+						}
+					}
+				case *ast.SelectorExpr:
+					if node.Sel.Name == "MakeLabeledError" && fileName != "classify.go" {
+						assert.Fail("error label set without an error class", "at %s", fset.Position(node.Pos()))
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+func hasRequestMetricParam(decl *ast.FuncDecl) bool {
+	for _, param := range decl.Type.Params.List {
+		if star, isStar := param.Type.(*ast.StarExpr); isStar {
+			if ident, isIdent := star.X.(*ast.Ident); isIdent && ident.Name == "requestMetric" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const errorPathTarget = "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+	"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"
+
+const (
+	exportTarget      = "/extensions/api/v1/admin/export"
+	shareTarget       = "/extensions/api/v1/share"
+	maintenanceTarget = "/extensions/api/v1/admin/maintenance"
+)
+
+// failingClusterList is a cluster list whose Refresh always fails.
+type failingClusterList struct{}
+
+func (failingClusterList) List() []string { return []string{"test"} }
+
+func (failingClusterList) Refresh(ctx context.Context) error {
+	return errors.New("cluster registry is down")
+}
+
+type errorPathCase struct {
+	args    []string
+	method  string
+	target  string
+	body    string
+	header  http.Header
+	find    func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error)
+	prepare func(mock *trace.MockServer)
+	// blockTarget is requested in the background before the request, holding a FindTraces call until the request ends
+	blockTarget string
+}
+
+// untestedErrorClasses are the error classes not produced by TestErrorPathsRecordClass.
+var untestedErrorClasses = map[trace.ErrorClass]string{
+	"MarshalError": "the response types always marshal successfully",
+	"ShuttingDown": "rejected before the request metric is created so that it is not recorded after the metrics flush",
+}
+
+// TestErrorPathsRecordClass triggers each error path and asserts that
+// the response status and the error label of the request metric match the error class.
+func TestErrorPathsRecordClass(t *testing.T) {
+	exportDir := t.TempDir()
+	exportFile := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(exportFile, nil, 0o600))
+	exportArgs := func(dir string) []string {
+		return []string{"--trace-server-enable-admin", "--trace-server-export-destination=dir", "--trace-server-export-dir=" + dir}
+	}
+	exportBody := fmt.Sprintf(`{"query":%q}`, strings.TrimPrefix(errorPathTarget, "/extensions/api/v1/trace?"))
+
+	twoTraces := func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		return []*model.Trace{
+			{Spans: []*model.Span{auditSpan(1, "create", time.Unix(0, 0))}},
+			{Spans: []*model.Span{auditSpan(2, "create", time.Unix(0, 0))}},
+		}, nil
+	}
+	orphanTrace := func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		span := auditSpan(1, "create", time.Unix(0, 0))
+		span.References = []model.SpanRef{model.NewChildOfRef(model.TraceID{}, 2)}
+		return []*model.Trace{{Spans: []*model.Span{span}}}, nil
+	}
+	waitForCancel := func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	enableMaintenance := func(mock *trace.MockServer) {
+		mock.Serve(httptest.NewRequest("POST", maintenanceTarget, strings.NewReader(`{"enabled":true}`)))
+	}
+
+	cases := map[trace.ErrorClass]errorPathCase{
+		"ConflictingParams": {target: errorPathTarget + "&list=true&format=html"},
+		"DuplicateParam":    {target: errorPathTarget + "&name=other"},
+		"UnknownParam":      {args: []string{"--trace-server-strict-query"}, target: errorPathTarget + "&nmae=web"},
+		"InvalidParam":      {target: errorPathTarget + "&max_logs_per_span=-1"},
+		"EmptyParam":        {target: "/extensions/api/v1/trace?cluster=test"},
+		"InvalidTimestamp":  {target: strings.Replace(errorPathTarget, "start=2023-01-01T11:00:00Z", "start=yesterday", 1)},
+		"UnknownTimezone":   {target: errorPathTarget + "&tz=Mars/Olympus"},
+		"BeyondRetention":   {args: []string{"--trace-server-max-lookback=1h"}, target: errorPathTarget},
+		"InvalidFormat":     {target: errorPathTarget + "&format=unknown"},
+		"FormatDisabled":    {args: []string{"--trace-server-enabled-formats=json"}, target: errorPathTarget + "&format=yaml"},
+		"UnknownDisplayMode": {
+			prepare: func(mock *trace.MockServer) {
+				mock.SetTransformConfigs(staticConfigs{config: &tfconfig.Config{Name: "tree"}})
+			},
+			target: errorPathTarget + "&displayMode=unknown",
+		},
+		"ConfigUnavailable": {target: errorPathTarget + "&displayMode=unknown"},
+		"TooManyTraces": {
+			args:   []string{"--trace-server-max-namespace-traces=1"},
+			find:   twoTraces,
+			target: "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&all_in_namespace=true&relative=-1h",
+		},
+		"FanoutTooLarge":   {args: []string{"--trace-server-max-fanout=1"}, target: errorPathTarget + "&also_name=other"},
+		"ResponseTooLarge": {args: []string{"--trace-server-max-response-bytes=10"}, target: errorPathTarget},
+		"RequestTooLarge": {
+			args:   append([]string{"--trace-server-max-request-body-bytes=10"}, exportArgs(exportDir)...),
+			method: "POST", target: exportTarget, body: exportBody,
+		},
+		"UnsupportedEncoding": {
+			args:   exportArgs(exportDir),
+			method: "POST", target: exportTarget, body: exportBody, header: http.Header{"Content-Encoding": {"br"}},
+		},
+		"InvalidBody": {args: exportArgs(exportDir), method: "POST", target: exportTarget, body: "{"},
+		"ExportError": {
+			// the export directory cannot be created under a file
+			args:   exportArgs(exportFile),
+			method: "POST", target: exportTarget, body: exportBody,
+		},
+		"UnknownCluster":  {target: strings.Replace(errorPathTarget, "cluster=test", "cluster=other", 1)},
+		"NoTraceMatch":    {target: strings.Replace(errorPathTarget, "name=web", "name=missing", 1)},
+		"UnknownSpan":     {target: errorPathTarget + "&subtree=00000000000000ff"},
+		"UnknownToken":    {target: "/extensions/api/v1/trace/by-token/unknown"},
+		"MultiTraceMatch": {find: twoTraces, target: errorPathTarget},
+		"NoRootSpan":      {find: orphanTrace, target: errorPathTarget + "&root_only=true"},
+		"TraceError": {
+			find: func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+				return nil, errors.New("storage is down")
+			},
+			target: errorPathTarget,
+		},
+		"ClusterListError": {
+			args:    []string{"--trace-server-enable-admin"},
+			prepare: func(mock *trace.MockServer) { mock.SetClusterList(failingClusterList{}) },
+			method:  "POST", target: "/extensions/api/v1/admin/reload-clusters",
+		},
+		"Overloaded": {
+			args:        []string{"--trace-server-max-concurrent-requests=1", "--trace-server-max-queue-wait=1ms"},
+			blockTarget: errorPathTarget,
+			target:      errorPathTarget,
+		},
+		"ClientOverloaded": {
+			args:        []string{"--trace-server-per-ip-concurrency=1"},
+			blockTarget: errorPathTarget,
+			target:      errorPathTarget,
+			// X-Forwarded-For from an untrusted peer must not change the client IP
+			header: http.Header{"X-Forwarded-For": {"198.51.100.7"}},
+		},
+		"TooManyStreams": {
+			args:        []string{"--trace-server-max-streams=1"},
+			blockTarget: "/extensions/api/v1/trace/stream?cluster=test&resource=pods&namespace=default&name=web&relative=-1h",
+			target:      "/extensions/api/v1/trace/stream?cluster=test&resource=pods&namespace=default&name=web&relative=-1h",
+		},
+		"Maintenance": {args: []string{"--trace-server-enable-admin"}, prepare: enableMaintenance, target: errorPathTarget},
+		"Timeout":     {args: []string{"--trace-server-query-timeout=10ms"}, find: waitForCancel, target: errorPathTarget},
+	}
+
+	for _, class := range trace.ErrorClasses() {
+		testCase, tested := cases[class]
+		if _, untested := untestedErrorClasses[class]; untested {
+			assert.False(t, tested, "class %q is tested", class)
+			continue
+		}
+		if !assert.True(t, tested, "class %q has no error path test", class) {
+			continue
+		}
+
+		t.Run(string(class), func(t *testing.T) { runErrorPathCase(t, class, testCase) })
+	}
+
+	// routes other than the trace endpoint also record their error class
+	routeCases := map[string]struct {
+		class trace.ErrorClass
+		errorPathCase
+	}{
+		"share/InvalidBody":  {"InvalidBody", errorPathCase{method: "POST", target: shareTarget, body: "{"}},
+		"share/InvalidParam": {"InvalidParam", errorPathCase{method: "POST", target: shareTarget, body: `{"query":"name=%zz"}`}},
+		"share/RequestTooLarge": {"RequestTooLarge", errorPathCase{
+			args:   []string{"--trace-server-max-request-body-bytes=10"},
+			method: "POST", target: shareTarget, body: exportBody,
+		}},
+		"share/Maintenance": {"Maintenance", errorPathCase{
+			args:    []string{"--trace-server-enable-admin"},
+			prepare: enableMaintenance,
+			method:  "POST", target: shareTarget, body: exportBody,
+		}},
+		"maintenance/InvalidBody": {"InvalidBody", errorPathCase{
+			args:   []string{"--trace-server-enable-admin"},
+			method: "POST", target: maintenanceTarget, body: "{",
+		}},
+		"maintenance/UnsupportedEncoding": {"UnsupportedEncoding", errorPathCase{
+			args:   []string{"--trace-server-enable-admin"},
+			method: "POST", target: maintenanceTarget, body: "{}", header: http.Header{"Content-Encoding": {"br"}},
+		}},
+	}
+	for name, testCase := range routeCases {
+		testCase := testCase
+		t.Run(name, func(t *testing.T) { runErrorPathCase(t, testCase.class, testCase.errorPathCase) })
+	}
+}
+
+func runErrorPathCase(t *testing.T, class trace.ErrorClass, testCase errorPathCase) {
+	assert := assert.New(t)
+
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", time.Date(2023, 1, 1, 11, 30, 0, 0, time.UTC)))
+	reader.find = testCase.find
+
+	release := make(chan struct{})
+	defer close(release)
+	if testCase.blockTarget != "" {
+		started := make(chan struct{})
+		reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+			close(started)
+			<-release
+			return nil, nil
+		}
+
+		mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"}, testCase.args...)
+		assert.NoError(err)
+		go mock.Request("GET", testCase.blockTarget, nil)
+		<-started
+
+		assertErrorClass(t, mock, class, mock.Request("GET", testCase.target, testCase.header))
+		return
+	}
+
+	mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"}, testCase.args...)
+	assert.NoError(err)
+	if testCase.prepare != nil {
+		testCase.prepare(mock)
+	}
+
+	method := testCase.method
+	if method == "" {
+		method = "GET"
+	}
+	request := httptest.NewRequest(method, testCase.target, strings.NewReader(testCase.body))
+	for key, values := range testCase.header {
+		request.Header[key] = values
+	}
+	assertErrorClass(t, mock, class, mock.Serve(request))
+}
+
+func assertErrorClass(t *testing.T, mock *trace.MockServer, class trace.ErrorClass, response *httptest.ResponseRecorder) {
+	assert.Equal(t, class.Status(), response.Code, response.Body.String())
+	assert.Equal(t, 1.0, mock.MetricsOutput().Get("extension_trace_request", map[string]string{"error": string(class)}).Int,
+		mock.MetricsOutput().PrintAll())
+}
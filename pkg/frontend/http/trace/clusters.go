@@ -0,0 +1,241 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/clusterlist"
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+type clusterRefreshMetric struct {
+	Resolved bool
+}
+
+func (*clusterRefreshMetric) MetricName() string { return "extension_trace_cluster_refresh" }
+
+// clusterRefresher rate-limits on-demand cluster list refreshes.
+type clusterRefresher struct {
+	mu sync.Mutex
+	// lastRefresh is the completion time of the last successful refresh.
+	lastRefresh time.Time
+	// inflight is the refresh in progress, or nil if no refresh is in progress.
+	inflight *clusterRefresh
+}
+
+// clusterRefresh is a cluster list refresh shared by all requests waiting for it.
+type clusterRefresh struct {
+	// done is closed when the refresh completes.
+	done chan struct{}
+	err  error
+	// waiters is the number of requests that have waited for the refresh.
+	waiters int
+}
+
+func (server *server) hasCluster(cluster string) bool {
+	for _, knownCluster := range server.ClusterList.List() {
+		if strings.EqualFold(knownCluster, cluster) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ensureCluster checks whether the cluster is known,
+// refreshing the cluster list once if it is not and the cooldown has elapsed.
+func (server *server) ensureCluster(ctx context.Context, cluster string) bool {
+	if server.hasCluster(cluster) {
+		return true
+	}
+
+	refresher, ok := server.ClusterList.(clusterlist.Refresher)
+	if !ok {
+		return false
+	}
+
+	refresh := server.startClusterRefresh(refresher, false)
+	if refresh == nil {
+		return false
+	}
+
+	select {
+	case <-refresh.done:
+	case <-ctx.Done():
+		return false
+	}
+
+	if refresh.err != nil {
+		return false
+	}
+
+	resolved := server.hasCluster(cluster)
+	server.ClusterRefreshMetric.With(&clusterRefreshMetric{Resolved: resolved}).Count(1)
+	return resolved
+}
+
+// startClusterRefresh returns the refresh in progress, starting a new refresh if none is in progress.
+// Unless force is true, no refresh is started and nil is returned within the cooldown after the last successful refresh.
+// The refresh runs in the background on a context bounded by --trace-server-cluster-refresh-timeout,
+// so that it is not cancelled with the request that started it.
+func (server *server) startClusterRefresh(refresher clusterlist.Refresher, force bool) *clusterRefresh {
+	server.clusterRefresher.mu.Lock()
+	defer server.clusterRefresher.mu.Unlock()
+
+	if inflight := server.clusterRefresher.inflight; inflight != nil {
+		inflight.waiters++
+		return inflight
+	}
+
+	lastRefresh := server.clusterRefresher.lastRefresh
+	if !force && server.Clock.Since(lastRefresh) < server.options.clusterRefreshCooldown {
+		return nil
+	}
+
+	refresh := &clusterRefresh{done: make(chan struct{}), waiters: 1}
+	server.clusterRefresher.inflight = refresh
+
+	// the refresh is called without holding the lock so that a slow refresh does not block other requests
+	go func() {
+		defer shutdown.RecoverPanic(server.Logger)
+
+		ctx, cancel := context.WithTimeout(context.Background(), server.options.clusterRefreshTimeout)
+		defer cancel()
+
+		err := refresher.Refresh(ctx)
+		if err != nil && !errors.Is(err, clusterlist.ErrRefreshUnsupported) {
+			server.Logger.WithError(err).Warn("cannot refresh cluster list")
+		}
+
+		server.clusterRefresher.mu.Lock()
+		server.clusterRefresher.inflight = nil
+		if err == nil {
+			server.clusterRefresher.lastRefresh = server.Clock.Now()
+		}
+		refresh.err = err
+		server.clusterRefresher.mu.Unlock()
+		close(refresh.done)
+	}()
+
+	return refresh
+}
+
+type reloadClustersResponse struct {
+	// Refreshed is false if the cluster list implementation does not support refresh.
+	Refreshed bool     `json:"refreshed"`
+	Clusters  []string `json:"clusters"`
+}
+
+// handleReloadClusters forces a refresh of the cluster list regardless of the cooldown.
+func (server *server) handleReloadClusters(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	logger := server.Logger.WithField("source", ctx.Request.RemoteAddr)
+
+	refreshed := false
+	if refresher, ok := server.ClusterList.(clusterlist.Refresher); ok {
+		// a refresh in progress is shared instead of running concurrently with it
+		refresh := server.startClusterRefresh(refresher, true)
+
+		select {
+		case <-refresh.done:
+		case <-ctx.Request.Context().Done():
+			return metric.fail(classClusterListError), fmt.Errorf("cannot reload cluster list: %w", ctx.Request.Context().Err())
+		}
+
+		if refresh.err != nil && !errors.Is(refresh.err, clusterlist.ErrRefreshUnsupported) {
+			return metric.fail(classClusterListError), fmt.Errorf("cannot reload cluster list: %w", refresh.err)
+		}
+		refreshed = refresh.err == nil
+	}
+
+	clusters := server.ClusterList.List()
+	logger.WithField("refreshed", refreshed).WithField("clusters", clusters).Info("reloaded cluster list")
+	server.writeJSON(ctx, 200, server.wrapEnvelope(ctx, reloadClustersResponse{Refreshed: refreshed, Clusters: clusters}))
+	return 200, nil
+}
+
+const (
+	emptyClusterListServe = "serve"
+	emptyClusterListFail  = "fail"
+
+	clusterListPollInterval = time.Second
+)
+
+// checkClusterList handles an empty cluster list at startup according to --trace-server-empty-cluster-list.
+func (server *server) checkClusterList(ctx context.Context) error {
+	if len(server.ClusterList.List()) > 0 {
+		return nil
+	}
+
+	if server.options.emptyClusterListMode == emptyClusterListServe {
+		server.Logger.Error("cluster list is empty, all trace requests will fail with UnknownCluster until clusters are available")
+		return nil
+	}
+
+	server.Logger.WithField("timeout", server.options.emptyClusterListTimeout).Warn("cluster list is empty, waiting for clusters")
+
+	timeout := server.Clock.NewTimer(server.options.emptyClusterListTimeout)
+	defer timeout.Stop()
+
+	for {
+		if refresher, ok := server.ClusterList.(clusterlist.Refresher); ok {
+			if err := refresher.Refresh(ctx); err != nil && !errors.Is(err, clusterlist.ErrRefreshUnsupported) {
+				server.Logger.WithError(err).Warn("cannot refresh cluster list")
+			}
+		}
+
+		if len(server.ClusterList.List()) > 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C():
+			return fmt.Errorf("cluster list is still empty after %v", server.options.emptyClusterListTimeout)
+		case <-server.Clock.After(clusterListPollInterval):
+		}
+	}
+}
+
+// handleReadyz reports the server as unready while the cluster list is empty or the server is shutting down.
+// The server stays ready during maintenance mode so that it is not restarted.
+func (server *server) handleReadyz(ctx *gin.Context) {
+	select {
+	case <-server.inflight.shutdown():
+		ctx.String(503, "shutting down")
+		return
+	default:
+	}
+
+	if status := server.maintenanceStatus(); status.Enabled {
+		ctx.String(200, "maintenance: %s", status.Message)
+		return
+	}
+
+	if len(server.ClusterList.List()) == 0 {
+		ctx.String(503, "cluster list is empty")
+		return
+	}
+
+	ctx.String(200, "ok")
+}
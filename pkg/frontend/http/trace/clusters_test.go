@@ -0,0 +1,246 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+// blockingClusterList is a cluster list whose Refresh adds the pending cluster after release is closed.
+type blockingClusterList struct {
+	lock      sync.Mutex
+	clusters  []string
+	pending   string
+	started   chan struct{}
+	release   chan struct{}
+	refreshes int
+}
+
+func (list *blockingClusterList) List() []string {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	return append([]string(nil), list.clusters...)
+}
+
+func (list *blockingClusterList) Refresh(ctx context.Context) error {
+	list.started <- struct{}{}
+	<-list.release
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.refreshes++
+	list.clusters = append(list.clusters, list.pending)
+	return nil
+}
+
+func (list *blockingClusterList) refreshCount() int {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	return list.refreshes
+}
+
+// flakyClusterList is a cluster list whose first Refresh fails and later calls add the pending cluster.
+type flakyClusterList struct {
+	lock      sync.Mutex
+	clusters  []string
+	pending   string
+	refreshes int
+}
+
+func (list *flakyClusterList) List() []string {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	return append([]string(nil), list.clusters...)
+}
+
+func (list *flakyClusterList) Refresh(ctx context.Context) error {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+	list.refreshes++
+	if list.refreshes == 1 {
+		return errors.New("cluster registry is down")
+	}
+	list.clusters = append(list.clusters, list.pending)
+	return nil
+}
+
+func TestSlowClusterRefreshDoesNotBlockOtherRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	clusters := &blockingClusterList{
+		clusters: []string{"test"},
+		pending:  "other",
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+	}
+	mock.SetClusterList(clusters)
+
+	leaderDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		leaderDone <- mock.Request("GET", strings.Replace(errorPathTarget, "cluster=test", "cluster=other", 1), nil)
+	}()
+	<-clusters.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	followerDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		target := strings.Replace(errorPathTarget, "cluster=test", "cluster=third", 1)
+		followerDone <- mock.Serve(httptest.NewRequest("GET", target, nil).WithContext(ctx))
+	}()
+
+	select {
+	case response := <-followerDone:
+		assert.Equal(404, response.Code, response.Body.String())
+	case <-time.After(time.Second):
+		t.Fatal("a request for an unknown cluster is blocked by the refresh in progress")
+	}
+
+	assert.Equal(200, mock.Request("GET", errorPathTarget, nil).Code, "requests for known clusters are not blocked")
+
+	close(clusters.release)
+	leaderResponse := <-leaderDone
+	assert.Equal(200, leaderResponse.Code, leaderResponse.Body.String())
+}
+
+func TestClusterRefreshSurvivesDisconnectOfFirstRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	clusters := &blockingClusterList{
+		clusters: []string{"test"},
+		pending:  "other",
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+	}
+	mock.SetClusterList(clusters)
+
+	target := strings.Replace(errorPathTarget, "cluster=test", "cluster=other", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		leaderDone <- mock.Serve(httptest.NewRequest("GET", target, nil).WithContext(ctx))
+	}()
+	<-clusters.started
+
+	followerDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		followerDone <- mock.Request("GET", target, nil)
+	}()
+	assert.Eventually(func() bool { return mock.ClusterRefreshWaiters() == 2 }, time.Second, time.Millisecond)
+
+	// the first request disconnects while the refresh is in progress
+	cancel()
+	assert.Equal(404, (<-leaderDone).Code)
+
+	close(clusters.release)
+	followerResponse := <-followerDone
+	assert.Equal(200, followerResponse.Code, followerResponse.Body.String())
+	assert.Equal(1, clusters.refreshCount())
+	assert.Equal(1.0, mock.MetricsOutput().Get("extension_trace_cluster_refresh", map[string]string{"resolved": "true"}).Int,
+		"waiters of a shared refresh record the refresh metric")
+}
+
+func TestFailedClusterRefreshDoesNotStartCooldown(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	clusters := &flakyClusterList{clusters: []string{"test"}, pending: "other"}
+	mock.SetClusterList(clusters)
+
+	target := strings.Replace(errorPathTarget, "cluster=test", "cluster=other", 1)
+	assert.Equal(404, mock.Request("GET", target, nil).Code)
+
+	response := mock.Request("GET", target, nil)
+	assert.Equal(200, response.Code, "the request after a failed refresh refreshes again within the cooldown")
+}
+
+func TestReloadClustersSharesRefreshInProgress(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-enable-admin")
+	assert.NoError(err)
+
+	clusters := &blockingClusterList{
+		clusters: []string{"test"},
+		pending:  "other",
+		started:  make(chan struct{}, 2),
+		release:  make(chan struct{}),
+	}
+	mock.SetClusterList(clusters)
+
+	requestDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		requestDone <- mock.Request("GET", strings.Replace(errorPathTarget, "cluster=test", "cluster=other", 1), nil)
+	}()
+	<-clusters.started
+
+	reloadDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		reloadDone <- mock.Request("POST", "/extensions/api/v1/admin/reload-clusters", nil)
+	}()
+	assert.Eventually(func() bool { return mock.ClusterRefreshWaiters() == 2 }, time.Second, time.Millisecond)
+
+	close(clusters.release)
+	assert.Equal(200, (<-requestDone).Code)
+	reloadResponse := <-reloadDone
+	assert.Equal(200, reloadResponse.Code, reloadResponse.Body.String())
+
+	var body struct {
+		Clusters []string `json:"clusters"`
+	}
+	assert.NoError(json.Unmarshal(reloadResponse.Body.Bytes(), &body))
+	assert.Contains(body.Clusters, "other")
+	assert.Equal(1, clusters.refreshCount(), "the reload does not refresh concurrently with the refresh in progress")
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+type coalescedQueryMetric struct{}
+
+func (*coalescedQueryMetric) MetricName() string { return "extension_trace_coalesced_query" }
+
+// coalesceGranularity is the precision of relative windows if queries are coalesced,
+// since windows resolved from the current time of each request would otherwise never be identical.
+const coalesceGranularity = time.Second
+
+// coalescer merges concurrent identical FindTraces calls into one backend call.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	traces  []*model.Trace
+	err     error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: map[string]*coalescedCall{}}
+}
+
+// do waits for the call with the same key, starting a call of fn if none is in progress.
+// The call runs on the context returned by newContext, detached from the callers,
+// so that the cancellation of one caller does not fail the other callers.
+// Each caller stops waiting when its ctx is done, and the call is cancelled when no callers are waiting.
+// Since responses mutate the traces, every caller receives its own copy of the result.
+func (c *coalescer) do(
+	ctx context.Context,
+	key string,
+	newContext func() (context.Context, context.CancelFunc),
+	fn func(ctx context.Context) ([]*model.Trace, error),
+) (traces []*model.Trace, shared bool, err error) {
+	c.mu.Lock()
+	call, inProgress := c.calls[key]
+	if !inProgress {
+		callCtx, cancel := newContext()
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		c.calls[key] = call
+		go c.run(callCtx, key, call, fn)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			c.remove(key, call)
+		}
+		c.mu.Unlock()
+		return nil, inProgress, ctx.Err()
+	}
+
+	if call.err != nil {
+		return nil, inProgress, call.err
+	}
+
+	traces = make([]*model.Trace, len(call.traces))
+	for i, trace := range call.traces {
+		traces[i] = cloneTrace(trace)
+	}
+	return traces, inProgress, nil
+}
+
+func (c *coalescer) run(ctx context.Context, key string, call *coalescedCall, fn func(ctx context.Context) ([]*model.Trace, error)) {
+	defer call.cancel()
+
+	call.traces, call.err = fn(ctx)
+
+	c.mu.Lock()
+	c.remove(key, call)
+	c.mu.Unlock()
+
+	close(call.done)
+}
+
+// remove deletes the call unless it has been replaced by a new call with the same key.
+// Must be called with c.mu locked.
+func (c *coalescer) remove(key string, call *coalescedCall) {
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
+
+// cloneTrace copies the spans, tags and logs of the trace so that they can be mutated independently.
+func cloneTrace(trace *model.Trace) *model.Trace {
+	clone := &model.Trace{
+		ProcessMap: trace.ProcessMap,
+		Warnings:   append([]string(nil), trace.Warnings...),
+		Spans:      make([]*model.Span, len(trace.Spans)),
+	}
+
+	for i, span := range trace.Spans {
+		spanClone := *span
+		spanClone.Tags = append([]model.KeyValue(nil), span.Tags...)
+		spanClone.References = append([]model.SpanRef(nil), span.References...)
+		spanClone.Logs = make([]model.Log, len(span.Logs))
+		for j, log := range span.Logs {
+			spanClone.Logs[j] = model.Log{
+				Timestamp: log.Timestamp,
+				Fields:    append([]model.KeyValue(nil), log.Fields...),
+			}
+		}
+		clone.Spans[i] = &spanClone
+	}
+
+	return clone
+}
+
+// coalesceKey identifies the resolved query parameters.
+func coalesceKey(parameters *spanstore.TraceQueryParameters) string {
+	return fmt.Sprintf(
+		"%s\x00%s\x00%d\x00%d\x00%d\x00%d\x00%d\x00%v",
+		parameters.ServiceName,
+		parameters.OperationName,
+		parameters.StartTimeMin.UnixNano(),
+		parameters.StartTimeMax.UnixNano(),
+		parameters.DurationMin,
+		parameters.DurationMax,
+		parameters.NumTraces,
+		parameters.Tags, // fmt prints maps with sorted keys
+	)
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestCoalescedQuerySurvivesLeaderCancellation(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	var calls int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		reader.lock.Lock()
+		reader.find = nil
+		reader.lock.Unlock()
+		return reader.FindTraces(ctx, query)
+	}
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-coalesce-queries")
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan *httptest.ResponseRecorder)
+	go func() { leaderDone <- mock.Serve(httptest.NewRequest("GET", target, nil).WithContext(leaderCtx)) }()
+	<-started
+
+	followerDone := make(chan *httptest.ResponseRecorder)
+	go func() { followerDone <- mock.Request("GET", target, nil) }()
+	assert.Eventually(func() bool { return mock.CoalescedWaiters() == 2 }, time.Second, time.Millisecond)
+
+	cancelLeader()
+	leaderResponse := <-leaderDone
+	assert.NotEqual(200, leaderResponse.Code)
+
+	close(release)
+	followerResponse := <-followerDone
+	assert.Equal(200, followerResponse.Code, followerResponse.Body.String())
+	assert.Equal(int32(1), atomic.LoadInt32(&calls), "the follower shares the query started by the leader")
+}
+
+func TestCoalescedRelativeQueriesShareWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, int(100*time.Millisecond), time.UTC))
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", clock.Now().Add(-10*time.Minute)))
+
+	var calls int32
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		<-release
+
+		reader.lock.Lock()
+		reader.find = nil
+		reader.lock.Unlock()
+		return reader.FindTraces(ctx, query)
+	}
+
+	mock, err := trace.NewMockHttpServer(clock, reader, []string{"test"}, "--trace-server-coalesce-queries")
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&relative=-1h"
+
+	firstDone := make(chan *httptest.ResponseRecorder)
+	go func() { firstDone <- mock.Request("GET", target, nil) }()
+	<-started
+
+	// the second request resolves its window a few milliseconds later
+	clock.Step(5 * time.Millisecond)
+	secondDone := make(chan *httptest.ResponseRecorder)
+	go func() { secondDone <- mock.Request("GET", target, nil) }()
+	assert.Eventually(func() bool { return mock.CoalescedWaiters() == 2 }, time.Second, time.Millisecond)
+
+	close(release)
+	for _, done := range []chan *httptest.ResponseRecorder{firstDone, secondDone} {
+		response := <-done
+		assert.Equal(200, response.Code, response.Body.String())
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&calls), "relative requests a few milliseconds apart share the query")
+}
@@ -0,0 +1,175 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	// CollapseKeyOperationName selects the operation name as a collapse key instead of a tag.
+	CollapseKeyOperationName = "operationName"
+
+	// CollapsedCountTag is the number of spans collapsed into a span.
+	CollapsedCountTag = "count"
+	// CollapsedRangeTag is the time range covered by the collapsed spans as an RFC3339 interval.
+	CollapsedRangeTag = "timeRange"
+)
+
+var defaultCollapseKeys = []string{CollapseKeyOperationName, "resource", "name", "verb"}
+
+// CollapseRepeats merges consecutive sibling spans with identical values of the collapse keys into the first span,
+// which is extended to cover all merged spans and tagged with CollapsedCountTag and CollapsedRangeTag.
+// Logs and children of merged spans are moved to the first span.
+// Spans without any of the keys are never merged.
+func CollapseRepeats(trace *model.Trace, keys []string) {
+	spanIds := make(map[model.SpanID]struct{}, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spanIds[span.SpanID] = struct{}{}
+	}
+
+	children := map[model.SpanID][]*model.Span{}
+	var roots []*model.Span
+	for _, span := range trace.Spans {
+		parentId := span.ParentSpanID()
+		if _, exists := spanIds[parentId]; parentId == 0 || !exists {
+			roots = append(roots, span)
+		} else {
+			children[parentId] = append(children[parentId], span)
+		}
+	}
+
+	removed := map[model.SpanID]struct{}{}
+	queue := []model.SpanID{}
+	for _, root := range roots {
+		queue = append(queue, root.SpanID)
+	}
+
+	for len(queue) > 0 {
+		parentId := queue[0]
+		queue = queue[1:]
+
+		siblings := children[parentId]
+		sort.SliceStable(siblings, func(i, j int) bool { return siblings[i].StartTime.Before(siblings[j].StartTime) })
+
+		var kept []*model.Span
+		var run []*model.Span
+		flush := func() {
+			if len(run) == 0 {
+				return
+			}
+
+			first := run[0]
+			if len(run) > 1 {
+				mergeRun(first, run[1:], children)
+				for _, span := range run[1:] {
+					removed[span.SpanID] = struct{}{}
+				}
+			}
+			kept = append(kept, first)
+			run = nil
+		}
+
+		for _, span := range siblings {
+			key, hasKey := collapseKey(span, keys)
+			if hasKey && len(run) > 0 {
+				if runKey, _ := collapseKey(run[0], keys); runKey == key {
+					run = append(run, span)
+					continue
+				}
+			}
+
+			flush()
+			run = []*model.Span{span}
+			if !hasKey {
+				flush()
+			}
+		}
+		flush()
+
+		children[parentId] = kept
+		for _, span := range kept {
+			queue = append(queue, span.SpanID)
+		}
+	}
+
+	if len(removed) == 0 {
+		return
+	}
+
+	spans := make([]*model.Span, 0, len(trace.Spans)-len(removed))
+	for _, span := range trace.Spans {
+		if _, isRemoved := removed[span.SpanID]; !isRemoved {
+			spans = append(spans, span)
+		}
+	}
+	trace.Spans = spans
+}
+
+// mergeRun merges the repeated spans into the first span of their run.
+func mergeRun(first *model.Span, repeats []*model.Span, children map[model.SpanID][]*model.Span) {
+	startTime := first.StartTime
+	endTime := spanEnd(first)
+	for _, span := range repeats {
+		if span.StartTime.Before(startTime) {
+			startTime = span.StartTime
+		}
+		if end := spanEnd(span); end.After(endTime) {
+			endTime = end
+		}
+
+		first.Logs = append(first.Logs, span.Logs...)
+
+		for _, child := range children[span.SpanID] {
+			for i := range child.References {
+				if child.References[i].RefType == model.ChildOf && child.References[i].SpanID == span.SpanID {
+					child.References[i].SpanID = first.SpanID
+				}
+			}
+		}
+		children[first.SpanID] = append(children[first.SpanID], children[span.SpanID]...)
+		delete(children, span.SpanID)
+	}
+
+	first.StartTime = startTime
+	first.Duration = endTime.Sub(startTime)
+	first.Tags = append(first.Tags,
+		model.Int64(CollapsedCountTag, int64(len(repeats)+1)),
+		model.String(CollapsedRangeTag, startTime.Format(time.RFC3339Nano)+"/"+endTime.Format(time.RFC3339Nano)),
+	)
+}
+
+// collapseKey returns the values of the collapse keys of the span, and whether the span has any of the keys.
+func collapseKey(span *model.Span, keys []string) (string, bool) {
+	values := make([]string, len(keys))
+	hasKey := false
+	for i, key := range keys {
+		if key == CollapseKeyOperationName {
+			values[i] = span.OperationName
+			hasKey = true
+			continue
+		}
+
+		if kv, ok := model.KeyValues(span.Tags).FindByKey(key); ok {
+			values[i] = kv.AsString()
+			hasKey = true
+		}
+	}
+	return strings.Join(values, "\x00"), hasKey
+}
@@ -0,0 +1,148 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+var (
+	collapseKeys  = []string{trace.CollapseKeyOperationName, "resource", "name", "verb"}
+	collapseStart = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	collapseTrace = model.NewTraceID(1, 1)
+)
+
+func collapseSpan(id uint64, parent uint64, offset time.Duration, verb string) *model.Span {
+	span := &model.Span{
+		TraceID:       collapseTrace,
+		SpanID:        model.SpanID(id),
+		OperationName: verb,
+		StartTime:     collapseStart.Add(offset),
+		Duration:      time.Second,
+		Tags: []model.KeyValue{
+			model.String("resource", "deployments"),
+			model.String("name", "web"),
+			model.String("verb", verb),
+		},
+		Logs: []model.Log{{Fields: []model.KeyValue{model.String("audit", verb)}}},
+	}
+	if parent != 0 {
+		span.References = []model.SpanRef{model.NewChildOfRef(collapseTrace, model.SpanID(parent))}
+	}
+	return span
+}
+
+func findTag(span *model.Span, key string) (model.KeyValue, bool) {
+	return model.KeyValues(span.Tags).FindByKey(key)
+}
+
+func TestCollapseRepeatsMergesReconcileBurst(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &model.Span{TraceID: collapseTrace, SpanID: 1, OperationName: "deployments/web", StartTime: collapseStart}
+	tr := &model.Trace{Spans: []*model.Span{root}}
+	for i := 0; i < 100; i++ {
+		tr.Spans = append(tr.Spans, collapseSpan(uint64(10+i), 1, time.Duration(i)*time.Second*2, "update"))
+	}
+
+	trace.CollapseRepeats(tr, collapseKeys)
+
+	assert.Len(tr.Spans, 2)
+	collapsed := tr.Spans[1]
+	assert.Equal(model.SpanID(10), collapsed.SpanID)
+	assert.Equal(collapseStart, collapsed.StartTime)
+	assert.Equal(199*time.Second, collapsed.Duration)
+	assert.Len(collapsed.Logs, 100)
+
+	count, ok := findTag(collapsed, trace.CollapsedCountTag)
+	assert.True(ok)
+	assert.Equal(int64(100), count.Int64())
+
+	timeRange, ok := findTag(collapsed, trace.CollapsedRangeTag)
+	assert.True(ok)
+	assert.Equal("2023-01-01T00:00:00Z/2023-01-01T00:03:19Z", timeRange.AsString())
+}
+
+func TestCollapseRepeatsOnlyMergesConsecutiveSiblings(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &model.Span{TraceID: collapseTrace, SpanID: 1, StartTime: collapseStart}
+	tr := &model.Trace{Spans: []*model.Span{
+		root,
+		collapseSpan(10, 1, 0, "update"),
+		collapseSpan(11, 1, time.Second, "update"),
+		collapseSpan(12, 1, 2*time.Second, "patch"),
+		collapseSpan(13, 1, 3*time.Second, "update"),
+		// same key under a different parent
+		collapseSpan(14, 13, 4*time.Second, "update"),
+	}}
+
+	trace.CollapseRepeats(tr, collapseKeys)
+
+	ids := []model.SpanID{}
+	for _, span := range tr.Spans {
+		ids = append(ids, span.SpanID)
+	}
+	assert.Equal([]model.SpanID{1, 10, 12, 13, 14}, ids)
+
+	count, _ := findTag(tr.Spans[1], trace.CollapsedCountTag)
+	assert.Equal(int64(2), count.Int64())
+	_, ok := findTag(tr.Spans[3], trace.CollapsedCountTag)
+	assert.False(ok, "an interrupted run is not merged")
+}
+
+func TestCollapseRepeatsReparentsChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	root := &model.Span{TraceID: collapseTrace, SpanID: 1, StartTime: collapseStart}
+	tr := &model.Trace{Spans: []*model.Span{
+		root,
+		collapseSpan(10, 1, 0, "reconcile"),
+		collapseSpan(11, 1, time.Second, "reconcile"),
+		collapseSpan(20, 10, 0, "update"),
+		collapseSpan(21, 11, time.Second, "update"),
+	}}
+
+	trace.CollapseRepeats(tr, collapseKeys)
+
+	assert.Len(tr.Spans, 3)
+	child := tr.Spans[2]
+	assert.Equal(model.SpanID(20), child.SpanID)
+	assert.Equal(model.SpanID(10), child.ParentSpanID())
+
+	count, _ := findTag(child, trace.CollapsedCountTag)
+	assert.Equal(int64(2), count.Int64(), "children moved to the same parent are collapsed too")
+}
+
+func TestCollapseRepeatsIgnoresSpansWithoutKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ref := []model.SpanRef{model.NewChildOfRef(collapseTrace, 1)}
+	tr := &model.Trace{Spans: []*model.Span{
+		{TraceID: collapseTrace, SpanID: 1, StartTime: collapseStart},
+		{TraceID: collapseTrace, SpanID: 2, StartTime: collapseStart, References: ref},
+		{TraceID: collapseTrace, SpanID: 3, StartTime: collapseStart.Add(time.Second), References: ref},
+	}}
+
+	trace.CollapseRepeats(tr, []string{"verb"})
+
+	assert.Len(tr.Spans, 3)
+}
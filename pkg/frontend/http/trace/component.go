@@ -0,0 +1,52 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// defaultComponentTags are the tags identifying the acting component.
+// Event spans have the `source` tag set to the reporting component by the event informer,
+// and audit spans have the `userAgent` tag set by the audit consumer,
+// both of which are mapped to log fields of the same name by the default CollapseNestingVisitor config.
+var defaultComponentTags = []string{"source", "userAgent"}
+
+// componentOf returns the component name in a tag value.
+// User agents such as `kube-controller-manager/v1.27.3 (linux/amd64) kubernetes/abcdef` are truncated
+// to the part before the first slash.
+func componentOf(value string) string {
+	component, _, _ := strings.Cut(value, "/")
+	return component
+}
+
+// filterByComponent keeps only the spans and logs from one of the components, plus the ancestors of matched spans.
+func filterByComponent(trace *model.Trace, componentTags []string, components []string) {
+	filterSpansAndLogs(trace, func(kvs []model.KeyValue) bool {
+		for _, tag := range componentTags {
+			kv, ok := model.KeyValues(kvs).FindByKey(tag)
+			if !ok {
+				continue
+			}
+
+			if containsString(components, componentOf(kv.AsString())) {
+				return true
+			}
+		}
+		return false
+	})
+}
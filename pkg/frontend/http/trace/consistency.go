@@ -0,0 +1,153 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	timeConsistencyKeep   = "keep"
+	timeConsistencyClamp  = "clamp"
+	timeConsistencyExpand = "expand"
+)
+
+// Tags marking the spans whose time range was changed by --trace-server-time-consistency-mode.
+const (
+	timeClampedTag  = "timeClamped"
+	timeExpandedTag = "timeExpanded"
+)
+
+// adjustTimeConsistency handles child spans outside the time range of their parents
+// according to --trace-server-time-consistency-mode, since some viewers reject them.
+// Such spans are common because spans are synthesized from discrete events.
+// Only the response is changed; the stored spans are not affected.
+func (server *server) adjustTimeConsistency(trace *model.Trace) {
+	switch server.options.timeConsistencyMode {
+	case timeConsistencyClamp:
+		clampToParents(trace)
+	case timeConsistencyExpand:
+		expandToChildren(trace)
+	}
+}
+
+// spanTreeOrder returns the spans reachable from the roots in pre-order, where parents precede their children,
+// together with the parent of each span. Spans whose parent is not in the trace are roots.
+func spanTreeOrder(trace *model.Trace) (order []*model.Span, parents map[model.SpanID]*model.Span) {
+	spans := make(map[model.SpanID]*model.Span, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spans[span.SpanID] = span
+	}
+
+	var roots []*model.Span
+	children := map[model.SpanID][]*model.Span{}
+	parents = map[model.SpanID]*model.Span{}
+	for _, span := range trace.Spans {
+		if parent, hasParent := spans[span.ParentSpanID()]; hasParent && span.ParentSpanID() != 0 {
+			children[parent.SpanID] = append(children[parent.SpanID], span)
+			parents[span.SpanID] = parent
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	visited := map[model.SpanID]struct{}{}
+	var visit func(span *model.Span)
+	visit = func(span *model.Span) {
+		if _, seen := visited[span.SpanID]; seen {
+			return
+		}
+		visited[span.SpanID] = struct{}{}
+
+		order = append(order, span)
+		for _, child := range children[span.SpanID] {
+			visit(child)
+		}
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+
+	return order, parents
+}
+
+// clampToParents narrows each span into the time range of its parent, after the parent itself is clamped.
+// A span entirely outside the parent range becomes an instantaneous span at the nearest parent bound.
+func clampToParents(trace *model.Trace) {
+	order, parents := spanTreeOrder(trace)
+	for _, span := range order {
+		parent, hasParent := parents[span.SpanID]
+		if !hasParent {
+			continue
+		}
+
+		start, end := span.StartTime, spanEnd(span)
+		parentStart, parentEnd := parent.StartTime, spanEnd(parent)
+		if !start.Before(parentStart) && !end.After(parentEnd) {
+			continue
+		}
+
+		start = clampTime(start, parentStart, parentEnd)
+		end = clampTime(end, parentStart, parentEnd)
+		span.StartTime = start
+		span.Duration = end.Sub(start)
+		span.Tags = append(span.Tags, model.Bool(timeClampedTag, true))
+	}
+}
+
+func clampTime(t time.Time, min time.Time, max time.Time) time.Time {
+	if t.Before(min) {
+		return min
+	}
+	if t.After(max) {
+		return max
+	}
+	return t
+}
+
+// expandToChildren widens each span to encompass its children, after the children themselves are expanded.
+func expandToChildren(trace *model.Trace) {
+	order, parents := spanTreeOrder(trace)
+	expanded := map[model.SpanID]struct{}{}
+
+	// children precede their parents in the reverse pre-order
+	for i := len(order) - 1; i >= 0; i-- {
+		span := order[i]
+		parent, hasParent := parents[span.SpanID]
+		if !hasParent {
+			continue
+		}
+
+		start, end := parent.StartTime, spanEnd(parent)
+		if span.StartTime.Before(start) {
+			start = span.StartTime
+		}
+		if childEnd := spanEnd(span); childEnd.After(end) {
+			end = childEnd
+		}
+		if start.Equal(parent.StartTime) && end.Equal(spanEnd(parent)) {
+			continue
+		}
+
+		parent.StartTime = start
+		parent.Duration = end.Sub(start)
+		if _, tagged := expanded[parent.SpanID]; !tagged {
+			expanded[parent.SpanID] = struct{}{}
+			parent.Tags = append(parent.Tags, model.Bool(timeExpandedTag, true))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	danglingRefsKeep     = "keep"
+	danglingRefsWarn     = "warn"
+	danglingRefsReparent = "reparent"
+)
+
+type danglingRefMetric struct{}
+
+func (*danglingRefMetric) MetricName() string { return "extension_trace_dangling_ref" }
+
+// truncatedByBackendWarning is the prefix of the trace warning added for dangling references.
+const truncatedByBackendWarning = "truncated_by_backend: true"
+
+// handleDanglingRefs detects spans whose parent is missing from the trace,
+// which indicates that the storage returned a truncated trace,
+// and handles them according to --trace-server-dangling-refs.
+// Returns the number of spans with dangling references.
+func (server *server) handleDanglingRefs(trace *model.Trace) int {
+	if server.options.danglingRefs == danglingRefsKeep {
+		return 0
+	}
+
+	orphans := danglingSpans(trace)
+	if len(orphans) == 0 {
+		return 0
+	}
+
+	trace.Warnings = append(trace.Warnings, fmt.Sprintf(
+		"%s; %d spans reference parents missing from the trace, the storage may have truncated the trace",
+		truncatedByBackendWarning, len(orphans),
+	))
+
+	if server.options.danglingRefs == danglingRefsReparent {
+		if root := findRootSpan(trace, server.rootTag); root != nil {
+			for _, orphan := range orphans {
+				if orphan != root {
+					reparent(orphan, root)
+				}
+			}
+		}
+	}
+
+	return len(orphans)
+}
+
+func danglingSpans(trace *model.Trace) []*model.Span {
+	spanIds := make(map[model.SpanID]struct{}, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spanIds[span.SpanID] = struct{}{}
+	}
+
+	var orphans []*model.Span
+	for _, span := range trace.Spans {
+		if parentId := span.ParentSpanID(); parentId != 0 {
+			if _, exists := spanIds[parentId]; !exists {
+				orphans = append(orphans, span)
+			}
+		}
+	}
+	return orphans
+}
+
+// reparent replaces the reference to the missing parent of the span with a ChildOf reference to the new parent.
+func reparent(span *model.Span, parent *model.Span) {
+	missingId := span.ParentSpanID()
+
+	references := make([]model.SpanRef, 0, len(span.References))
+	for _, ref := range span.References {
+		if ref.SpanID != missingId {
+			references = append(references, ref)
+		}
+	}
+	span.References = append(references, model.NewChildOfRef(parent.TraceID, parent.SpanID))
+}
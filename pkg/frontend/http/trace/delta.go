@@ -0,0 +1,242 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"k8s.io/utils/clock"
+)
+
+const (
+	// deltaTokenHeader is the response header with the token of the returned trace for the since param of the next poll.
+	deltaTokenHeader = "X-Kelemetry-Delta-Token"
+	// deltaResetHeader is set if the since token is unknown or expired and the full trace is returned.
+	deltaResetHeader = "X-Kelemetry-Delta-Reset"
+)
+
+// deltaBase is the part of the trace held by the client.
+type deltaBase struct {
+	// traceId is the trace ID held by the client; the reader assigns a new trace ID on every query.
+	traceId model.TraceID
+	// spans are the held spans keyed by identity, since pseudo and virtual spans get a new ID on every query.
+	spans map[spanIdentity]heldSpan
+}
+
+// heldSpan is a span held by the client.
+type heldSpan struct {
+	// spanId is the ID of the span in the response that the client holds it from.
+	spanId model.SpanID
+	cursor logCursor
+}
+
+// logCursor identifies the logs of a span seen by the client by the latest seen timestamp,
+// since counting logs is unstable when older logs are trimmed by max_logs_per_span and similar params.
+type logCursor struct {
+	// latest is the UnixNano timestamp of the latest seen log, or 0 if no logs are seen.
+	latest int64
+	// atLatest is the number of seen logs with the latest timestamp.
+	atLatest int
+}
+
+// parseSinceSpanIds parses the since_span_ids param.
+func parseSinceSpanIds(spanIds []string) (map[model.SpanID]struct{}, error) {
+	parsed := map[model.SpanID]struct{}{}
+	for _, values := range spanIds {
+		for _, value := range strings.Split(values, ",") {
+			spanId, err := model.SpanIDFromString(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid span ID %q in since_span_ids: %w", value, err)
+			}
+			parsed[spanId] = struct{}{}
+		}
+	}
+	return parsed, nil
+}
+
+// applyDelta removes the spans and logs held by the client from the trace,
+// returning the part of the trace held by the client after the response.
+//
+// Spans in the base or in heldIds are matched by identity or by span ID respectively.
+// Spans in the base with new logs are kept with only the logs after the latest seen log,
+// assuming that new logs are not older than the seen logs.
+// The returned spans and their references are renamed to the trace ID and span IDs held by the client.
+// The logs must be sorted by sortLogs.
+func applyDelta(trace *model.Trace, base deltaBase, heldIds map[model.SpanID]struct{}) deltaBase {
+	next := deltaBase{traceId: base.traceId, spans: make(map[spanIdentity]heldSpan, len(trace.Spans))}
+	if next.traceId == (model.TraceID{}) && len(trace.Spans) > 0 {
+		next.traceId = trace.Spans[0].TraceID
+	}
+
+	identities := spanIdentities(trace)
+	clientIds := make(map[model.SpanID]model.SpanID, len(trace.Spans))
+	for _, span := range trace.Spans {
+		clientId := span.SpanID
+		if held, isHeld := base.spans[identities[span.SpanID]]; isHeld {
+			clientId = held.spanId
+		}
+		clientIds[span.SpanID] = clientId
+	}
+
+	kept := make([]*model.Span, 0, len(trace.Spans))
+	for _, span := range trace.Spans {
+		identity := identities[span.SpanID]
+		clientId := clientIds[span.SpanID]
+		next.spans[identity] = heldSpan{spanId: clientId, cursor: latestLogCursor(span.Logs)}
+
+		if _, heldById := heldIds[clientId]; heldById {
+			continue
+		}
+
+		if held, isHeld := base.spans[identity]; isHeld {
+			newLogs := logsAfter(span.Logs, held.cursor)
+			if len(newLogs) == 0 {
+				continue
+			}
+			span.Logs = newLogs
+		}
+
+		span.TraceID = next.traceId
+		span.SpanID = clientId
+		for i := range span.References {
+			ref := &span.References[i]
+			ref.TraceID = next.traceId
+			if refId, exists := clientIds[ref.SpanID]; exists {
+				ref.SpanID = refId
+			}
+		}
+		kept = append(kept, span)
+	}
+	trace.Spans = kept
+
+	return next
+}
+
+// latestLogCursor returns the cursor of the latest log in the sorted logs.
+func latestLogCursor(logs []model.Log) logCursor {
+	cursor := logCursor{}
+	for _, log := range logs {
+		if timestamp := log.Timestamp.UnixNano(); timestamp > cursor.latest {
+			cursor = logCursor{latest: timestamp, atLatest: 1}
+		} else if timestamp == cursor.latest {
+			cursor.atLatest++
+		}
+	}
+	return cursor
+}
+
+// logsAfter returns the sorted logs after the cursor.
+func logsAfter(logs []model.Log, cursor logCursor) []model.Log {
+	var newLogs []model.Log
+	skipped := 0
+	for _, log := range logs {
+		timestamp := log.Timestamp.UnixNano()
+		if timestamp < cursor.latest {
+			continue
+		}
+		if timestamp == cursor.latest && skipped < cursor.atLatest {
+			skipped++
+			continue
+		}
+		newLogs = append(newLogs, log)
+	}
+	return newLogs
+}
+
+// sortLogs sorts the logs of each span by timestamp so that logs with the same timestamp are in a stable order.
+func sortLogs(trace *model.Trace) {
+	for _, span := range trace.Spans {
+		logs := span.Logs
+		sort.SliceStable(logs, func(i, j int) bool { return logs[i].Timestamp.Before(logs[j].Timestamp) })
+	}
+}
+
+// deltaStore keeps the part of the trace held by each polling client behind an opaque token,
+// so that the since token stays small regardless of the trace size.
+// Tokens are only known to the replica that issued them.
+type deltaStore struct {
+	clock      clock.Clock
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]deltaEntry
+}
+
+type deltaEntry struct {
+	base   deltaBase
+	expiry time.Time
+}
+
+func newDeltaStore(clock clock.Clock, ttl time.Duration, maxEntries int) *deltaStore {
+	return &deltaStore{
+		clock:      clock,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]deltaEntry{},
+	}
+}
+
+// put stores the base under a new token, evicting the entry expiring first if the store is full.
+func (store *deltaStore) put(base deltaBase) (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("cannot generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := store.clock.Now()
+	for len(store.entries) >= store.maxEntries {
+		oldestToken := ""
+		var oldestExpiry time.Time
+		for otherToken, entry := range store.entries {
+			if oldestToken == "" || entry.expiry.Before(oldestExpiry) {
+				oldestToken, oldestExpiry = otherToken, entry.expiry
+			}
+		}
+		delete(store.entries, oldestToken)
+	}
+
+	store.entries[token] = deltaEntry{base: base, expiry: now.Add(store.ttl)}
+	return token, nil
+}
+
+// get returns the base of an unexpired token.
+func (store *deltaStore) get(token string) (deltaBase, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, exists := store.entries[token]
+	if !exists {
+		return deltaBase{}, false
+	}
+
+	if !store.clock.Now().Before(entry.expiry) {
+		delete(store.entries, token)
+		return deltaBase{}, false
+	}
+
+	return entry.base, true
+}
@@ -0,0 +1,210 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+const deltaTarget = "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+	"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z&since="
+
+type deltaResponse struct {
+	TraceId string `json:"traceID"`
+	Spans   []struct {
+		SpanId        string `json:"spanID"`
+		OperationName string `json:"operationName"`
+		References    []struct {
+			SpanId string `json:"spanID"`
+		} `json:"references"`
+	} `json:"spans"`
+}
+
+func TestDeltaWithMaxLogsPerSpan(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	span := auditSpan(1, "update", now.Add(-50*time.Minute))
+	for i := 1; i < 10; i++ {
+		span.Logs = append(span.Logs, model.Log{
+			Timestamp: span.StartTime.Add(time.Duration(i) * time.Second),
+			Fields:    []model.KeyValue{model.Int64("audit", int64(i))},
+		})
+	}
+	reader := newFakeReader()
+	reader.addObject("web", span)
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z&max_logs_per_span=10&since="
+
+	response := mock.Request("GET", target, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	token := response.Header().Get("X-Kelemetry-Delta-Token")
+	assert.NotEmpty(token)
+
+	// 5 new logs push the 5 oldest logs out of max_logs_per_span, so the span still returns 10 logs
+	for i := 10; i < 15; i++ {
+		span.Logs = append(span.Logs, model.Log{
+			Timestamp: span.StartTime.Add(time.Duration(i) * time.Second),
+			Fields:    []model.KeyValue{model.Int64("audit", int64(i))},
+		})
+	}
+
+	response = mock.Request("GET", target+token, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var body struct {
+		Spans []struct {
+			SpanId string `json:"spanID"`
+			Logs   []struct {
+				Fields []struct {
+					Value any `json:"value"`
+				} `json:"fields"`
+			} `json:"logs"`
+		} `json:"spans"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	if assert.Len(body.Spans, 1, "only the span with new logs is returned") {
+		returned := body.Spans[0]
+		assert.Equal("0000000000000001", returned.SpanId)
+		values := []any{}
+		for _, log := range returned.Logs {
+			values = append(values, log.Fields[0].Value)
+		}
+		assert.Equal([]any{10.0, 11.0, 12.0, 13.0, 14.0}, values)
+	}
+}
+
+func TestDeltaTokenIsCompact(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	spans := []*model.Span{}
+	for i := 1; i <= 1000; i++ {
+		spans = append(spans, auditSpan(uint64(i), "update", now.Add(-50*time.Minute+time.Duration(i)*time.Second)))
+	}
+	reader := newFakeReader()
+	reader.addObject("web", spans...)
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	response := mock.Request("GET", deltaTarget, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	token := response.Header().Get("X-Kelemetry-Delta-Token")
+	assert.NotEmpty(token)
+	assert.Less(len(token), 64, "the token does not grow with the trace")
+
+	response = mock.Request("GET", deltaTarget+token, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	var body deltaResponse
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Empty(body.Spans, "all spans are held by the client")
+}
+
+func TestDeltaMatchesPseudoSpansWithNewIds(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	withUpdate := false
+	reader := newFakeReader()
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		// like the reader, every query returns a new trace ID and pseudo span ID
+		traceId := model.NewTraceID(rand.Uint64(), rand.Uint64())
+		pseudo := &model.Span{
+			TraceID:       traceId,
+			SpanID:        model.SpanID(rand.Uint64()),
+			OperationName: "pods web",
+			StartTime:     query.StartTimeMin,
+			Duration:      query.StartTimeMax.Sub(query.StartTimeMin),
+			Tags: []model.KeyValue{
+				model.String(zconstants.PseudoType, string(zconstants.PseudoTypeObject)),
+				model.String("resource", "pods"),
+				model.String("name", "web"),
+			},
+			Process: &model.Process{ServiceName: "test"},
+		}
+		spans := []*model.Span{pseudo, auditSpan(1, "create", now.Add(-50*time.Minute))}
+		if withUpdate {
+			spans = append(spans, auditSpan(2, "update", now.Add(-40*time.Minute)))
+		}
+		for _, span := range spans[1:] {
+			span.TraceID = traceId
+			span.References = []model.SpanRef{model.NewChildOfRef(traceId, pseudo.SpanID)}
+		}
+		return []*model.Trace{{Spans: spans}}, nil
+	}
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	response := mock.Request("GET", deltaTarget, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	var first deltaResponse
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &first))
+	var pseudoId string
+	for _, span := range first.Spans {
+		if span.OperationName == "pods web" {
+			pseudoId = span.SpanId
+		}
+	}
+	assert.NotEmpty(pseudoId)
+
+	withUpdate = true
+	response = mock.Request("GET", deltaTarget+response.Header().Get("X-Kelemetry-Delta-Token"), nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	var second deltaResponse
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &second))
+
+	assert.Equal(first.TraceId, second.TraceId, "deltas reuse the held trace ID")
+	if assert.Len(second.Spans, 1, "pseudo spans with new IDs are not returned again") {
+		assert.Equal("update", second.Spans[0].OperationName)
+		assert.Equal(pseudoId, second.Spans[0].References[0].SpanId, "new spans reference the held pseudo span")
+	}
+}
+
+func TestDeltaUnknownTokenResets(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-50*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	response := mock.Request("GET", deltaTarget+"unknown", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	assert.Equal("true", response.Header().Get("X-Kelemetry-Delta-Reset"))
+	assert.NotEmpty(response.Header().Get("X-Kelemetry-Delta-Token"))
+	var body deltaResponse
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.Len(body.Spans, 2, "the full trace is returned")
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+type diffQuery struct {
+	TsA string `form:"ts_a"`
+	TsB string `form:"ts_b"`
+}
+
+// traceDiff is the response of /extensions/api/v1/trace/diff.
+type traceDiff struct {
+	TraceIdA string `json:"traceIDA"`
+	TraceIdB string `json:"traceIDB"`
+
+	// Spans only in trace B.
+	Added []spanSummary `json:"added"`
+	// Spans only in trace A.
+	Removed []spanSummary `json:"removed"`
+	// Spans in both traces with different tags, duration or logs.
+	Changed []spanChange `json:"changed"`
+
+	// Differences between the root span tags, which describe the object state.
+	ObjectTags map[string]tagChange `json:"objectTags"`
+}
+
+type spanSummary struct {
+	SpanId        string `json:"spanID"`
+	OperationName string `json:"operationName"`
+}
+
+type spanChange struct {
+	spanSummary
+	DurationA uint64               `json:"durationA"`
+	DurationB uint64               `json:"durationB"`
+	LogsA     int                  `json:"logsA"`
+	LogsB     int                  `json:"logsB"`
+	Tags      map[string]tagChange `json:"tags,omitempty"`
+}
+
+// tagChange is the value of a tag in each trace. Missing tags are omitted.
+type tagChange struct {
+	A *string `json:"a,omitempty"`
+	B *string `json:"b,omitempty"`
+}
+
+// handleDiff fetches the traces of the object in the aggregator buckets containing ts_a and ts_b and compares their spans.
+func (server *server) handleDiff(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	params := append([]string{"ts_a", "ts_b"}, knownParams...)
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), params); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), params); err != nil {
+		return code, err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	diffParams := diffQuery{}
+	if err := ctx.BindQuery(&diffParams); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if query.Relative != "" || query.Start != "" || query.End != "" {
+		return metric.fail(classConflictingParams), fmt.Errorf("diff uses ts_a and ts_b instead of relative, start and end")
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	traces := [2]*model.Trace{}
+	for i, ts := range []string{diffParams.TsA, diffParams.TsB} {
+		tsTime, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return metric.fail(classInvalidTimestamp), fmt.Errorf("invalid timestamp for ts_a/ts_b param %w", err)
+		}
+
+		// the reader drops non-pseudo spans outside the query window, so query the whole bucket containing ts
+		window := server.bucketWindow(tsTime)
+		tsQuery := query
+		tsQuery.Start = window.start.Format(time.RFC3339)
+		tsQuery.End = window.end.Format(time.RFC3339)
+
+		trace, _, code, err := server.fetchTrace(ctx.Request.Context(), metric, tsQuery)
+		if err != nil {
+			return code, fmt.Errorf("cannot fetch trace at %s: %w", ts, err)
+		}
+
+		server.pruneTrace(trace, query.SpanType)
+		server.filterTagKeys(trace)
+		traces[i] = trace
+	}
+
+	return server.writeResponse(ctx, metric, diffTraces(traces[0], traces[1], server.rootTag))
+}
+
+func diffTraces(traceA, traceB *model.Trace, tag rootTag) *traceDiff {
+	diff := &traceDiff{
+		Added:   []spanSummary{},
+		Removed: []spanSummary{},
+		Changed: []spanChange{},
+	}
+
+	if len(traceA.Spans) > 0 {
+		diff.TraceIdA = traceA.Spans[0].TraceID.String()
+	}
+	if len(traceB.Spans) > 0 {
+		diff.TraceIdB = traceB.Spans[0].TraceID.String()
+	}
+
+	// each aggregator bucket stores its own spans with their own IDs, so spans are matched by identity
+	identitiesA := spanIdentities(traceA)
+	spansA := make(map[spanIdentity]*model.Span, len(traceA.Spans))
+	for _, span := range traceA.Spans {
+		spansA[identitiesA[span.SpanID]] = span
+	}
+
+	identitiesB := spanIdentities(traceB)
+	spansB := make(map[spanIdentity]*model.Span, len(traceB.Spans))
+	for _, span := range traceB.Spans {
+		identity := identitiesB[span.SpanID]
+		spansB[identity] = span
+
+		spanA, exists := spansA[identity]
+		if !exists {
+			diff.Added = append(diff.Added, summarizeSpan(span))
+			continue
+		}
+
+		tags := diffTags(spanA.Tags, span.Tags)
+		if len(tags) > 0 || spanA.Duration != span.Duration || len(spanA.Logs) != len(span.Logs) {
+			diff.Changed = append(diff.Changed, spanChange{
+				spanSummary: summarizeSpan(span),
+				DurationA:   model.DurationAsMicroseconds(spanA.Duration),
+				DurationB:   model.DurationAsMicroseconds(span.Duration),
+				LogsA:       len(spanA.Logs),
+				LogsB:       len(span.Logs),
+				Tags:        tags,
+			})
+		}
+	}
+
+	for _, span := range traceA.Spans {
+		if _, exists := spansB[identitiesA[span.SpanID]]; !exists {
+			diff.Removed = append(diff.Removed, summarizeSpan(span))
+		}
+	}
+
+	rootA, rootB := findRootSpan(traceA, tag), findRootSpan(traceB, tag)
+	var rootTagsA, rootTagsB []model.KeyValue
+	if rootA != nil {
+		rootTagsA = rootA.Tags
+	}
+	if rootB != nil {
+		rootTagsB = rootB.Tags
+	}
+	diff.ObjectTags = diffTags(rootTagsA, rootTagsB)
+
+	for _, list := range [][]spanSummary{diff.Added, diff.Removed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].SpanId < list[j].SpanId })
+	}
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].SpanId < diff.Changed[j].SpanId })
+
+	return diff
+}
+
+func summarizeSpan(span *model.Span) spanSummary {
+	return spanSummary{
+		SpanId:        span.SpanID.String(),
+		OperationName: span.OperationName,
+	}
+}
+
+// diffTags returns the tags whose values differ between a and b.
+func diffTags(tagsA, tagsB []model.KeyValue) map[string]tagChange {
+	valuesA := make(map[string]string, len(tagsA))
+	for _, tag := range tagsA {
+		valuesA[tag.Key] = tag.AsString()
+	}
+
+	valuesB := make(map[string]string, len(tagsB))
+	for _, tag := range tagsB {
+		valuesB[tag.Key] = tag.AsString()
+	}
+
+	changes := map[string]tagChange{}
+	for key, valueA := range valuesA {
+		valueA := valueA
+		if valueB, exists := valuesB[key]; !exists {
+			changes[key] = tagChange{A: &valueA}
+		} else if valueA != valueB {
+			valueB := valueB
+			changes[key] = tagChange{A: &valueA, B: &valueB}
+		}
+	}
+	for key, valueB := range valuesB {
+		valueB := valueB
+		if _, exists := valuesA[key]; !exists {
+			changes[key] = tagChange{B: &valueB}
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func TestDiffQueriesBucketOfTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web",
+		auditSpan(1, "create", now.Add(-50*time.Minute)),
+		auditSpan(2, "update", now.Add(-10*time.Minute)),
+	)
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-bucket-duration=30m")
+	assert.NoError(err)
+
+	// ts_a is in the bucket [11:00, 11:30) and ts_b in [11:30, 12:00)
+	response := mock.Request("GET", "/extensions/api/v1/trace/diff?cluster=test&resource=pods&namespace=default&name=web"+
+		"&ts_a=2023-01-01T11:20:00Z&ts_b=2023-01-01T11:40:00Z", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var diff struct {
+		Added []struct {
+			SpanId string `json:"spanID"`
+		} `json:"added"`
+		Removed []struct {
+			SpanId string `json:"spanID"`
+		} `json:"removed"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &diff))
+
+	assert.Len(diff.Added, 1)
+	if len(diff.Added) > 0 {
+		assert.Equal("0000000000000002", diff.Added[0].SpanId)
+	}
+	assert.Len(diff.Removed, 1)
+	if len(diff.Removed) > 0 {
+		assert.Equal("0000000000000001", diff.Removed[0].SpanId)
+	}
+}
+
+func TestDiffMatchesSpansAcrossBucketsWithDifferentIds(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	updateStart := time.Date(2023, 1, 1, 11, 10, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		// like the aggregator, each bucket stores its own spans of the object with their own IDs
+		traceId := model.NewTraceID(rand.Uint64(), rand.Uint64())
+		pseudo := &model.Span{
+			SpanID:        model.SpanID(rand.Uint64()),
+			OperationName: "pods web",
+			StartTime:     query.StartTimeMin,
+			Duration:      query.StartTimeMax.Sub(query.StartTimeMin),
+			Tags: []model.KeyValue{
+				model.String(zconstants.TraceSource, zconstants.TraceSourceObject),
+				model.String("resource", "pods"),
+				model.String("name", "web"),
+			},
+			Process: &model.Process{ServiceName: "test"},
+		}
+		update := auditSpan(rand.Uint64(), "update", updateStart)
+		if query.StartTimeMin.After(updateStart) {
+			update.Logs = append(update.Logs, model.Log{Timestamp: updateStart.Add(30 * time.Minute)})
+		}
+		spans := []*model.Span{pseudo, update}
+		for _, span := range spans {
+			span.TraceID = traceId
+		}
+		update.References = []model.SpanRef{model.NewChildOfRef(traceId, pseudo.SpanID)}
+		return []*model.Trace{{Spans: spans}}, nil
+	}
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-bucket-duration=30m")
+	assert.NoError(err)
+
+	response := mock.Request("GET", "/extensions/api/v1/trace/diff?cluster=test&resource=pods&namespace=default&name=web"+
+		"&ts_a=2023-01-01T11:20:00Z&ts_b=2023-01-01T11:40:00Z", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var diff struct {
+		Added   []any `json:"added"`
+		Removed []any `json:"removed"`
+		Changed []struct {
+			OperationName string `json:"operationName"`
+			LogsA         int    `json:"logsA"`
+			LogsB         int    `json:"logsB"`
+		} `json:"changed"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &diff))
+
+	assert.Empty(diff.Added, "spans of the same object are not added again with new IDs")
+	assert.Empty(diff.Removed)
+	if assert.Len(diff.Changed, 1) {
+		assert.Equal("update", diff.Changed[0].OperationName)
+		assert.Equal(1, diff.Changed[0].LogsA)
+		assert.Equal(2, diff.Changed[0].LogsB)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// inflightTracker tracks the requests being handled so that shutdown can wait for them.
+type inflightTracker struct {
+	lock  sync.Mutex
+	count int
+	// idle is closed when the count drops to zero. It is nil if there are no requests in flight.
+	idle chan struct{}
+	// closing is closed when shutdown starts. It is created on first use.
+	closing chan struct{}
+	closed  bool
+}
+
+// begin marks the start of a request. The returned function must be called exactly once when the request ends.
+// Returns false without marking the request if shutdown has started,
+// since the metrics of requests ending after the drain would not be flushed.
+func (tracker *inflightTracker) begin() (end func(), accepted bool) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.closed {
+		return nil, false
+	}
+
+	if tracker.count == 0 {
+		tracker.idle = make(chan struct{})
+	}
+	tracker.count++
+
+	return func() {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+
+		tracker.count--
+		if tracker.count == 0 {
+			close(tracker.idle)
+			tracker.idle = nil
+		}
+	}, true
+}
+
+// close rejects all subsequent requests and notifies long-running requests to end.
+func (tracker *inflightTracker) close() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if !tracker.closed {
+		tracker.closed = true
+		close(tracker.closingLocked())
+	}
+}
+
+// shutdown returns a channel closed when shutdown starts.
+func (tracker *inflightTracker) shutdown() <-chan struct{} {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	return tracker.closingLocked()
+}
+
+func (tracker *inflightTracker) closingLocked() chan struct{} {
+	if tracker.closing == nil {
+		tracker.closing = make(chan struct{})
+	}
+	return tracker.closing
+}
+
+// wait blocks until there are no requests in flight or ctx is canceled.
+func (tracker *inflightTracker) wait(ctx context.Context) error {
+	tracker.lock.Lock()
+	idle := tracker.idle
+	tracker.lock.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainAndFlush rejects new requests with 503 and ends trace streams,
+// waits up to --trace-server-shutdown-drain-timeout for in-flight requests,
+// then flushes the metrics client so that the observations of the drained requests are exported.
+// The metrics client is flushed at most once even if called repeatedly.
+func (server *server) drainAndFlush(ctx context.Context) error {
+	server.inflight.close()
+
+	if server.options.shutdownDrainTimeout > 0 {
+		drainCtx, cancelFunc := context.WithTimeout(ctx, server.options.shutdownDrainTimeout)
+		defer cancelFunc()
+
+		if err := server.inflight.wait(drainCtx); err != nil {
+			server.Logger.WithError(err).Warn("in-flight requests did not complete before shutdown")
+		}
+	}
+
+	var err error
+	server.flushOnce.Do(func() {
+		if server.flushMetrics == nil {
+			return
+		}
+		if flushErr := server.flushMetrics(ctx); flushErr != nil {
+			err = fmt.Errorf("cannot flush metrics: %w", flushErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestCloseFlushesMetricsOnceAfterDraining(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{}, "--trace-server-shutdown-drain-timeout=10s")
+	assert.NoError(err)
+
+	var flushes atomic.Int32
+	var endedBeforeFlush atomic.Bool
+	var ended atomic.Bool
+	mock.SetMetricsFlusher(func(ctx context.Context) error {
+		endedBeforeFlush.Store(ended.Load())
+		flushes.Add(1)
+		return nil
+	})
+
+	endRequest, accepted := mock.BeginRequest()
+	assert.True(accepted)
+
+	closed := make(chan error, 1)
+	go func() { closed <- mock.Close(context.Background()) }()
+
+	select {
+	case <-closed:
+		assert.Fail("Close returned before the in-flight request ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(int32(0), flushes.Load(), "metrics must not be flushed while requests are in flight")
+
+	ended.Store(true)
+	endRequest()
+
+	assert.NoError(<-closed)
+	assert.Equal(int32(1), flushes.Load())
+	assert.True(endedBeforeFlush.Load(), "metrics must be flushed after the in-flight request ends")
+
+	assert.NoError(mock.Close(context.Background()))
+	assert.Equal(int32(1), flushes.Load(), "repeated Close must not flush again")
+}
+
+func TestCloseFlushesMetricsAfterDrainTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{}, "--trace-server-shutdown-drain-timeout=10ms")
+	assert.NoError(err)
+
+	var flushes atomic.Int32
+	mock.SetMetricsFlusher(func(ctx context.Context) error {
+		flushes.Add(1)
+		return nil
+	})
+
+	endRequest, accepted := mock.BeginRequest()
+	assert.True(accepted)
+	defer endRequest()
+
+	assert.NoError(mock.Close(context.Background()))
+	assert.Equal(int32(1), flushes.Load(), "a stuck request must not prevent flushing")
+}
+
+func TestCloseRejectsNewRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockHttpServer(clock.RealClock{}, newFakeReader(), []string{"test"})
+	assert.NoError(err)
+
+	var flushes atomic.Int32
+	mock.SetMetricsFlusher(func(ctx context.Context) error {
+		flushes.Add(1)
+		return nil
+	})
+	assert.NoError(mock.Close(context.Background()))
+
+	_, accepted := mock.BeginRequest()
+	assert.False(accepted, "requests after shutdown starts would be recorded after the flush")
+
+	response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web", nil)
+	assert.Equal(503, response.Code)
+	response = mock.Request("GET", "/extensions/api/v1/trace/stream?cluster=test&resource=pods&namespace=default&name=web", nil)
+	assert.Equal(503, response.Code)
+	assert.Equal(int32(1), flushes.Load())
+}
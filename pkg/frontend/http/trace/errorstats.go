@@ -0,0 +1,148 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// errorLogField is the log field that realError logs are mapped to by the default logTypeMapping in tfconfig.
+const errorLogField = "error"
+
+// errorStats is the response of /extensions/api/v1/error-stats.
+//
+// Accuracy depends on the aggregator marking errors, i.e. the diff decorator logging failed audit responses
+// as zconstants.LogTypeRealError, or spans setting the `error` tag.
+type errorStats struct {
+	Traces int `json:"traces"`
+	// Truncated is true if more traces than --trace-server-error-stats-max-traces matched the window.
+	Truncated bool                           `json:"truncated"`
+	Resources map[string]*resourceErrorStats `json:"resources"`
+}
+
+type resourceErrorStats struct {
+	Spans      int `json:"spans"`
+	ErrorSpans int `json:"errorSpans"`
+}
+
+// handleErrorStats counts the spans with errors per resource in the traces of a cluster in the window.
+func (server *server) handleErrorStats(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), knownParams); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), knownParams); err != nil {
+		return code, err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if query.Cluster == "" {
+		return metric.fail(classEmptyParam), fmt.Errorf("cluster is empty")
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	if !server.ensureCluster(ctx.Request.Context(), query.Cluster) {
+		return metric.fail(classUnknownCluster), fmt.Errorf("cluster %s not supported now", query.Cluster)
+	}
+
+	startTime, endTime, err := server.resolveWindow(query)
+	if err != nil {
+		return metric.fail(classInvalidTimestamp), err
+	}
+
+	maxTraces := server.options.errorStatsMaxTraces
+	parameters := &spanstore.TraceQueryParameters{
+		ServiceName:   query.DisplayMode,
+		OperationName: query.Cluster,
+		Tags:          map[string]string{},
+		StartTimeMin:  startTime,
+		StartTimeMax:  endTime,
+		// one more than the limit to detect truncation
+		NumTraces: maxTraces + 1,
+	}
+
+	queryCtx, cancelFunc := server.queryContext(ctx.Request.Context(), query.Cluster)
+	defer cancelFunc()
+
+	traces, err := server.queryStorage(ctx.Request.Context(), queryCtx, query.Cluster, parameters)
+	if err != nil {
+		if errors.Is(err, errFanoutTooLarge) {
+			return metric.fail(classFanoutTooLarge), err
+		}
+		return metric.fail(classTraceError), fmt.Errorf("failed to find traces %w", err)
+	}
+
+	stats := &errorStats{Resources: map[string]*resourceErrorStats{}}
+	if len(traces) > maxTraces {
+		traces = traces[:maxTraces]
+		stats.Truncated = true
+	}
+	stats.Traces = len(traces)
+
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			resourceTag, hasResource := model.KeyValues(span.Tags).FindByKey("resource")
+			if !hasResource {
+				continue
+			}
+
+			resource := resourceTag.AsString()
+			resourceStats, exists := stats.Resources[resource]
+			if !exists {
+				resourceStats = &resourceErrorStats{}
+				stats.Resources[resource] = resourceStats
+			}
+
+			resourceStats.Spans++
+			if spanHasError(span) {
+				resourceStats.ErrorSpans++
+			}
+		}
+	}
+
+	return server.writeResponse(ctx, metric, stats)
+}
+
+func spanHasError(span *model.Span) bool {
+	if hasValue(span.Tags, "error", "true") {
+		return true
+	}
+
+	for _, log := range span.Logs {
+		if _, ok := model.KeyValues(log.Fields).FindByKey(errorLogField); ok {
+			return true
+		}
+		if hasValue(log.Fields, zconstants.LogTypeAttr, string(zconstants.LogTypeRealError)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// fetchEventTraces finds the traces of the query in --trace-server-events-service.
+// Returns no traces if the events service has no matching trace.
+func (server *server) fetchEventTraces(ctx context.Context, metric *requestMetric, query traceQuery) ([]*model.Trace, int, error) {
+	if server.options.eventsService == "" {
+		return nil, metric.fail(classConfigUnavailable), fmt.Errorf("include_events requires --trace-server-events-service")
+	}
+
+	traces, code, err := server.findTraces(ctx, metric, server.options.eventsService, query)
+	if err != nil {
+		if code == 404 {
+			// the object has no events in this window
+			metric.Error = nil
+			return nil, 0, nil
+		}
+		return nil, code, fmt.Errorf("cannot find events: %w", err)
+	}
+	return traces, 0, nil
+}
+
+// mergeEventSpans merges the spans of event traces into the trace, skipping spans already in the trace.
+// Object spans of the event traces are replaced by the object span of the same object in the trace,
+// and event spans whose parent is not found are placed under the root span.
+func mergeEventSpans(trace *model.Trace, eventTraces []*model.Trace, tag rootTag) {
+	root := findRootSpan(trace, tag)
+	if root == nil {
+		return
+	}
+
+	seen := make(map[model.SpanID]struct{}, len(trace.Spans))
+	objectSpans := map[string]model.SpanID{}
+	for _, span := range trace.Spans {
+		seen[span.SpanID] = struct{}{}
+		if key, isObject := objectSpanKey(span); isObject {
+			if _, exists := objectSpans[key]; !exists {
+				objectSpans[key] = span.SpanID
+			}
+		}
+	}
+
+	for _, eventTrace := range eventTraces {
+		// span IDs in the event trace replaced by an object span in the trace
+		replaced := map[model.SpanID]model.SpanID{}
+		for _, span := range eventTrace.Spans {
+			if key, isObject := objectSpanKey(span); isObject {
+				if target, exists := objectSpans[key]; exists {
+					replaced[span.SpanID] = target
+				}
+			}
+		}
+
+		eventSpanIds := make(map[model.SpanID]struct{}, len(eventTrace.Spans))
+		for _, span := range eventTrace.Spans {
+			eventSpanIds[span.SpanID] = struct{}{}
+		}
+
+		for _, span := range eventTrace.Spans {
+			if _, isReplaced := replaced[span.SpanID]; isReplaced {
+				continue
+			}
+			if _, exists := seen[span.SpanID]; exists {
+				continue
+			}
+			seen[span.SpanID] = struct{}{}
+
+			span.TraceID = root.TraceID
+
+			hasParent := false
+			for i := range span.References {
+				ref := &span.References[i]
+				ref.TraceID = root.TraceID
+				if target, isReplaced := replaced[ref.SpanID]; isReplaced {
+					ref.SpanID = target
+				}
+				if ref.RefType == model.ChildOf {
+					_, inTrace := seen[ref.SpanID]
+					_, inEvents := eventSpanIds[ref.SpanID]
+					hasParent = hasParent || inTrace || inEvents
+				}
+			}
+			if !hasParent {
+				span.References = append(span.References, model.NewChildOfRef(root.TraceID, root.SpanID))
+			}
+
+			trace.Spans = append(trace.Spans, span)
+		}
+	}
+}
+
+// objectSpanKey returns the identity of the object represented by an object pseudospan.
+func objectSpanKey(span *model.Span) (string, bool) {
+	if !hasValue(span.Tags, zconstants.PseudoType, string(zconstants.PseudoTypeObject)) {
+		return "", false
+	}
+
+	tags := make(map[string]string, len(span.Tags))
+	for _, tag := range span.Tags {
+		tags[tag.Key] = tag.AsString()
+	}
+
+	parts := []string{}
+	for _, key := range []string{"cluster", "group", "resource", "namespace", "name"} {
+		parts = append(parts, tags[key])
+	}
+	return strings.Join(parts, "/"), true
+}
@@ -0,0 +1,285 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	"k8s.io/utils/clock"
+)
+
+const (
+	exportDestinationDir = "dir"
+	exportDestinationS3  = "s3"
+)
+
+// exportStore writes exported traces to an archive.
+type exportStore interface {
+	put(ctx context.Context, key string, data []byte) error
+}
+
+func (server *server) newExportStore() (exportStore, error) {
+	options := &server.options
+	switch options.exportDestination {
+	case "":
+		return nil, nil
+	case exportDestinationDir:
+		if options.exportDir == "" {
+			return nil, fmt.Errorf("--trace-server-export-dir is required for the %q export destination", exportDestinationDir)
+		}
+		return &dirExportStore{dir: options.exportDir}, nil
+	case exportDestinationS3:
+		return newS3ExportStore(server.Clock, options)
+	default:
+		return nil, fmt.Errorf(
+			"invalid --trace-server-export-destination %q, must be %q or %q",
+			options.exportDestination, exportDestinationDir, exportDestinationS3,
+		)
+	}
+}
+
+// dirExportStore writes exported traces to a local directory.
+type dirExportStore struct {
+	dir string
+}
+
+func (store *dirExportStore) put(ctx context.Context, key string, data []byte) error {
+	path := filepath.Join(store.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("cannot create export directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil { //nolint:gosec // exported traces are not secret
+		return fmt.Errorf("cannot write export file: %w", err)
+	}
+	return nil
+}
+
+// s3ExportStore uploads exported traces to an S3-compatible bucket with path-style requests.
+type s3ExportStore struct {
+	clock           clock.Clock
+	client          *http.Client
+	endpoint        *url.URL
+	bucket          string
+	region          string
+	accessKeyId     string
+	secretAccessKey string
+}
+
+func newS3ExportStore(clock clock.Clock, options *options) (*s3ExportStore, error) {
+	if options.exportS3Bucket == "" {
+		return nil, fmt.Errorf("--trace-server-export-s3-bucket is required for the %q export destination", exportDestinationS3)
+	}
+
+	endpoint, err := url.Parse(options.exportS3Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid --trace-server-export-s3-endpoint %q", options.exportS3Endpoint)
+	}
+
+	accessKeyId := options.exportS3AccessKeyId
+	if accessKeyId == "" {
+		accessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if options.exportS3SecretFile != "" {
+		secretBytes, err := os.ReadFile(options.exportS3SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read S3 secret access key: %w", err)
+		}
+		secretAccessKey = strings.TrimSpace(string(secretBytes))
+	}
+
+	if accessKeyId == "" || secretAccessKey == "" {
+		return nil, fmt.Errorf("S3 export requires credentials from flags or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &s3ExportStore{
+		clock:           clock,
+		client:          &http.Client{Timeout: time.Minute},
+		endpoint:        endpoint,
+		bucket:          options.exportS3Bucket,
+		region:          options.exportS3Region,
+		accessKeyId:     accessKeyId,
+		secretAccessKey: secretAccessKey,
+	}, nil
+}
+
+func (store *s3ExportStore) put(ctx context.Context, key string, data []byte) error {
+	objectUrl := *store.endpoint
+	objectUrl.Path = strings.TrimSuffix(objectUrl.Path, "/") + "/" + url.PathEscape(store.bucket) + "/" + escapeS3Key(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectUrl.String(), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot create S3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	store.sign(req, data)
+
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot upload to S3: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 upload failed with status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
+
+func escapeS3Key(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (store *s3ExportStore) sign(req *http.Request, payload []byte) {
+	now := store.clock.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, store.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := []byte("AWS4" + store.secretAccessKey)
+	for _, part := range []string{date, store.region, "s3", "aws4_request"} {
+		signingKey = hmacSha256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		store.accessKeyId, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+type exportRequest struct {
+	// Query is the URL-encoded query string of the trace endpoint.
+	Query string `json:"query"`
+}
+
+type exportResponse struct {
+	Key string `json:"key"`
+}
+
+// handleExport fetches the trace of a query and writes it as JSON to the export destination.
+func (server *server) handleExport(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if server.exportStore == nil {
+		return metric.fail(classConfigUnavailable), fmt.Errorf("no export destination is configured")
+	}
+
+	if class, err := server.checkRequestBody(ctx); err != nil {
+		return metric.fail(class), err
+	}
+
+	var request exportRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		if server.isBodyTooLarge(err) {
+			return metric.fail(classRequestTooLarge), err
+		}
+		return metric.fail(classInvalidBody), fmt.Errorf("invalid request body: %w", err)
+	}
+
+	values, err := url.ParseQuery(request.Query)
+	if err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid query: %w", err)
+	}
+	if err := validateParamConflicts(values); err != nil {
+		return metric.fail(classConflictingParams), err
+	}
+	if code, err := server.checkStrictQuery(metric, values, knownParams); err != nil {
+		return code, err
+	}
+
+	ctx.Request.URL.RawQuery = values.Encode()
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	trace, _, code, err := server.fetchTrace(ctx.Request.Context(), metric, query)
+	if err != nil {
+		return code, err
+	}
+	server.pruneTrace(trace, query.SpanType)
+	server.filterTagKeys(trace)
+
+	uiTrace := uiconv.FromDomain(trace)
+	data, err := json.Marshal(uiTrace)
+	if err != nil {
+		return metric.fail(classMarshalError), fmt.Errorf("cannot marshal trace: %w", err)
+	}
+
+	key := fmt.Sprintf("%s/%s.json", uiTrace.TraceID, server.Clock.Now().UTC().Format("20060102T150405Z"))
+	if err := server.exportStore.put(ctx.Request.Context(), key, data); err != nil {
+		return metric.fail(classExportError), err
+	}
+
+	server.writeJSON(ctx, 200, server.wrapEnvelope(ctx, exportResponse{Key: key}))
+	return 0, nil
+}
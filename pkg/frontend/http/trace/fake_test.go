@@ -0,0 +1,146 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// fakeReader serves copies of the stored spans of each object,
+// filtering the time range and assigning a new trace ID on each FindTraces call like the frontend reader.
+type fakeReader struct {
+	lock sync.Mutex
+	// spans of each object keyed by name
+	objects map[string][]*model.Span
+	// find overrides FindTraces if non-nil
+	find func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error)
+
+	finds    []*spanstore.TraceQueryParameters
+	gets     int
+	returned map[model.TraceID]*model.Trace
+}
+
+func newFakeReader() *fakeReader {
+	return &fakeReader{objects: map[string][]*model.Span{}, returned: map[model.TraceID]*model.Trace{}}
+}
+
+// addObject stores a pseudo span of the object with the child spans.
+func (reader *fakeReader) addObject(name string, children ...*model.Span) {
+	pseudo := &model.Span{
+		SpanID:        model.SpanID(rand.Uint64()),
+		OperationName: "pods " + name,
+		Tags: []model.KeyValue{
+			model.String(zconstants.TraceSource, zconstants.TraceSourceObject),
+			model.String("resource", "pods"),
+			model.String("name", name),
+		},
+		Process: &model.Process{ServiceName: "test"},
+	}
+	for _, child := range children {
+		child.References = []model.SpanRef{model.NewChildOfRef(model.TraceID{}, pseudo.SpanID)}
+	}
+	reader.objects[name] = append([]*model.Span{pseudo}, children...)
+}
+
+func (reader *fakeReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	reader.lock.Lock()
+	reader.finds = append(reader.finds, query)
+	find := reader.find
+	reader.lock.Unlock()
+
+	if find != nil {
+		return find(ctx, query)
+	}
+
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+
+	spans, exists := reader.objects[query.Tags["name"]]
+	if !exists {
+		return nil, nil
+	}
+
+	traceId := model.NewTraceID(rand.Uint64(), rand.Uint64())
+	trace := &model.Trace{}
+	for _, span := range spans {
+		span := *span
+		span.TraceID = traceId
+		span.Tags = append([]model.KeyValue{}, span.Tags...)
+		span.References = append([]model.SpanRef{}, span.References...)
+		for i := range span.References {
+			span.References[i].TraceID = traceId
+		}
+		span.Logs = append([]model.Log{}, span.Logs...)
+
+		if source, _ := model.KeyValues(span.Tags).FindByKey(zconstants.TraceSource); source.VStr == zconstants.TraceSourceObject {
+			span.StartTime = query.StartTimeMin
+			span.Duration = query.StartTimeMax.Sub(query.StartTimeMin)
+		} else if !(query.StartTimeMin.Before(span.StartTime) && span.StartTime.Before(query.StartTimeMax)) {
+			continue
+		}
+		trace.Spans = append(trace.Spans, &span)
+	}
+
+	reader.returned[traceId] = trace
+	return []*model.Trace{trace}, nil
+}
+
+func (reader *fakeReader) findCount() int {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+	return len(reader.finds)
+}
+
+func (reader *fakeReader) GetTrace(ctx context.Context, traceId model.TraceID) (*model.Trace, error) {
+	reader.lock.Lock()
+	defer reader.lock.Unlock()
+
+	reader.gets++
+	if trace, exists := reader.returned[traceId]; exists {
+		return trace, nil
+	}
+	return nil, spanstore.ErrTraceNotFound
+}
+
+func (*fakeReader) GetServices(ctx context.Context) ([]string, error) { return nil, nil }
+
+func (*fakeReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, nil
+}
+
+func (*fakeReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, nil
+}
+
+// auditSpan is a span of an audit event at the time with a log.
+func auditSpan(spanId uint64, verb string, timestamp time.Time) *model.Span {
+	return &model.Span{
+		SpanID:        model.SpanID(spanId),
+		OperationName: verb,
+		StartTime:     timestamp,
+		Duration:      time.Second,
+		Tags:          []model.KeyValue{model.String("verb", verb)},
+		Logs:          []model.Log{{Timestamp: timestamp, Fields: []model.KeyValue{model.String("audit", verb)}}},
+		Process:       &model.Process{ServiceName: "test"},
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// errFanoutTooLarge is returned by reserveBackendCall if the request has issued --trace-server-max-fanout backend queries.
+var errFanoutTooLarge = errors.New("request exceeds the maximum number of backend queries")
+
+// checkFanout rejects requests that would issue more than --trace-server-max-fanout backend queries
+// before any of them is issued. Fan-out that cannot be predicted is limited by queryStorage instead.
+func (server *server) checkFanout(metric *requestMetric, queries int) (code int, err error) {
+	if limit := server.options.maxFanout; limit > 0 && queries > limit {
+		return metric.fail(classFanoutTooLarge), fmt.Errorf(
+			"request would issue %d backend queries, more than the limit of %d", queries, limit,
+		)
+	}
+	return 0, nil
+}
+
+// reserveBackendCall counts a backend query of the request,
+// returning errFanoutTooLarge if the request has used up --trace-server-max-fanout.
+func (server *server) reserveBackendCall(ctx context.Context) error {
+	if !requestStatsFrom(ctx).reserveBackendCall(server.options.maxFanout) {
+		return errFanoutTooLarge
+	}
+	return nil
+}
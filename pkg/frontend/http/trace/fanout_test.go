@@ -0,0 +1,62 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestEmptyRetriesDoNotCountAgainstFanout(t *testing.T) {
+	assert := assert.New(t)
+
+	reader := newFakeReader()
+	mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"},
+		"--trace-server-max-fanout=1", "--trace-server-empty-retry-attempts=2", "--trace-server-empty-retry-delay=1ms")
+	assert.NoError(err)
+
+	response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&relative=-1h", nil)
+	assert.Equal(404, response.Code, response.Body.String())
+	assert.Equal(3, reader.findCount())
+}
+
+func TestGetTraceFallbackCountsAgainstFanout(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	reader := newFakeReader()
+	span := auditSpan(1, "create", now.Add(-10*time.Minute))
+	span.Logs = nil
+	reader.addObject("web", span)
+
+	mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"}, "--trace-server-max-fanout=1")
+	assert.NoError(err)
+
+	response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&relative=-1h", nil)
+	assert.Equal(400, response.Code, response.Body.String())
+	assert.Contains(response.Body.String(), "maximum number of backend queries")
+
+	mock, err = trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"}, "--trace-server-max-fanout=2")
+	assert.NoError(err)
+
+	response = mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&relative=-1h", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	assert.Equal(1, reader.gets, "the trace without logs is fetched again with GetTrace")
+}
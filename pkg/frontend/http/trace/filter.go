@@ -0,0 +1,62 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// filterSpansAndLogs keeps only the spans whose tags match and the logs whose fields match,
+// plus the ancestors of spans that match or have matching logs.
+// All logs of matching spans are kept. Ancestors are kept without their logs unless the logs also match.
+func filterSpansAndLogs(trace *model.Trace, matches func(kvs []model.KeyValue) bool) {
+	spans := make(map[model.SpanID]*model.Span, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spans[span.SpanID] = span
+	}
+
+	keep := map[model.SpanID]struct{}{}
+	for _, span := range trace.Spans {
+		spanMatches := matches(span.Tags)
+
+		var newLogs []model.Log
+		for _, log := range span.Logs {
+			if spanMatches || matches(log.Fields) {
+				newLogs = append(newLogs, log)
+			}
+		}
+		span.Logs = newLogs
+
+		if !spanMatches && len(newLogs) == 0 {
+			continue
+		}
+
+		// keep the span and its ancestors
+		for current := span; current != nil; current = spans[current.ParentSpanID()] {
+			if _, kept := keep[current.SpanID]; kept {
+				break
+			}
+			keep[current.SpanID] = struct{}{}
+		}
+	}
+
+	newSpans := make([]*model.Span, 0, len(keep))
+	for _, span := range trace.Spans {
+		if _, kept := keep[span.SpanID]; kept {
+			newSpans = append(newSpans, span)
+		}
+	}
+	trace.Spans = newSpans
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// foldedFrameReplacer removes the separators of the folded stack format from frame names.
+var foldedFrameReplacer = strings.NewReplacer(";", "_", " ", "_", "\n", "_", "\t", "_")
+
+// foldedStacks renders the span tree in the folded stack format used by flamegraph tools.
+// Each line is a path from a root span to a leaf span, followed by the leaf duration in microseconds.
+// Rendering stops at the first write error.
+func foldedStacks(writer io.Writer, trace *model.Trace) error {
+	spanIds := make(map[model.SpanID]struct{}, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spanIds[span.SpanID] = struct{}{}
+	}
+
+	var roots []*model.Span
+	children := map[model.SpanID][]*model.Span{}
+	for _, span := range trace.Spans {
+		parent := span.ParentSpanID()
+		if _, hasParent := spanIds[parent]; parent != 0 && hasParent {
+			children[parent] = append(children[parent], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	byStartTime := func(spans []*model.Span) {
+		sort.SliceStable(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+	}
+
+	visited := map[model.SpanID]struct{}{}
+	// err is the first write error, which stops the traversal
+	var err error
+
+	var visit func(span *model.Span, path []string)
+	visit = func(span *model.Span, path []string) {
+		if _, seen := visited[span.SpanID]; seen || err != nil {
+			return
+		}
+		visited[span.SpanID] = struct{}{}
+
+		path = append(path, foldedFrameName(span))
+
+		spanChildren := children[span.SpanID]
+		if len(spanChildren) == 0 {
+			_, err = fmt.Fprintf(writer, "%s %d\n", strings.Join(path, ";"), model.DurationAsMicroseconds(span.Duration))
+			return
+		}
+
+		byStartTime(spanChildren)
+		for _, child := range spanChildren {
+			visit(child, path)
+		}
+	}
+
+	byStartTime(roots)
+	for _, root := range roots {
+		visit(root, nil)
+	}
+
+	return err
+}
+
+// foldedFrameName names the frame of a span with objectSpanName.
+func foldedFrameName(span *model.Span) string {
+	return foldedFrameReplacer.Replace(objectSpanName(span))
+}
+
+// objectSpanName names object spans as `resource/name` and other spans by their operation name.
+func objectSpanName(span *model.Span) string {
+	resource, hasResource := model.KeyValues(span.Tags).FindByKey("resource")
+	objectName, hasName := model.KeyValues(span.Tags).FindByKey("name")
+	if hasResource && hasName {
+		return resource.AsString() + "/" + objectName.AsString()
+	}
+	return span.OperationName
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	"google.golang.org/protobuf/encoding/protojson"
+	"sigs.k8s.io/yaml"
+)
+
+// Format marshals a trace into the body of a response to `?format=`.
+// Errors are returned as 500 MarshalError.
+type Format func(trace *model.Trace, request *FormatRequest) (contentType string, body []byte, err error)
+
+var (
+	formatsLock sync.RWMutex
+	formats     = map[string]Format{}
+)
+
+func init() {
+	RegisterFormat(formatJson, writeJsonFormat)
+	RegisterFormat(formatYaml, writeYamlFormat)
+	RegisterFormat(formatOtlp, writeOtlpFormat)
+	RegisterFormat(formatFolded, writeFoldedFormat)
+	RegisterFormat(formatMermaid, writeMermaidFormat)
+	RegisterFormat(formatDurationHistogram, writeDurationHistogramFormat)
+}
+
+// RegisterFormat registers a format for the format param.
+//
+// Custom formats are registered by the init function of another package linked into the binary,
+// e.g. a package that also provides a component to the manager.
+// Registration must complete before the trace server is initialized,
+// since --trace-server-enabled-formats is validated against the registered formats.
+// Panics if the name is empty or already registered.
+func RegisterFormat(name string, format Format) {
+	formatsLock.Lock()
+	defer formatsLock.Unlock()
+
+	if name == "" {
+		panic("format name must not be empty")
+	}
+	if _, exists := formats[name]; exists {
+		panic(fmt.Sprintf("format %q is already registered", name))
+	}
+	formats[name] = format
+}
+
+func lookupFormat(name string) (Format, bool) {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	format, exists := formats[name]
+	return format, exists
+}
+
+// registeredFormats returns the names of the registered formats sorted by name.
+func registeredFormats() []string {
+	formatsLock.RLock()
+	defer formatsLock.RUnlock()
+
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FormatRequest is the request for a trace response passed to a Format.
+type FormatRequest struct {
+	// Query is the query params of the request.
+	Query url.Values
+
+	server *server
+	ctx    *gin.Context
+	query  traceQuery
+	extras traceExtras
+}
+
+// Enveloped checks whether the data must be wrapped with Envelope,
+// which is the case if --trace-server-response-envelope is enabled or include_snapshots or expected_interval is requested.
+func (request *FormatRequest) Enveloped() bool {
+	return request.server.options.responseEnvelope || request.extras.requested()
+}
+
+// Envelope wraps the data of the trace in the response envelope if Enveloped, otherwise returns data unchanged.
+func (request *FormatRequest) Envelope(trace *model.Trace, data any) any {
+	if !request.Enveloped() {
+		return data
+	}
+
+	meta := envelopeMeta{
+		SpanCount:      len(trace.Spans),
+		Warnings:       trace.Warnings,
+		ResultsLimited: requestStatsFrom(request.ctx.Request.Context()).isResultsLimited(),
+		Snapshots:      request.extras.snapshots,
+		Gaps:           request.extras.gaps,
+	}
+	if len(trace.Spans) > 0 {
+		meta.TraceId = trace.Spans[0].TraceID.String()
+	}
+	return envelope{Data: data, Meta: meta}
+}
+
+// EncodeJSON marshals the object as JSON, indented if pretty=true is requested.
+// Fails as soon as the output exceeds --trace-server-max-response-bytes.
+func (request *FormatRequest) EncodeJSON(obj any) ([]byte, error) {
+	return request.server.encodeJSON(request.ctx, obj, request.server.options.maxResponseBytes)
+}
+
+func writeJsonFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	body, err := request.EncodeJSON(request.Envelope(trace, uiconv.FromDomain(trace)))
+	return jsonContentType, body, err
+}
+
+// writeYamlFormat marshals the same structure as the JSON format.
+// The yaml marshaler cannot write to a capped writer, so --trace-server-max-response-bytes is only checked on the marshaled body.
+func writeYamlFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	// the tz param is validated by handleTrace
+	if location, _ := parseTimezone(request.query.Tz); location != nil {
+		localizeTimestamps(trace, location)
+	}
+
+	body, err := yaml.Marshal(request.Envelope(trace, uiconv.FromDomain(trace)))
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot marshal trace as yaml: %w", err)
+	}
+	return "application/yaml; charset=utf-8", body, nil
+}
+
+func writeOtlpFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	otlpJson, err := protojson.Marshal(toOtlp(trace, request.server.otlpLinkTags, request.server.otlpKindRules))
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot marshal trace as otlp: %w", err)
+	}
+
+	body, err := request.EncodeJSON(request.Envelope(trace, json.RawMessage(otlpJson)))
+	return jsonContentType, body, err
+}
+
+// writeTextFormat renders a plain text format, failing as soon as the text exceeds --trace-server-max-response-bytes.
+// If Enveloped, the text is returned as the data of the JSON envelope, which is never smaller than the text.
+func writeTextFormat(
+	trace *model.Trace,
+	request *FormatRequest,
+	render func(writer io.Writer, trace *model.Trace) error,
+) (string, []byte, error) {
+	text := &cappedBuffer{limit: request.server.options.maxResponseBytes}
+	if err := render(text, trace); err != nil {
+		return "", nil, err
+	}
+
+	if request.Enveloped() {
+		body, err := request.EncodeJSON(request.Envelope(trace, text.buf.String()))
+		return jsonContentType, body, err
+	}
+	return "text/plain; charset=utf-8", text.buf.Bytes(), nil
+}
+
+func writeFoldedFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	return writeTextFormat(trace, request, foldedStacks)
+}
+
+func writeMermaidFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	return writeTextFormat(trace, request, mermaidFlowchart)
+}
+
+// writeDurationHistogramFormat is never enveloped since it does not return the trace.
+func writeDurationHistogramFormat(trace *model.Trace, request *FormatRequest) (string, []byte, error) {
+	server := request.server
+	spanType := server.canonicalSpanType(request.query.SpanType)
+	histogram := histogramOf(trace, server.options.histogramBuckets, server.options.spanTypeField, spanType, request.query.Verb)
+	body, err := request.EncodeJSON(histogram)
+	return jsonContentType, body, err
+}
@@ -0,0 +1,165 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func formatTestTrace() *model.Trace {
+	traceId := model.NewTraceID(0, 1)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	process := &model.Process{ServiceName: "test"}
+	return &model.Trace{Spans: []*model.Span{
+		{TraceID: traceId, SpanID: 1, OperationName: "root", StartTime: start, Duration: time.Minute, Process: process},
+		{
+			TraceID:       traceId,
+			SpanID:        2,
+			OperationName: "child",
+			StartTime:     start,
+			Duration:      time.Second,
+			Process:       process,
+			References:    []model.SpanRef{model.NewChildOfRef(traceId, 1)},
+		},
+	}}
+}
+
+func TestRegisteredFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	trace.RegisterFormat("test-span-names", func(tr *model.Trace, request *trace.FormatRequest) (string, []byte, error) {
+		body := request.Query.Get("prefix")
+		for _, span := range tr.Spans {
+			body += span.OperationName + ";"
+		}
+		return "text/csv", []byte(body), nil
+	})
+
+	mock, err := trace.NewMockServer(clock.RealClock{})
+	assert.NoError(err)
+
+	code, contentType, body := mock.WriteTrace("format=test-span-names&prefix=names:", formatTestTrace())
+	assert.Equal(200, code)
+	assert.Equal("text/csv", contentType)
+	assert.Equal("names:root;child;", body)
+
+	assert.Panics(func() {
+		trace.RegisterFormat("test-span-names", func(*model.Trace, *trace.FormatRequest) (string, []byte, error) {
+			return "", nil, nil
+		})
+	}, "duplicate registration must panic")
+	assert.Panics(func() {
+		trace.RegisterFormat("json", func(*model.Trace, *trace.FormatRequest) (string, []byte, error) {
+			return "", nil, nil
+		})
+	}, "built-in formats must not be overridden")
+}
+
+func TestRegisteredFormatError(t *testing.T) {
+	assert := assert.New(t)
+
+	trace.RegisterFormat("test-failing", func(*model.Trace, *trace.FormatRequest) (string, []byte, error) {
+		return "", nil, fmt.Errorf("cannot marshal")
+	})
+
+	mock, err := trace.NewMockServer(clock.RealClock{})
+	assert.NoError(err)
+
+	code, _, body := mock.WriteTrace("format=test-failing", formatTestTrace())
+	assert.Equal(500, code)
+	assert.Contains(body, "cannot marshal")
+}
+
+func TestBuiltinFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{})
+	assert.NoError(err)
+
+	code, contentType, body := mock.WriteTrace("", formatTestTrace())
+	assert.Equal(200, code)
+	assert.Equal("application/json; charset=utf-8", contentType)
+	assert.Contains(body, `"operationName":"child"`)
+
+	code, contentType, body = mock.WriteTrace("format=folded", formatTestTrace())
+	assert.Equal(200, code)
+	assert.Equal("text/plain; charset=utf-8", contentType)
+	assert.Contains(body, "root;child")
+}
+
+func TestTextFormatsAreCappedWhileRendering(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{}, "--trace-server-max-response-bytes=16")
+	assert.NoError(err)
+
+	for _, query := range []string{"format=folded", "format=mermaid", "format=mermaid&include_snapshots=true"} {
+		code, _, body := mock.WriteTrace(query, formatTestTrace())
+		assert.Equal(413, code, query)
+		assert.Contains(body, "response exceeds 16 bytes", query)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{})
+	assert.NoError(err)
+
+	code, _, body := mock.WriteTrace("format=unknown-format", formatTestTrace())
+	assert.Equal(400, code)
+	assert.Contains(body, `unknown format "unknown-format"`)
+}
+
+func TestDisabledFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{}, "--trace-server-enabled-formats=json")
+	assert.NoError(err)
+
+	code, _, body := mock.WriteTrace("format=yaml", formatTestTrace())
+	assert.Equal(400, code)
+	assert.Contains(body, `format "yaml" is disabled`)
+}
+
+func TestMermaidFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	mock, err := trace.NewMockServer(clock.RealClock{})
+	assert.NoError(err)
+
+	tr := formatTestTrace()
+	tr.Spans[0].Tags = []model.KeyValue{model.String("resource", "pods"), model.String("name", `web-"0"`)}
+	tr.Spans[1].OperationName = "update <status> #1"
+
+	code, contentType, body := mock.WriteTrace("format=mermaid", tr)
+	assert.Equal(200, code)
+	assert.Equal("text/plain; charset=utf-8", contentType)
+	assert.Equal(
+		"graph TD\n"+
+			"    span0000000000000001[\"pods/web-#quot;0#quot;\"]\n"+
+			"    span0000000000000001 --> span0000000000000002\n"+
+			"    span0000000000000002[\"update #lt;status#gt; #35;1\"]\n",
+		body,
+	)
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// coverageGap is a window in which no span matching span_type and verb was active for longer than expected_interval.
+type coverageGap struct {
+	Start          time.Time `json:"start"`
+	End            time.Time `json:"end"`
+	Duration       string    `json:"duration"`
+	DurationMicros int64     `json:"durationMicros"`
+}
+
+func parseExpectedInterval(value string) (time.Duration, error) {
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for expected_interval param %w", err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("expected_interval param must be a positive duration, got %q", value)
+	}
+	return interval, nil
+}
+
+// coverageGaps returns the windows longer than interval in which no span matching spanType and verb was active,
+// from the start to the end of the whole trace, so that a trace without matching spans is a single gap.
+// Overlapping spans merge into one covered window.
+func coverageGaps(trace *model.Trace, interval time.Duration, spanTypeField string, spanType string, verb string) []coverageGap {
+	var traceStart, traceEnd time.Time
+	var covered [][2]time.Time
+	for _, span := range trace.Spans {
+		if traceStart.IsZero() || span.StartTime.Before(traceStart) {
+			traceStart = span.StartTime
+		}
+		if end := spanEnd(span); end.After(traceEnd) {
+			traceEnd = end
+		}
+
+		if spanMatchesTypeAndVerb(span, spanTypeField, spanType, verb) {
+			covered = append(covered, [2]time.Time{span.StartTime, spanEnd(span)})
+		}
+	}
+	sort.Slice(covered, func(i, j int) bool { return covered[i][0].Before(covered[j][0]) })
+
+	gaps := []coverageGap{}
+	addGap := func(start, end time.Time) {
+		if duration := end.Sub(start); duration > interval {
+			gaps = append(gaps, coverageGap{
+				Start:          start,
+				End:            end,
+				Duration:       duration.String(),
+				DurationMicros: duration.Microseconds(),
+			})
+		}
+	}
+
+	coveredUntil := traceStart
+	for _, window := range covered {
+		addGap(coveredUntil, window[0])
+		if window[1].After(coveredUntil) {
+			coveredUntil = window[1]
+		}
+	}
+	addGap(coveredUntil, traceEnd)
+
+	return gaps
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+)
+
+const groupByResource = "resource"
+
+// groupedTrace is the response of `?group_by=resource`.
+type groupedTrace struct {
+	TraceId   uimodel.TraceID                       `json:"traceID"`
+	Groups    map[string]*spanGroup                 `json:"groups"`
+	Processes map[uimodel.ProcessID]uimodel.Process `json:"processes"`
+}
+
+type spanGroup struct {
+	Count int            `json:"count"`
+	Spans []uimodel.Span `json:"spans"`
+}
+
+// groupTrace groups the spans of the trace by the value of the tag named groupBy.
+// Spans without the tag are grouped under the empty string.
+func groupTrace(trace *model.Trace, groupBy string) (*groupedTrace, error) {
+	if groupBy != groupByResource {
+		return nil, fmt.Errorf("unsupported group_by %q, only %q is supported", groupBy, groupByResource)
+	}
+
+	uiTrace := uiconv.FromDomain(trace)
+
+	groups := map[string]*spanGroup{}
+	for _, span := range uiTrace.Spans {
+		key := ""
+		for _, tag := range span.Tags {
+			if tag.Key == groupBy {
+				key = fmt.Sprint(tag.Value)
+				break
+			}
+		}
+
+		group, exists := groups[key]
+		if !exists {
+			group = &spanGroup{}
+			groups[key] = group
+		}
+		group.Count++
+		group.Spans = append(group.Spans, span)
+	}
+
+	return &groupedTrace{
+		TraceId:   uiTrace.TraceID,
+		Groups:    groups,
+		Processes: uiTrace.Processes,
+	}, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"compress/gzip"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validateGzipLevel checks --trace-server-gzip-level, allowing the levels 1 to 9 and gzip.DefaultCompression.
+func validateGzipLevel(level int) error {
+	if level == gzip.DefaultCompression || (level >= gzip.BestSpeed && level <= gzip.BestCompression) {
+		return nil
+	}
+	return fmt.Errorf("--trace-server-gzip-level must be between 1 and 9, or -1 for the default level, got %d", level)
+}
+
+// compressResponse gzips the response body if --trace-server-gzip is enabled and the client accepts gzip.
+// The returned function flushes the compressed body and must be called after the handler returns.
+func (server *server) compressResponse(ctx *gin.Context) (finish func()) {
+	if !server.options.gzip || !acceptsGzip(ctx.GetHeader("Accept-Encoding")) {
+		return func() {}
+	}
+
+	ctx.Header("Vary", "Accept-Encoding")
+	writer := &gzipWriter{ResponseWriter: ctx.Writer, level: server.options.gzipLevel}
+	ctx.Writer = writer
+	return writer.close
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.EqualFold(coding, "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter compresses the body lazily so that responses without a body, such as HEAD and 304, are left untouched.
+type gzipWriter struct {
+	gin.ResponseWriter
+	level int
+	gz    *gzip.Writer
+}
+
+func (writer *gzipWriter) Write(data []byte) (int, error) {
+	if writer.gz == nil {
+		writer.Header().Del("Content-Length")
+		writer.Header().Set("Content-Encoding", "gzip")
+
+		// the level is validated in Init
+		writer.gz, _ = gzip.NewWriterLevel(writer.ResponseWriter, writer.level)
+	}
+	return writer.gz.Write(data)
+}
+
+func (writer *gzipWriter) WriteString(data string) (int, error) { return writer.Write([]byte(data)) }
+
+func (writer *gzipWriter) close() {
+	if writer.gz != nil {
+		_ = writer.gz.Close()
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+const traceIdHeader = "X-Kelemetry-Trace-Id"
+
+// handleTraceHead returns the metadata of the trace matching the query in headers without a body.
+// The trace is fetched in the same way as GET so that both return the same validators.
+func (server *server) handleTraceHead(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), knownParams); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), knownParams); err != nil {
+		return code, err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+	if query.Format == "" {
+		query.Format = server.defaultFormat(ctx)
+	}
+
+	trace, code, err := server.fetchResponseTrace(ctx, metric, query)
+	if err != nil {
+		return code, err
+	}
+
+	if len(trace.Spans) > 0 {
+		ctx.Header(traceIdHeader, trace.Spans[0].TraceID.String())
+	}
+
+	if server.setCacheValidators(ctx, query.Format, trace) {
+		ctx.Status(http.StatusNotModified)
+		return 0, nil
+	}
+
+	ctx.Status(200)
+	return 0, nil
+}
+
+// setCacheValidators sets the ETag and Last-Modified headers of the trace in the format,
+// returning true if the request has a matching If-None-Match header and can be answered with 304 Not Modified.
+func (server *server) setCacheValidators(ctx *gin.Context, format string, trace *model.Trace) (notModified bool) {
+	etag := server.traceEtag(format, trace)
+	ctx.Header("ETag", etag)
+	ctx.Header("Last-Modified", traceLastModified(trace).UTC().Format(http.TimeFormat))
+	return etagMatches(ctx.GetHeader("If-None-Match"), etag)
+}
+
+// etagMatches checks whether an If-None-Match header matches the ETag with the weak comparison of RFC 9110.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// traceLastModified returns the latest span end or log timestamp of the trace.
+func traceLastModified(trace *model.Trace) time.Time {
+	var lastModified time.Time
+	for _, span := range trace.Spans {
+		if end := spanEnd(span); end.After(lastModified) {
+			lastModified = end
+		}
+		for _, log := range span.Logs {
+			if log.Timestamp.After(lastModified) {
+				lastModified = log.Timestamp
+			}
+		}
+	}
+	return lastModified
+}
+
+// traceEtag returns a weak ETag of the trace in the format,
+// since gzip and identity bodies of the same format carry the same trace.
+//
+// Only fields that are stable across queries are hashed:
+// the object of the root span, and the times and log timestamps of the spans that are not pseudo.
+// Span IDs are not hashed since pseudo and virtual spans get a random ID on every query.
+func (server *server) traceEtag(format string, trace *model.Trace) string {
+	entries := []string{}
+	for _, span := range trace.Spans {
+		if isPseudoSpan(span) {
+			continue
+		}
+
+		entry := fmt.Sprintf("%d+%d", span.StartTime.UnixNano(), span.Duration)
+		logTimes := make([]string, 0, len(span.Logs))
+		for _, log := range span.Logs {
+			logTimes = append(logTimes, strconv.FormatInt(log.Timestamp.UnixNano(), 10))
+		}
+		sort.Strings(logTimes)
+		entries = append(entries, entry+":"+strings.Join(logTimes, ","))
+	}
+	sort.Strings(entries)
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(format))
+	_, _ = hash.Write([]byte{0})
+	if root := findRootSpan(trace, server.rootTag); root != nil {
+		_, _ = hash.Write([]byte(zconstants.ObjectKeyFromSpan(root).String()))
+	}
+	for _, entry := range entries {
+		_, _ = hash.Write([]byte{0})
+		_, _ = hash.Write([]byte(entry))
+	}
+	return fmt.Sprintf(`W/"%016x"`, hash.Sum64())
+}
+
+// isPseudoSpan checks whether the span is synthesized by the reader or the transformations instead of stored by the aggregator.
+func isPseudoSpan(span *model.Span) bool {
+	if _, isPseudo := model.KeyValues(span.Tags).FindByKey(zconstants.PseudoType); isPseudo {
+		return true
+	}
+	return hasValue(span.Tags, zconstants.TraceSource, zconstants.TraceSourceObject)
+}
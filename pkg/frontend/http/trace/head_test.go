@@ -0,0 +1,168 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestGetHonorsIfNoneMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	span := auditSpan(1, "create", now.Add(-10*time.Minute))
+	reader := newFakeReader()
+	reader.addObject("web", span)
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"
+
+	response := mock.Request("GET", target, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	etag := response.Header().Get("ETag")
+	assert.NotEmpty(etag)
+	assert.NotEmpty(response.Header().Get("Last-Modified"))
+
+	head := mock.Request("HEAD", target, nil)
+	assert.Equal(etag, head.Header().Get("ETag"), "HEAD and GET return the same validator")
+
+	response = mock.Request("GET", target, http.Header{"If-None-Match": {etag}})
+	assert.Equal(304, response.Code)
+	assert.Empty(response.Body.String())
+
+	span.Logs = append(span.Logs, model.Log{
+		Timestamp: span.StartTime.Add(time.Second),
+		Fields:    []model.KeyValue{model.String("audit", "patch")},
+	})
+
+	response = mock.Request("GET", target, http.Header{"If-None-Match": {etag}})
+	assert.Equal(200, response.Code, "a new log changes the ETag")
+	assert.NotEqual(etag, response.Header().Get("ETag"))
+}
+
+func TestCacheValidatorsMatchWithGetTraceFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	// FindTraces returns the spans without logs and with a new pseudo span ID on every call,
+	// so the GetTrace fallback fires and span IDs differ between queries.
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		reader.lock.Lock()
+		find := reader.find
+		reader.find = nil
+		reader.lock.Unlock()
+
+		traces, err := reader.FindTraces(ctx, query)
+
+		reader.lock.Lock()
+		reader.find = find
+		reader.lock.Unlock()
+
+		if err != nil || len(traces) == 0 {
+			return traces, err
+		}
+
+		full := &model.Trace{}
+		found := &model.Trace{}
+		pseudoId := model.SpanID(rand.Uint64())
+		for _, span := range traces[0].Spans {
+			span := *span
+			if span.ParentSpanID() == 0 {
+				span.SpanID = pseudoId
+			} else {
+				span.References = []model.SpanRef{model.NewChildOfRef(span.TraceID, pseudoId)}
+			}
+			full.Spans = append(full.Spans, &span)
+
+			withoutLogs := span
+			withoutLogs.Logs = nil
+			found.Spans = append(found.Spans, &withoutLogs)
+		}
+
+		reader.lock.Lock()
+		reader.returned[found.Spans[0].TraceID] = full
+		reader.lock.Unlock()
+		return []*model.Trace{found}, nil
+	}
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"
+
+	head := mock.Request("HEAD", target, nil)
+	assert.Equal(200, head.Code)
+	etag := head.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	response := mock.Request("GET", target, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	assert.Equal("get", response.Header().Get("X-Kelemetry-Source"), "the GetTrace fallback fires")
+	assert.Equal(etag, response.Header().Get("ETag"), "HEAD and GET return the same validator")
+
+	response = mock.Request("GET", target, http.Header{"If-None-Match": {etag}})
+	assert.Equal(304, response.Code, "the validator does not depend on the random pseudo span IDs")
+
+	yaml := mock.Request("HEAD", target+"&format=yaml", nil)
+	assert.NotEqual(etag, yaml.Header().Get("ETag"), "different formats have different validators")
+}
+
+func TestIfNoneMatchParsing(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(t, err)
+
+	target := "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web" +
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"
+	etag := mock.Request("HEAD", target, nil).Header().Get("ETag")
+	strong := strings.TrimPrefix(etag, "W/")
+
+	for name, tc := range map[string]struct {
+		ifNoneMatch string
+		code        int
+	}{
+		"exact":    {ifNoneMatch: etag, code: 304},
+		"strong":   {ifNoneMatch: strong, code: 304},
+		"list":     {ifNoneMatch: `"other", ` + etag, code: 304},
+		"wildcard": {ifNoneMatch: "*", code: 304},
+		"mismatch": {ifNoneMatch: `W/"other", "another"`, code: 200},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.code, mock.Request("GET", target, http.Header{"If-None-Match": {tc.ifNoneMatch}}).Code)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// formatDurationHistogram buckets the durations of the spans instead of returning the trace.
+const formatDurationHistogram = "duration_histogram"
+
+var defaultHistogramBuckets = []time.Duration{
+	time.Millisecond * 10,
+	time.Millisecond * 100,
+	time.Second,
+	time.Second * 10,
+	time.Minute,
+	time.Minute * 10,
+}
+
+// durationHistogram is the response of `?format=duration_histogram`.
+type durationHistogram struct {
+	Spans   int               `json:"spans"`
+	Buckets []histogramBucket `json:"buckets"`
+}
+
+// histogramBucket counts the spans with durations in (previous bucket, Le].
+// The last bucket has no upper bound.
+type histogramBucket struct {
+	Le       string `json:"le"`
+	LeMicros int64  `json:"leMicros,omitempty"`
+	Count    int    `json:"count"`
+}
+
+func validateHistogramBuckets(buckets []time.Duration) error {
+	for i, bucket := range buckets {
+		if bucket <= 0 {
+			return fmt.Errorf("--trace-server-duration-histogram-buckets must be positive, got %s", bucket)
+		}
+		if i > 0 && bucket <= buckets[i-1] {
+			return fmt.Errorf("--trace-server-duration-histogram-buckets must be increasing, got %s after %s", bucket, buckets[i-1])
+		}
+	}
+	return nil
+}
+
+// histogramOf buckets the durations of the spans matching spanType and verb.
+// Spans are not filtered by a criterion if it is empty.
+func histogramOf(trace *model.Trace, bounds []time.Duration, spanTypeField string, spanType string, verb string) *durationHistogram {
+	histogram := &durationHistogram{Buckets: make([]histogramBucket, len(bounds)+1)}
+	for i, bound := range bounds {
+		histogram.Buckets[i] = histogramBucket{Le: bound.String(), LeMicros: bound.Microseconds()}
+	}
+	histogram.Buckets[len(bounds)] = histogramBucket{Le: "+Inf"}
+
+	for _, span := range trace.Spans {
+		if !spanMatchesTypeAndVerb(span, spanTypeField, spanType, verb) {
+			continue
+		}
+
+		histogram.Spans++
+
+		bucket := len(bounds)
+		for i, bound := range bounds {
+			if span.Duration <= bound {
+				bucket = i
+				break
+			}
+		}
+		histogram.Buckets[bucket].Count++
+	}
+
+	return histogram
+}
+
+// spanMatchesTypeAndVerb checks whether the span is tagged with spanType and verb.
+// Spans are not filtered by a criterion if it is empty.
+func spanMatchesTypeAndVerb(span *model.Span, spanTypeField string, spanType string, verb string) bool {
+	if spanType != "" && (spanTypeField == "" || !hasValue(span.Tags, spanTypeField, spanType)) {
+		return false
+	}
+	return verb == "" || hasValue(span.Tags, "verb", verb)
+}
@@ -0,0 +1,77 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"github.com/jaegertracing/jaeger/model"
+
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// spanIdentity identifies a span across queries.
+// Span IDs cannot be used since the reader and the transformations assign a random ID to pseudo and virtual spans
+// on every query, and each aggregator bucket stores its own spans with their own IDs.
+type spanIdentity struct {
+	// object is the object of the span, or of its nearest ancestor with object tags.
+	object    utilobject.Key
+	operation string
+	// start is the start time in nanoseconds, or 0 for pseudo spans, which are retimed to the query window.
+	start int64
+	// occurrence tells apart spans with the same fields in the order of the trace.
+	occurrence int
+}
+
+// spanIdentities returns the identity of each span of the trace keyed by span ID.
+func spanIdentities(trace *model.Trace) map[model.SpanID]spanIdentity {
+	spans := make(map[model.SpanID]*model.Span, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spans[span.SpanID] = span
+	}
+
+	objects := make(map[model.SpanID]utilobject.Key, len(trace.Spans))
+	var objectOf func(span *model.Span) utilobject.Key
+	objectOf = func(span *model.Span) utilobject.Key {
+		if key, exists := objects[span.SpanID]; exists {
+			return key
+		}
+		// guards against reference cycles
+		objects[span.SpanID] = utilobject.Key{}
+
+		key := zconstants.ObjectKeyFromSpan(span)
+		if key == (utilobject.Key{}) {
+			if parent, exists := spans[span.ParentSpanID()]; exists {
+				key = objectOf(parent)
+			}
+		}
+		objects[span.SpanID] = key
+		return key
+	}
+
+	identities := make(map[model.SpanID]spanIdentity, len(trace.Spans))
+	occurrences := map[spanIdentity]int{}
+	for _, span := range trace.Spans {
+		identity := spanIdentity{object: objectOf(span), operation: span.OperationName}
+		if !isPseudoSpan(span) {
+			identity.start = span.StartTime.UnixNano()
+		}
+
+		occurrence := occurrences[identity]
+		occurrences[identity]++
+		identity.occurrence = occurrence
+		identities[span.SpanID] = identity
+	}
+	return identities
+}
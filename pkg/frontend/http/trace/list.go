@@ -0,0 +1,55 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	listOrderStartAsc      = "start_asc"
+	listOrderStartDesc     = "start_desc"
+	listOrderSpanCountDesc = "span_count_desc"
+)
+
+// sortTraces sorts traces by the start time of their root spans or by span count.
+func sortTraces(traces []*model.Trace, order string, tag rootTag) {
+	switch order {
+	case listOrderStartAsc:
+		sort.SliceStable(traces, func(i, j int) bool { return traceStartTime(traces[i], tag).Before(traceStartTime(traces[j], tag)) })
+	case listOrderStartDesc:
+		sort.SliceStable(traces, func(i, j int) bool { return traceStartTime(traces[i], tag).After(traceStartTime(traces[j], tag)) })
+	case listOrderSpanCountDesc:
+		sort.SliceStable(traces, func(i, j int) bool { return len(traces[i].Spans) > len(traces[j].Spans) })
+	}
+}
+
+// traceStartTime returns the start time of the root span, or the earliest span if there is no root.
+func traceStartTime(trace *model.Trace, tag rootTag) time.Time {
+	if root := findRootSpan(trace, tag); root != nil {
+		return root.StartTime
+	}
+
+	var earliest time.Time
+	for _, span := range trace.Spans {
+		if earliest.IsZero() || span.StartTime.Before(earliest) {
+			earliest = span.StartTime
+		}
+	}
+	return earliest
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+)
+
+// requestIdHeader identifies a request for deterministic log sampling.
+const requestIdHeader = "X-Request-Id"
+
+// shouldLogRequest decides whether the request is logged at Info with --trace-server-log-sample-rate.
+// The decision hashes the request ID header, or the method, path and query if there is no request ID,
+// so that all logs of the same request, or of retries of the same query, are consistently sampled.
+func (server *server) shouldLogRequest(req *http.Request) bool {
+	rate := server.options.logSampleRate
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+
+	hash := fnv.New64a()
+	if requestId := req.Header.Get(requestIdHeader); requestId != "" {
+		_, _ = hash.Write([]byte(requestId))
+	} else {
+		_, _ = hash.Write([]byte(req.Method + " " + req.URL.Path + "?" + req.URL.RawQuery))
+	}
+
+	return float64(hash.Sum64()) < rate*math.MaxUint64
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceState is toggled through /extensions/api/v1/admin/maintenance.
+type maintenanceState struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+	since   time.Time
+}
+
+type maintenanceRequest struct {
+	Enabled bool `json:"enabled"`
+	// Message overrides --trace-server-maintenance-message if nonempty.
+	Message string `json:"message"`
+}
+
+type maintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+func (server *server) maintenanceStatus() maintenanceStatus {
+	server.maintenance.mu.RLock()
+	defer server.maintenance.mu.RUnlock()
+
+	if !server.maintenance.enabled {
+		return maintenanceStatus{}
+	}
+
+	since := server.maintenance.since
+	return maintenanceStatus{Enabled: true, Message: server.maintenance.message, Since: &since}
+}
+
+// checkMaintenance rejects trace queries while maintenance mode is enabled.
+func (server *server) checkMaintenance(metric *requestMetric) (code int, err error) {
+	if status := server.maintenanceStatus(); status.Enabled {
+		return metric.fail(classMaintenance), fmt.Errorf("%s", status.Message)
+	}
+	return 0, nil
+}
+
+// handleMaintenance enables or disables maintenance mode.
+func (server *server) handleMaintenance(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if class, err := server.checkRequestBody(ctx); err != nil {
+		return metric.fail(class), err
+	}
+
+	var request maintenanceRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		if server.isBodyTooLarge(err) {
+			return metric.fail(classRequestTooLarge), err
+		}
+		return metric.fail(classInvalidBody), fmt.Errorf("invalid request body: %w", err)
+	}
+
+	server.maintenance.mu.Lock()
+	if request.Enabled && !server.maintenance.enabled {
+		server.maintenance.since = server.Clock.Now()
+	}
+	server.maintenance.enabled = request.Enabled
+	server.maintenance.message = request.Message
+	if server.maintenance.message == "" {
+		server.maintenance.message = server.options.maintenanceMessage
+	}
+	server.maintenance.mu.Unlock()
+
+	status := server.maintenanceStatus()
+	server.Logger.WithField("source", ctx.Request.RemoteAddr).
+		WithField("enabled", status.Enabled).
+		WithField("message", status.Message).
+		Warn("maintenance mode updated")
+	server.writeJSON(ctx, 200, server.wrapEnvelope(ctx, status))
+	return 200, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	defaultMergeRootTemplate = "{{.Resource}}/{{join .Names \", \"}} (merged {{.Reason}})"
+
+	defaultMergeClusterTag = "cluster"
+
+	mergeReasonNames    = "names"
+	mergeReasonClusters = "clusters"
+)
+
+// mergeDescription is the template data of the synthetic root of merged traces.
+type mergeDescription struct {
+	Cluster string
+	// Clusters of the merged objects, starting with Cluster.
+	Clusters  []string
+	Resource  string
+	Namespace string
+	// Names of the merged objects.
+	Names []string
+	// Reason is the feature that merges the traces, i.e. "names" for also_name, "clusters" for also_cluster,
+	// or "names and clusters" for both.
+	Reason string
+	// Traces is the number of merged traces.
+	Traces int
+}
+
+// mergeRootTemplates renders the name and tags of synthetic roots.
+type mergeRootTemplates struct {
+	name *template.Template
+	tags map[string]*template.Template
+}
+
+func parseMergeRootTemplates(name string, tags map[string]string) (mergeRootTemplates, error) {
+	funcs := template.FuncMap{"join": strings.Join}
+
+	nameTemplate, err := template.New("merge-root-name").Funcs(funcs).Parse(name)
+	if err != nil {
+		return mergeRootTemplates{}, fmt.Errorf("invalid --trace-server-merge-root-name-template: %w", err)
+	}
+
+	templates := mergeRootTemplates{name: nameTemplate, tags: make(map[string]*template.Template, len(tags))}
+	for key, text := range tags {
+		tagTemplate, err := template.New("merge-root-tag").Funcs(funcs).Parse(text)
+		if err != nil {
+			return mergeRootTemplates{}, fmt.Errorf("invalid --trace-server-merge-root-tag-templates value for %q: %w", key, err)
+		}
+		templates.tags[key] = tagTemplate
+	}
+	return templates, nil
+}
+
+// mergeTraces merges the traces under a synthetic root rendered from the merge root templates.
+// clusters[i] is the cluster queried for traces[i].
+// All features merging multiple traces into one tree should use this method.
+func (server *server) mergeTraces(traces []*model.Trace, clusters []string, desc mergeDescription) (*model.Trace, error) {
+	desc.Traces = len(traces)
+
+	if server.options.mergeClusterTag != "" {
+		annotateClusters(traces, clusters, server.options.mergeClusterTag)
+	}
+
+	var name strings.Builder
+	if err := server.mergeRoot.name.Execute(&name, desc); err != nil {
+		return nil, fmt.Errorf("cannot render merge root name: %w", err)
+	}
+
+	tagKeys := make([]string, 0, len(server.mergeRoot.tags))
+	for key := range server.mergeRoot.tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+
+	tags := make([]model.KeyValue, 0, len(tagKeys))
+	for _, key := range tagKeys {
+		var value strings.Builder
+		if err := server.mergeRoot.tags[key].Execute(&value, desc); err != nil {
+			return nil, fmt.Errorf("cannot render merge root tag %q: %w", key, err)
+		}
+		tags = append(tags, model.String(key, value.String()))
+	}
+
+	return mergeTraces(traces, name.String(), tags, server.rootTag), nil
+}
+
+// annotateClusters tags the spans of each trace with its cluster if the traces are from multiple clusters,
+// so that viewers can tell apart the spans of different clusters in the merged trace.
+// Spans already tagged with the key are unchanged.
+func annotateClusters(traces []*model.Trace, clusters []string, key string) {
+	multiCluster := false
+	for _, cluster := range clusters {
+		if cluster != clusters[0] {
+			multiCluster = true
+			break
+		}
+	}
+	if !multiCluster {
+		return
+	}
+
+	for i, trace := range traces {
+		for _, span := range trace.Spans {
+			if _, exists := model.KeyValues(span.Tags).FindByKey(key); !exists {
+				span.Tags = append(span.Tags, model.String(key, clusters[i]))
+			}
+		}
+	}
+}
+
+// mergeTraces merges multiple traces into one trace under a synthetic root span.
+// Spans with the same SpanID are only included once.
+// The merged trace reuses the trace ID of the first trace.
+func mergeTraces(traces []*model.Trace, rootName string, rootTags []model.KeyValue, tag rootTag) *model.Trace {
+	if len(traces) == 1 {
+		return traces[0]
+	}
+
+	var traceId model.TraceID
+	for _, trace := range traces {
+		if len(trace.Spans) > 0 {
+			traceId = trace.Spans[0].TraceID
+			break
+		}
+	}
+
+	processId, process := mergeRootProcess(traces)
+	root := &model.Span{
+		TraceID:       traceId,
+		SpanID:        model.NewSpanID(rand.Uint64()),
+		OperationName: rootName,
+		ProcessID:     processId,
+		Process:       process,
+		Tags:          rootTags,
+	}
+	if tag.key != "" {
+		root.Tags = append(root.Tags, model.String(tag.key, tag.value))
+	}
+
+	merged := &model.Trace{
+		ProcessMap: mergeProcessMaps(traces, processId, process),
+		Spans:      []*model.Span{root},
+	}
+
+	var startTime, endTime time.Time
+	seen := map[model.SpanID]struct{}{}
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			if _, exists := seen[span.SpanID]; exists {
+				continue
+			}
+			seen[span.SpanID] = struct{}{}
+
+			span.TraceID = traceId
+			for i := range span.References {
+				span.References[i].TraceID = traceId
+			}
+			if span.ParentSpanID() == 0 {
+				span.References = append(span.References, model.NewChildOfRef(traceId, root.SpanID))
+			}
+
+			if startTime.IsZero() || span.StartTime.Before(startTime) {
+				startTime = span.StartTime
+			}
+			if spanEnd := span.StartTime.Add(span.Duration); spanEnd.After(endTime) {
+				endTime = spanEnd
+			}
+
+			merged.Spans = append(merged.Spans, span)
+		}
+	}
+
+	root.StartTime = startTime
+	root.Duration = endTime.Sub(startTime)
+
+	return merged
+}
+
+// mergeRootProcess returns the process of the first root span among the traces,
+// since uiconv and the other converters dereference the process of every span.
+func mergeRootProcess(traces []*model.Trace) (string, *model.Process) {
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			if span.ParentSpanID() == 0 && span.Process != nil {
+				process := *span.Process
+				return span.ProcessID, &process
+			}
+		}
+	}
+
+	return "0", &model.Process{}
+}
+
+// mergeProcessMaps returns the union of the process maps of the traces, including the process of the synthetic root.
+// The first mapping of each process ID is kept.
+func mergeProcessMaps(traces []*model.Trace, rootProcessId string, rootProcess *model.Process) []model.Trace_ProcessMapping {
+	mappings := []model.Trace_ProcessMapping{}
+	seen := map[string]struct{}{}
+	for _, trace := range traces {
+		for _, mapping := range trace.ProcessMap {
+			if _, exists := seen[mapping.ProcessID]; !exists {
+				seen[mapping.ProcessID] = struct{}{}
+				mappings = append(mappings, mapping)
+			}
+		}
+	}
+
+	if _, exists := seen[rootProcessId]; !exists {
+		mappings = append(mappings, model.Trace_ProcessMapping{ProcessID: rootProcessId, Process: *rootProcess})
+	}
+
+	return mappings
+}
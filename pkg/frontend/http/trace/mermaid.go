@@ -0,0 +1,106 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// formatMermaid renders the span tree as a Mermaid flowchart.
+const formatMermaid = "mermaid"
+
+// mermaidLabelReplacer escapes the characters that terminate or are interpreted in quoted Mermaid labels
+// with Mermaid entity codes. Newlines are not allowed in node declarations.
+var mermaidLabelReplacer = strings.NewReplacer(
+	"#", "#35;",
+	"\"", "#quot;",
+	"&", "#amp;",
+	"<", "#lt;",
+	">", "#gt;",
+	"`", "#96;",
+	"\n", " ",
+	"\r", " ",
+)
+
+// mermaidFlowchart renders the span tree as a top-down Mermaid flowchart.
+// Each span is a node labeled `resource/name` for object spans and the operation name for other spans,
+// with an edge from each parent span to its children in start time order.
+// Rendering stops at the first write error.
+func mermaidFlowchart(writer io.Writer, trace *model.Trace) error {
+	spanIds := make(map[model.SpanID]struct{}, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spanIds[span.SpanID] = struct{}{}
+	}
+
+	var roots []*model.Span
+	children := map[model.SpanID][]*model.Span{}
+	for _, span := range trace.Spans {
+		parent := span.ParentSpanID()
+		if _, hasParent := spanIds[parent]; parent != 0 && hasParent {
+			children[parent] = append(children[parent], span)
+		} else {
+			roots = append(roots, span)
+		}
+	}
+
+	byStartTime := func(spans []*model.Span) {
+		sort.SliceStable(spans, func(i, j int) bool { return spans[i].StartTime.Before(spans[j].StartTime) })
+	}
+
+	if _, err := io.WriteString(writer, "graph TD\n"); err != nil {
+		return err
+	}
+	visited := map[model.SpanID]struct{}{}
+	// err is the first write error, which stops the traversal
+	var err error
+
+	var visit func(span *model.Span)
+	visit = func(span *model.Span) {
+		if _, seen := visited[span.SpanID]; seen || err != nil {
+			return
+		}
+		visited[span.SpanID] = struct{}{}
+
+		label := mermaidLabelReplacer.Replace(objectSpanName(span))
+		if _, err = fmt.Fprintf(writer, "    %s[\"%s\"]\n", mermaidNodeId(span.SpanID), label); err != nil {
+			return
+		}
+
+		spanChildren := children[span.SpanID]
+		byStartTime(spanChildren)
+		for _, child := range spanChildren {
+			if _, err = fmt.Fprintf(writer, "    %s --> %s\n", mermaidNodeId(span.SpanID), mermaidNodeId(child.SpanID)); err != nil {
+				return
+			}
+		}
+		for _, child := range spanChildren {
+			visit(child)
+		}
+	}
+
+	byStartTime(roots)
+	for _, root := range roots {
+		visit(root)
+	}
+
+	return err
+}
+
+func mermaidNodeId(spanId model.SpanID) string { return "span" + spanId.String() }
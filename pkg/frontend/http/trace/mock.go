@@ -0,0 +1,265 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/clusterlist"
+	jaegerreader "github.com/kubewharf/kelemetry/pkg/frontend/reader"
+	tfconfig "github.com/kubewharf/kelemetry/pkg/frontend/tf/config"
+	"github.com/kubewharf/kelemetry/pkg/manager"
+	"github.com/kubewharf/kelemetry/pkg/metrics"
+)
+
+// MockServer exposes the time-dependent helpers of the trace server for tests with a fake clock.
+type MockServer struct {
+	server *server
+
+	router  *gin.Engine
+	metrics *metrics.Mock
+}
+
+// NewMockServer creates a trace server using the clock, configured by trace server command line args.
+func NewMockServer(clock clock.Clock, args ...string) (*MockServer, error) {
+	server := &server{Clock: clock, Logger: logrus.New()}
+
+	fs := pflag.NewFlagSet("trace-server", pflag.ContinueOnError)
+	server.options.Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	server.negativeCache = newNegativeCache(clock, server.options.negativeCacheTtl, server.options.negativeCacheSize)
+	server.spanTypes = server.buildSpanTypeIndex()
+	return &MockServer{server: server}, nil
+}
+
+// NewMockHttpServer creates an initialized trace server serving the clusters from the span reader,
+// configured by trace server command line args. Requests are sent with Request.
+func NewMockHttpServer(clock clock.Clock, reader jaegerreader.Interface, clusters []string, args ...string) (*MockServer, error) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// like the default of --http-trusted-proxies, the client IP is the remote address
+	if err := router.SetTrustedProxies(nil); err != nil {
+		return nil, err
+	}
+	metricsClient, metricsOutput := metrics.NewMock(clock)
+	server := &server{
+		Clock:       clock,
+		Logger:      logrus.New(),
+		Server:      &mockHttpServer{router: router},
+		SpanReader:  reader,
+		ClusterList: mockClusterList(clusters),
+		Metrics:     metricsClient,
+	}
+
+	fs := pflag.NewFlagSet("trace-server", pflag.ContinueOnError)
+	server.options.Setup(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := constructMockMetrics(server, metricsClient); err != nil {
+		return nil, err
+	}
+	if err := server.Init(); err != nil {
+		return nil, err
+	}
+
+	return &MockServer{server: server, router: router, metrics: metricsOutput}, nil
+}
+
+// constructMockMetrics fills the metric fields of the server, which are injected by the manager in production.
+func constructMockMetrics(server *server, client metrics.Client) error {
+	value := reflect.ValueOf(server).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if !field.CanSet() || field.Kind() != reflect.Pointer {
+			continue
+		}
+
+		metric, isMetric := reflect.New(field.Type().Elem()).Interface().(interface {
+			Construct(values []reflect.Value) error
+		})
+		if !isMetric {
+			continue
+		}
+
+		var inits []func() error
+		utilCtx := &manager.UtilContext{AddOnInit: func(init func() error) { inits = append(inits, init) }}
+		if err := metric.Construct([]reflect.Value{reflect.ValueOf(utilCtx), reflect.ValueOf(client)}); err != nil {
+			return fmt.Errorf("cannot construct %s: %w", value.Type().Field(i).Name, err)
+		}
+		for _, init := range inits {
+			if err := init(); err != nil {
+				return err
+			}
+		}
+		field.Set(reflect.ValueOf(metric))
+	}
+	return nil
+}
+
+type mockHttpServer struct {
+	manager.BaseComponent
+	router *gin.Engine
+}
+
+func (server *mockHttpServer) Routes() gin.IRoutes                           { return server.router }
+func (server *mockHttpServer) AddServerModifier(modifier func(*http.Server)) {}
+
+type mockClusterList []string
+
+func (clusters mockClusterList) List() []string { return clusters }
+
+// Request serves a request without a body to a server created by NewMockHttpServer.
+func (mock *MockServer) Request(method string, target string, header http.Header) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, target, nil)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	return mock.Serve(request)
+}
+
+// Serve serves the request to a server created by NewMockHttpServer.
+func (mock *MockServer) Serve(request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	mock.router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// CoalescedWaiters returns the number of requests waiting for coalesced storage queries.
+func (mock *MockServer) CoalescedWaiters() int {
+	mock.server.coalescer.mu.Lock()
+	defer mock.server.coalescer.mu.Unlock()
+
+	waiters := 0
+	for _, call := range mock.server.coalescer.calls {
+		waiters += call.waiters
+	}
+	return waiters
+}
+
+// SetClusterList replaces the cluster list of the server.
+func (mock *MockServer) SetClusterList(clusters clusterlist.Lister) {
+	mock.server.ClusterList = clusters
+}
+
+// ClusterRefreshWaiters returns the number of requests that have waited for the cluster list refresh in progress.
+func (mock *MockServer) ClusterRefreshWaiters() int {
+	mock.server.clusterRefresher.mu.Lock()
+	defer mock.server.clusterRefresher.mu.Unlock()
+
+	if inflight := mock.server.clusterRefresher.inflight; inflight != nil {
+		return inflight.waiters
+	}
+	return 0
+}
+
+// Routes lists the registered routes of a server created by NewMockHttpServer as "METHOD path".
+func (mock *MockServer) Routes() []string {
+	routes := []string{}
+	for _, route := range mock.router.Routes() {
+		routes = append(routes, route.Method+" "+route.Path)
+	}
+	return routes
+}
+
+// MetricsOutput returns the metrics recorded by a server created by NewMockHttpServer.
+func (mock *MockServer) MetricsOutput() *metrics.Mock { return mock.metrics }
+
+// RecentWindows returns the start and end of each bucket searched with the recent and ts params.
+func (mock *MockServer) RecentWindows(ts string) ([][2]time.Time, error) {
+	windows, err := mock.server.recentWindows(ts)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make([][2]time.Time, len(windows))
+	for i, window := range windows {
+		output[i] = [2]time.Time{window.start, window.end}
+	}
+	return output, nil
+}
+
+// ResolveWindow returns the query window of the relative, start and end params.
+func (mock *MockServer) ResolveWindow(relative, start, end string) (time.Time, time.Time, error) {
+	return mock.server.resolveWindow(traceQuery{Relative: relative, Start: start, End: end})
+}
+
+// AddNegativeCache remembers that the query key matched no traces.
+func (mock *MockServer) AddNegativeCache(key string) { mock.server.negativeCache.add(key) }
+
+// NegativeCacheContains checks whether the query key is remembered to match no traces.
+func (mock *MockServer) NegativeCacheContains(key string) bool {
+	return mock.server.negativeCache.contains(key)
+}
+
+// SetMetricsFlusher replaces the function flushing the metrics client on Close.
+func (mock *MockServer) SetMetricsFlusher(flush func(ctx context.Context) error) {
+	mock.server.flushMetrics = flush
+}
+
+// BeginRequest marks a request in flight until the returned function is called.
+// Returns false if the server is shutting down.
+func (mock *MockServer) BeginRequest() (end func(), accepted bool) {
+	return mock.server.inflight.begin()
+}
+
+// Close shuts down the server, draining in-flight requests and flushing metrics.
+func (mock *MockServer) Close(ctx context.Context) error { return mock.server.Close(ctx) }
+
+// WriteTrace writes the trace as the response to a trace request with the raw query,
+// returning the status code, content type and body of the response.
+func (mock *MockServer) WriteTrace(rawQuery string, trace *model.Trace) (code int, contentType string, body string) {
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest("GET", "/extensions/api/v1/trace?"+rawQuery, nil)
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return 400, "", err.Error()
+	}
+
+	metric := &requestMetric{}
+	if code, err := mock.server.writeTrace(ctx, metric, query, trace, traceExtras{}); err != nil {
+		mock.server.writeError(ctx, code, err)
+	}
+
+	return recorder.Code, recorder.Header().Get("Content-Type"), recorder.Body.String()
+}
+
+// SetTransformConfigs replaces the transform config provider and reindexes the known span types.
+func (mock *MockServer) SetTransformConfigs(configs tfconfig.Provider) {
+	mock.server.TransformConfigs = configs
+	mock.server.spanTypes = mock.server.buildSpanTypeIndex()
+}
+
+// PruneTrace removes the logs that do not match the span_type param value.
+func (mock *MockServer) PruneTrace(trace *model.Trace, spanType string) {
+	mock.server.pruneTrace(trace, spanType)
+}
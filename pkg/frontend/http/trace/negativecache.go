@@ -0,0 +1,98 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+)
+
+type negativeCacheHitMetric struct{}
+
+func (*negativeCacheHitMetric) MetricName() string { return "extension_trace_negative_cache_hit" }
+
+// negativeCache remembers queries that recently matched no traces.
+// The number of entries is bounded; expired entries are evicted lazily.
+type negativeCache struct {
+	clock      clock.Clock
+	ttl        time.Duration
+	maxEntries int
+
+	mu     sync.Mutex
+	expiry map[string]time.Time
+}
+
+func newNegativeCache(clock clock.Clock, ttl time.Duration, maxEntries int) *negativeCache {
+	return &negativeCache{
+		clock:      clock,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		expiry:     map[string]time.Time{},
+	}
+}
+
+func (cache *negativeCache) enabled() bool { return cache.ttl > 0 && cache.maxEntries > 0 }
+
+func (cache *negativeCache) contains(key string) bool {
+	if !cache.enabled() {
+		return false
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	expiry, exists := cache.expiry[key]
+	if !exists {
+		return false
+	}
+
+	if !cache.clock.Now().Before(expiry) {
+		delete(cache.expiry, key)
+		return false
+	}
+
+	return true
+}
+
+func (cache *negativeCache) add(key string) {
+	if !cache.enabled() {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := cache.clock.Now()
+
+	if len(cache.expiry) >= cache.maxEntries {
+		for otherKey, expiry := range cache.expiry {
+			if !now.Before(expiry) {
+				delete(cache.expiry, otherKey)
+			}
+		}
+	}
+
+	if len(cache.expiry) >= cache.maxEntries {
+		// still full, evict an arbitrary entry
+		for otherKey := range cache.expiry {
+			delete(cache.expiry, otherKey)
+			break
+		}
+	}
+
+	cache.expiry[key] = now.Add(cache.ttl)
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// noTraceMatchError is returned when no trace matches the query,
+// with the help message from --trace-server-no-trace-help if configured.
+type noTraceMatchError struct {
+	err  error
+	help string
+}
+
+func (err *noTraceMatchError) Error() string {
+	if err.help == "" {
+		return err.err.Error()
+	}
+	return fmt.Sprintf("%s\n\n%s", err.err.Error(), err.help)
+}
+
+func (err *noTraceMatchError) Unwrap() error { return err.err }
+
+// noTraceHelpData is the data of the --trace-server-no-trace-help template.
+type noTraceHelpData struct {
+	Cluster   string
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+func parseNoTraceHelpTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("no-trace-help").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trace-server-no-trace-help: %w", err)
+	}
+	return tmpl, nil
+}
+
+// noTraceMatch wraps err with the help message rendered for the query.
+// The help message is omitted if the template fails.
+func (server *server) noTraceMatch(metric *requestMetric, query traceQuery, err error) (code int, _ error) {
+	code = metric.fail(classNoTraceMatch)
+	if server.noTraceHelp == nil {
+		return code, err
+	}
+
+	help := &strings.Builder{}
+	if execErr := server.noTraceHelp.Execute(help, noTraceHelpData{
+		Cluster:   query.Cluster,
+		Resource:  server.canonicalResource(query.Resource),
+		Namespace: query.Namespace,
+		Name:      query.Name,
+	}); execErr != nil {
+		server.Logger.WithError(execErr).Warn("cannot render --trace-server-no-trace-help")
+		return code, err
+	}
+
+	return code, &noTraceMatchError{err: err, help: help.String()}
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
+)
+
+type objectsQuery struct {
+	Prefix string `form:"prefix"`
+	Limit  int    `form:"limit"`
+}
+
+// objectList is the response of /extensions/api/v1/objects.
+type objectList struct {
+	Objects []objectName `json:"objects"`
+	// Truncated is true if more objects than the limit matched,
+	// or more traces than --trace-server-objects-max-traces were scanned.
+	Truncated bool `json:"truncated"`
+}
+
+type objectName struct {
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// handleObjects lists the distinct objects of a resource with traces in the window,
+// serving as the autocomplete backend for the name field.
+func (server *server) handleObjects(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	params := append([]string{"prefix", "limit"}, knownParams...)
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), params); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), params); err != nil {
+		return code, err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	objectsParams := objectsQuery{}
+	if err := ctx.BindQuery(&objectsParams); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	resource := server.canonicalResource(query.Resource)
+	if query.Cluster == "" || resource == "" {
+		return metric.fail(classEmptyParam), fmt.Errorf("cluster or resource is empty")
+	}
+
+	limit := server.options.objectsMaxResults
+	if objectsParams.Limit < 0 {
+		return metric.fail(classInvalidParam), fmt.Errorf("limit param must not be negative")
+	} else if objectsParams.Limit > 0 && objectsParams.Limit < limit {
+		limit = objectsParams.Limit
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	if !server.ensureCluster(ctx.Request.Context(), query.Cluster) {
+		return metric.fail(classUnknownCluster), fmt.Errorf("cluster %s not supported now", query.Cluster)
+	}
+
+	startTime, endTime, err := server.resolveWindow(query)
+	if err != nil {
+		return metric.fail(classInvalidTimestamp), err
+	}
+	if code, err := server.checkRetention(metric, startTime); err != nil {
+		return code, err
+	}
+
+	maxTraces := server.options.objectsMaxTraces
+	parameters := QueryParameters(query.DisplayMode, utilobject.Key{
+		Cluster:   query.Cluster,
+		Resource:  resource,
+		Namespace: query.Namespace,
+	}, startTime, endTime)
+	// one more than the limit to detect truncation
+	parameters.NumTraces = maxTraces + 1
+
+	queryCtx, cancelFunc := server.queryContext(ctx.Request.Context(), query.Cluster)
+	defer cancelFunc()
+
+	traces, err := server.queryStorage(ctx.Request.Context(), queryCtx, query.Cluster, parameters)
+	if err != nil {
+		if errors.Is(err, errFanoutTooLarge) {
+			return metric.fail(classFanoutTooLarge), err
+		}
+		return metric.fail(classTraceError), fmt.Errorf("failed to find traces %w", err)
+	}
+
+	list := &objectList{}
+	if len(traces) > maxTraces {
+		traces = traces[:maxTraces]
+		list.Truncated = true
+	}
+
+	list.Objects = distinctObjects(traces, resource, query.Namespace, objectsParams.Prefix)
+	if len(list.Objects) > limit {
+		list.Objects = list.Objects[:limit]
+		list.Truncated = true
+	}
+	if list.Truncated {
+		requestStatsFrom(ctx.Request.Context()).setResultsLimited()
+	}
+
+	return server.writeResponse(ctx, metric, list)
+}
+
+// distinctObjects returns the sorted distinct objects of the resource in the traces whose names start with prefix.
+// Objects in other namespaces are skipped if namespace is not empty.
+func distinctObjects(traces []*model.Trace, resource string, namespace string, prefix string) []objectName {
+	seen := map[objectName]struct{}{}
+	for _, trace := range traces {
+		for _, span := range trace.Spans {
+			if !hasValue(span.Tags, "resource", resource) {
+				continue
+			}
+
+			nameTag, hasName := model.KeyValues(span.Tags).FindByKey("name")
+			if !hasName || !strings.HasPrefix(nameTag.AsString(), prefix) {
+				continue
+			}
+
+			object := objectName{Name: nameTag.AsString()}
+			if namespaceTag, hasNamespace := model.KeyValues(span.Tags).FindByKey("namespace"); hasNamespace {
+				object.Namespace = namespaceTag.AsString()
+			}
+			if namespace != "" && object.Namespace != namespace {
+				continue
+			}
+
+			seen[object] = struct{}{}
+		}
+	}
+
+	objects := make([]objectName, 0, len(seen))
+	for object := range seen {
+		objects = append(objects, object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Namespace != objects[j].Namespace {
+			return objects[i].Namespace < objects[j].Namespace
+		}
+		return objects[i].Name < objects[j].Name
+	})
+	return objects
+}
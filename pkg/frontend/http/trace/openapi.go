@@ -0,0 +1,327 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"reflect"
+	"strings"
+)
+
+type jsonObject = map[string]any
+
+// openapiSpec describes the trace API in OpenAPI 3 format.
+// Query parameters are generated from the form tags of traceQuery so that new params are always listed.
+// Every route registered in Init must be described here; the admin routes are only described if they are enabled.
+func (server *server) openapiSpec() jsonObject {
+	traceSchema := jsonObject{"$ref": "#/components/schemas/Trace"}
+	if server.options.responseEnvelope {
+		traceSchema = jsonObject{"$ref": "#/components/schemas/Envelope"}
+	}
+
+	errorResponse := jsonObject{
+		"description": "error",
+		"content": jsonObject{
+			"text/plain": jsonObject{"schema": jsonObject{"type": "string"}},
+		},
+	}
+
+	traceResponses := jsonObject{
+		"200": jsonObject{
+			"description": "the matched trace",
+			"content": jsonObject{
+				"application/json": jsonObject{"schema": traceSchema},
+				"application/yaml": jsonObject{"schema": traceSchema},
+			},
+		},
+		"default": errorResponse,
+	}
+
+	// dataResponses describes the responses of a handler writing a non-trace object, which is wrapped in the envelope if enabled.
+	dataResponses := func(description string, ty reflect.Type) jsonObject {
+		schema := schemaOf(ty)
+		if server.options.responseEnvelope {
+			schema = jsonObject{
+				"type": "object",
+				"properties": jsonObject{
+					"data": schema,
+					"meta": schemaOf(reflect.TypeOf(envelopeMeta{})),
+				},
+			}
+		}
+
+		return jsonObject{
+			"200": jsonObject{
+				"description": description,
+				"content":     jsonObject{"application/json": jsonObject{"schema": schema}},
+			},
+			"default": errorResponse,
+		}
+	}
+
+	jsonBody := func(ty reflect.Type) jsonObject {
+		return jsonObject{
+			"required": true,
+			"content":  jsonObject{"application/json": jsonObject{"schema": schemaOf(ty)}},
+		}
+	}
+
+	paths := jsonObject{
+		"/extensions/api/v1/trace": jsonObject{
+			"get": jsonObject{
+				"operationId": "getTrace",
+				"parameters":  traceQueryParameters(),
+				"responses":   traceResponses,
+			},
+			"head": jsonObject{
+				"operationId": "headTrace",
+				"parameters":  traceQueryParameters(),
+				"responses": jsonObject{
+					"200":     jsonObject{"description": "the trace exists; ETag and Last-Modified identify its version"},
+					"304":     jsonObject{"description": "the ETag of the trace matches If-None-Match"},
+					"default": jsonObject{"description": "error"},
+				},
+			},
+		},
+		"/extensions/api/v1/trace/by-token/{token}": jsonObject{
+			"get": jsonObject{
+				"operationId": "getTraceByToken",
+				"parameters": []jsonObject{{
+					"name":     "token",
+					"in":       "path",
+					"required": true,
+					"schema":   jsonObject{"type": "string"},
+				}},
+				"responses": traceResponses,
+			},
+		},
+		"/extensions/api/v1/trace/stream": jsonObject{
+			"get": jsonObject{
+				"operationId": "streamTrace",
+				"parameters":  traceQueryParameters(),
+				"responses": jsonObject{
+					"200": jsonObject{
+						"description": "server-sent events: \"update\" with a trace of the new spans and logs, " +
+							"\"error\" with a storage error, and \"close\" with the reason the server closed the stream",
+						"content": jsonObject{
+							"text/event-stream": jsonObject{"schema": jsonObject{"type": "string"}},
+						},
+					},
+					"default": errorResponse,
+				},
+			},
+		},
+		"/extensions/api/v1/trace/diff": jsonObject{
+			"get": jsonObject{
+				"operationId": "diffTrace",
+				"parameters":  append(queryParameters(reflect.TypeOf(diffQuery{})), traceQueryParameters()...),
+				"responses":   dataResponses("the spans changed between the traces at ts_a and ts_b", reflect.TypeOf(traceDiff{})),
+			},
+		},
+		"/extensions/api/v1/trace/span-path": jsonObject{
+			"get": jsonObject{
+				"operationId": "getSpanPath",
+				"parameters":  append(queryParameters(reflect.TypeOf(spanPathQuery{})), traceQueryParameters()...),
+				"responses": jsonObject{
+					"200": jsonObject{
+						"description": "the spans from the root of the trace to span_id",
+						"content":     jsonObject{"application/json": jsonObject{"schema": traceSchema}},
+					},
+					"default": errorResponse,
+				},
+			},
+		},
+		"/extensions/api/v1/objects": jsonObject{
+			"get": jsonObject{
+				"operationId": "listObjects",
+				"parameters":  append(queryParameters(reflect.TypeOf(objectsQuery{})), traceQueryParameters()...),
+				"responses":   dataResponses("the objects with traces in the window", reflect.TypeOf(objectList{})),
+			},
+		},
+		"/extensions/api/v1/error-stats": jsonObject{
+			"get": jsonObject{
+				"operationId": "getErrorStats",
+				"parameters":  traceQueryParameters(),
+				"responses":   dataResponses("the spans with errors per resource in the window", reflect.TypeOf(errorStats{})),
+			},
+		},
+		"/extensions/api/v1/share": jsonObject{
+			"post": jsonObject{
+				"operationId": "shareTrace",
+				"requestBody": jsonBody(reflect.TypeOf(shareRequest{})),
+				"responses":   dataResponses("the token for the shared query", reflect.TypeOf(shareResponse{})),
+			},
+		},
+		"/extensions/api/v1/span-type-colors": jsonObject{
+			"get": jsonObject{
+				"operationId": "getSpanTypeColors",
+				"responses": jsonObject{
+					"200": jsonObject{
+						"description": "map of span type to display color",
+						"content": jsonObject{
+							"application/json": jsonObject{"schema": jsonObject{
+								"type":                 "object",
+								"additionalProperties": jsonObject{"type": "string"},
+							}},
+						},
+					},
+				},
+			},
+		},
+		"/extensions/api/v1/openapi.json": jsonObject{
+			"get": jsonObject{
+				"operationId": "getOpenapiSpec",
+				"responses": jsonObject{
+					"200": jsonObject{
+						"description": "this document",
+						"content":     jsonObject{"application/json": jsonObject{"schema": jsonObject{"type": "object"}}},
+					},
+				},
+			},
+		},
+		"/readyz": jsonObject{
+			"get": jsonObject{
+				"operationId": "getReadyz",
+				"responses": jsonObject{
+					"200": jsonObject{
+						"description": "the server is ready",
+						"content":     jsonObject{"text/plain": jsonObject{"schema": jsonObject{"type": "string"}}},
+					},
+					"default": errorResponse,
+				},
+			},
+		},
+	}
+
+	if server.options.enableAdmin {
+		paths["/extensions/api/v1/admin/reload-clusters"] = jsonObject{
+			"post": jsonObject{
+				"operationId": "reloadClusters",
+				"responses":   dataResponses("the cluster list after the reload", reflect.TypeOf(reloadClustersResponse{})),
+			},
+		}
+		paths["/extensions/api/v1/admin/maintenance"] = jsonObject{
+			"post": jsonObject{
+				"operationId": "setMaintenance",
+				"requestBody": jsonBody(reflect.TypeOf(maintenanceRequest{})),
+				"responses":   dataResponses("the maintenance status after the change", reflect.TypeOf(maintenanceStatus{})),
+			},
+		}
+		paths["/extensions/api/v1/admin/export"] = jsonObject{
+			"post": jsonObject{
+				"operationId": "exportTrace",
+				"requestBody": jsonBody(reflect.TypeOf(exportRequest{})),
+				"responses":   dataResponses("the key of the exported trace in the export store", reflect.TypeOf(exportResponse{})),
+			},
+		}
+	}
+
+	return jsonObject{
+		"openapi": "3.0.3",
+		"info": jsonObject{
+			"title":   "Kelemetry trace API",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": jsonObject{
+			"schemas": jsonObject{
+				// The trace is in the Jaeger UI JSON format; only the top-level fields are described.
+				"Trace": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"traceID":   jsonObject{"type": "string"},
+						"spans":     jsonObject{"type": "array", "items": jsonObject{"type": "object"}},
+						"processes": jsonObject{"type": "object"},
+						"warnings":  jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+					},
+				},
+				"Envelope": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"data": jsonObject{"$ref": "#/components/schemas/Trace"},
+						"meta": schemaOf(reflect.TypeOf(envelopeMeta{})),
+					},
+				},
+			},
+		},
+	}
+}
+
+func traceQueryParameters() []jsonObject { return queryParameters(reflect.TypeOf(traceQuery{})) }
+
+// queryParameters lists the query parameters bound from the form tags of a query struct.
+func queryParameters(queryType reflect.Type) []jsonObject {
+	params := make([]jsonObject, 0, queryType.NumField())
+	for i := 0; i < queryType.NumField(); i++ {
+		field := queryType.Field(i)
+		name := field.Tag.Get("form")
+		if name == "" {
+			continue
+		}
+
+		schema := schemaOf(field.Type)
+		if name == "format" {
+			schema["enum"] = registeredFormats()
+		}
+
+		params = append(params, jsonObject{
+			"name":   name,
+			"in":     "query",
+			"schema": schema,
+		})
+	}
+
+	return params
+}
+
+// schemaOf derives a JSON schema from a Go type.
+// Struct fields are named after their json tags.
+func schemaOf(ty reflect.Type) jsonObject {
+	if ty.Kind() == reflect.Pointer {
+		ty = ty.Elem()
+	}
+
+	switch ty.Kind() {
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": schemaOf(ty.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": schemaOf(ty.Elem())}
+	case reflect.Struct:
+		if ty.PkgPath() == "time" && ty.Name() == "Time" {
+			return jsonObject{"type": "string", "format": "date-time"}
+		}
+
+		properties := jsonObject{}
+		for i := 0; i < ty.NumField(); i++ {
+			field := ty.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			properties[name] = schemaOf(field.Type)
+		}
+		return jsonObject{"type": "object", "properties": properties}
+	default:
+		return jsonObject{}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestOpenapiSpecCoversRoutes(t *testing.T) {
+	for name, args := range map[string][]string{
+		"default": nil,
+		"admin":   {"--trace-server-enable-admin"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			clock := clocktesting.NewFakeClock(time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC))
+			mock, err := trace.NewMockHttpServer(clock, newFakeReader(), []string{"test"}, args...)
+			assert.NoError(err)
+
+			response := mock.Request("GET", "/extensions/api/v1/openapi.json", nil)
+			assert.Equal(200, response.Code)
+
+			var spec struct {
+				Paths map[string]map[string]any `json:"paths"`
+			}
+			assert.NoError(json.Unmarshal(response.Body.Bytes(), &spec))
+
+			routes := mock.Routes()
+			documented := 0
+			for _, operations := range spec.Paths {
+				documented += len(operations)
+			}
+			assert.Equal(len(routes), documented, "the spec describes only registered routes")
+
+			pathParam := regexp.MustCompile(`:(\w+)`)
+			for _, route := range routes {
+				method, path, _ := strings.Cut(route, " ")
+				path = pathParam.ReplaceAllString(path, "{$1}")
+				assert.Contains(spec.Paths[path], strings.ToLower(method), "%s is not in the spec", route)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// otlpLinkTags is a pair of span tags converted into an OTLP span link.
+type otlpLinkTags struct {
+	traceId string
+	spanId  string
+}
+
+// parseOtlpLinkTags parses --trace-server-otlp-link-tags values of the form `traceIdTag:spanIdTag`.
+func parseOtlpLinkTags(values []string) ([]otlpLinkTags, error) {
+	pairs := make([]otlpLinkTags, 0, len(values))
+	for _, value := range values {
+		traceIdTag, spanIdTag, ok := strings.Cut(value, ":")
+		if !ok || traceIdTag == "" || spanIdTag == "" {
+			return nil, fmt.Errorf("invalid --trace-server-otlp-link-tags value %q, expected traceIdTag:spanIdTag", value)
+		}
+		pairs = append(pairs, otlpLinkTags{traceId: traceIdTag, spanId: spanIdTag})
+	}
+	return pairs, nil
+}
+
+// otlpKindRule infers the OTLP span kind of spans with a tag value.
+type otlpKindRule struct {
+	key   string
+	value string
+	kind  tracepb.Span_SpanKind
+}
+
+// defaultOtlpKindRules treat audit writes as served by the apiserver.
+// Other spans, such as controller actions, default to INTERNAL.
+var defaultOtlpKindRules = []string{"verb=create:server", "verb=update:server", "verb=patch:server", "verb=delete:server"}
+
+// parseOtlpKindRules parses --trace-server-otlp-span-kind-rules values of the form `tag=value:kind`.
+func parseOtlpKindRules(values []string) ([]otlpKindRule, error) {
+	rules := make([]otlpKindRule, 0, len(values))
+	for _, value := range values {
+		match, kindName, ok := strings.Cut(value, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid --trace-server-otlp-span-kind-rules value %q, expected tag=value:kind", value)
+		}
+
+		key, tagValue, ok := strings.Cut(match, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --trace-server-otlp-span-kind-rules value %q, expected tag=value:kind", value)
+		}
+
+		kind, known := otlpSpanKinds[kindName]
+		if !known {
+			return nil, fmt.Errorf("unknown span kind %q in --trace-server-otlp-span-kind-rules value %q", kindName, value)
+		}
+
+		rules = append(rules, otlpKindRule{key: key, value: tagValue, kind: kind})
+	}
+	return rules, nil
+}
+
+// toOtlp converts the trace into OTLP, with one ResourceSpans per jaeger process.
+// Tags matching linkTags and FOLLOWS_FROM references are converted into span links.
+// The span kind is taken from the span.kind tag, or the first matching kind rule, or INTERNAL.
+func toOtlp(trace *model.Trace, linkTags []otlpLinkTags, kindRules []otlpKindRule) *tracepb.TracesData {
+	processes := map[string]*model.Process{}
+	for _, mapping := range trace.ProcessMap {
+		process := mapping.Process
+		processes[mapping.ProcessID] = &process
+	}
+
+	resourceSpans := map[string]*tracepb.ResourceSpans{}
+	data := &tracepb.TracesData{}
+
+	for _, span := range trace.Spans {
+		rs, exists := resourceSpans[span.ProcessID]
+		if !exists {
+			resource := &resourcepb.Resource{}
+			process := span.Process
+			if process == nil {
+				process = processes[span.ProcessID]
+			}
+			if process != nil {
+				resource.Attributes = append(
+					[]*commonpb.KeyValue{otlpString("service.name", process.ServiceName)},
+					otlpAttributes(process.Tags)...,
+				)
+			}
+
+			rs = &tracepb.ResourceSpans{
+				Resource:   resource,
+				ScopeSpans: []*tracepb.ScopeSpans{{Scope: &commonpb.InstrumentationScope{Name: "kelemetry"}}},
+			}
+			resourceSpans[span.ProcessID] = rs
+			data.ResourceSpans = append(data.ResourceSpans, rs)
+		}
+
+		rs.ScopeSpans[0].Spans = append(rs.ScopeSpans[0].Spans, toOtlpSpan(span, linkTags, kindRules))
+	}
+
+	return data
+}
+
+func toOtlpSpan(span *model.Span, linkTags []otlpLinkTags, kindRules []otlpKindRule) *tracepb.Span {
+	otlpSpan := &tracepb.Span{
+		TraceId:           otlpTraceId(span.TraceID),
+		SpanId:            otlpSpanId(span.SpanID),
+		Name:              span.OperationName,
+		Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+		StartTimeUnixNano: uint64(span.StartTime.UnixNano()),
+		EndTimeUnixNano:   uint64(span.StartTime.Add(span.Duration).UnixNano()),
+	}
+
+	if parent := span.ParentSpanID(); parent != 0 {
+		otlpSpan.ParentSpanId = otlpSpanId(parent)
+	}
+
+	for _, ref := range span.References {
+		if ref.RefType == model.FollowsFrom {
+			otlpSpan.Links = append(otlpSpan.Links, &tracepb.Span_Link{
+				TraceId: otlpTraceId(ref.TraceID),
+				SpanId:  otlpSpanId(ref.SpanID),
+			})
+		}
+	}
+
+	linkTagKeys := map[string]struct{}{}
+	for _, pair := range linkTags {
+		traceIdKv, hasTraceId := model.KeyValues(span.Tags).FindByKey(pair.traceId)
+		spanIdKv, hasSpanId := model.KeyValues(span.Tags).FindByKey(pair.spanId)
+		if !hasTraceId || !hasSpanId {
+			continue
+		}
+
+		traceId, err := model.TraceIDFromString(traceIdKv.AsString())
+		if err != nil {
+			continue
+		}
+		spanId, err := model.SpanIDFromString(spanIdKv.AsString())
+		if err != nil {
+			continue
+		}
+
+		otlpSpan.Links = append(otlpSpan.Links, &tracepb.Span_Link{
+			TraceId: otlpTraceId(traceId),
+			SpanId:  otlpSpanId(spanId),
+		})
+		linkTagKeys[pair.traceId] = struct{}{}
+		linkTagKeys[pair.spanId] = struct{}{}
+	}
+
+	tags := make([]model.KeyValue, 0, len(span.Tags))
+	for _, tag := range span.Tags {
+		if _, isLink := linkTagKeys[tag.Key]; !isLink {
+			tags = append(tags, tag)
+		}
+	}
+	otlpSpan.Attributes = otlpAttributes(tags)
+
+	if kind, ok := model.KeyValues(span.Tags).FindByKey("span.kind"); ok {
+		otlpSpan.Kind = otlpSpanKind(kind.AsString())
+	} else {
+		for _, rule := range kindRules {
+			if hasValue(span.Tags, rule.key, rule.value) {
+				otlpSpan.Kind = rule.kind
+				break
+			}
+		}
+	}
+
+	if isError, ok := model.KeyValues(span.Tags).FindByKey("error"); ok && isError.AsString() == "true" {
+		otlpSpan.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR}
+	}
+
+	for _, log := range span.Logs {
+		otlpSpan.Events = append(otlpSpan.Events, &tracepb.Span_Event{
+			Name:         "log",
+			TimeUnixNano: uint64(log.Timestamp.UnixNano()),
+			Attributes:   otlpAttributes(log.Fields),
+		})
+	}
+
+	return otlpSpan
+}
+
+func otlpTraceId(traceId model.TraceID) []byte {
+	bytes := make([]byte, 16)
+	binary.BigEndian.PutUint64(bytes[:8], traceId.High)
+	binary.BigEndian.PutUint64(bytes[8:], traceId.Low)
+	return bytes
+}
+
+func otlpSpanId(spanId model.SpanID) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(spanId))
+	return bytes
+}
+
+var otlpSpanKinds = map[string]tracepb.Span_SpanKind{
+	"internal": tracepb.Span_SPAN_KIND_INTERNAL,
+	"server":   tracepb.Span_SPAN_KIND_SERVER,
+	"client":   tracepb.Span_SPAN_KIND_CLIENT,
+	"producer": tracepb.Span_SPAN_KIND_PRODUCER,
+	"consumer": tracepb.Span_SPAN_KIND_CONSUMER,
+}
+
+func otlpSpanKind(kind string) tracepb.Span_SpanKind {
+	if otlpKind, known := otlpSpanKinds[kind]; known {
+		return otlpKind
+	}
+	return tracepb.Span_SPAN_KIND_INTERNAL
+}
+
+func otlpString(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+func otlpAttributes(kvs []model.KeyValue) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		value := &commonpb.AnyValue{}
+		switch kv.VType {
+		case model.BoolType:
+			value.Value = &commonpb.AnyValue_BoolValue{BoolValue: kv.Bool()}
+		case model.Int64Type:
+			value.Value = &commonpb.AnyValue_IntValue{IntValue: kv.Int64()}
+		case model.Float64Type:
+			value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: kv.Float64()}
+		case model.BinaryType:
+			value.Value = &commonpb.AnyValue_BytesValue{BytesValue: kv.Binary()}
+		default:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.AsString()}
+		}
+		attributes = append(attributes, &commonpb.KeyValue{Key: kv.Key, Value: value})
+	}
+	return attributes
+}
@@ -0,0 +1,299 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	formatJson = "json"
+	formatYaml = "yaml"
+	// OTLP TracesData in the protobuf JSON encoding.
+	formatOtlp = "otlp"
+	// Folded stacks for flamegraph tools.
+	formatFolded = "folded"
+)
+
+func (server *server) validateEnabledFormats() error {
+	for _, format := range server.options.enabledFormats {
+		if _, exists := lookupFormat(format); !exists {
+			return fmt.Errorf("invalid --trace-server-enabled-formats value %q, must be one of %q", format, registeredFormats())
+		}
+	}
+	return nil
+}
+
+// validateDefaultFormats checks that --trace-server-default-format and --trace-server-client-formats are enabled.
+func (server *server) validateDefaultFormats() error {
+	if _, exists := lookupFormat(server.options.defaultFormat); !exists {
+		return fmt.Errorf("invalid --trace-server-default-format %q, must be one of %q", server.options.defaultFormat, registeredFormats())
+	}
+	if !containsString(server.enabledFormats(), server.options.defaultFormat) {
+		return fmt.Errorf("--trace-server-default-format %q is not in --trace-server-enabled-formats", server.options.defaultFormat)
+	}
+
+	if len(server.options.clientFormats) > 0 && server.options.clientHeader == "" {
+		return fmt.Errorf("--trace-server-client-formats requires --trace-server-client-header")
+	}
+	for client, format := range server.options.clientFormats {
+		if _, exists := lookupFormat(format); !exists {
+			return fmt.Errorf(
+				"invalid --trace-server-client-formats value %q for client %q, must be one of %q",
+				format, client, registeredFormats(),
+			)
+		}
+		if !containsString(server.enabledFormats(), format) {
+			return fmt.Errorf(
+				"--trace-server-client-formats value %q for client %q is not in --trace-server-enabled-formats",
+				format, client,
+			)
+		}
+	}
+
+	return nil
+}
+
+// defaultFormat returns the format of requests without the format param,
+// which is the --trace-server-client-formats entry of the client identified by --trace-server-client-header,
+// or --trace-server-default-format if the client has no entry.
+func (server *server) defaultFormat(ctx *gin.Context) string {
+	if len(server.options.clientFormats) == 0 {
+		return server.options.defaultFormat
+	}
+
+	// the response format depends on the header, so caches must not share it between clients
+	ctx.Writer.Header().Add("Vary", server.options.clientHeader)
+	if format, exists := server.options.clientFormats[ctx.GetHeader(server.options.clientHeader)]; exists {
+		return format
+	}
+	return server.options.defaultFormat
+}
+
+func containsString(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+// enabledFormats returns the formats allowed by --trace-server-enabled-formats.
+func (server *server) enabledFormats() []string {
+	if len(server.options.enabledFormats) == 0 {
+		return registeredFormats()
+	}
+	return server.options.enabledFormats
+}
+
+// checkFormatEnabled rejects registered formats disabled by --trace-server-enabled-formats.
+// Unknown formats are rejected by the caller.
+func (server *server) checkFormatEnabled(metric *requestMetric, format string) (code int, err error) {
+	if !containsString(server.enabledFormats(), format) {
+		return metric.fail(classFormatDisabled),
+			fmt.Errorf("format %q is disabled, enabled formats are %q", format, server.enabledFormats())
+	}
+	return 0, nil
+}
+
+// envelope wraps responses when --trace-server-response-envelope is enabled.
+type envelope struct {
+	Data any          `json:"data"`
+	Meta envelopeMeta `json:"meta"`
+}
+
+type envelopeMeta struct {
+	TraceId string `json:"trace_id,omitempty"`
+	// SpanCount is the number of spans of a single trace response, or 0 for other responses.
+	SpanCount int      `json:"span_count"`
+	Warnings  []string `json:"warnings,omitempty"`
+	// ResultsLimited indicates that more traces may match than --trace-server-max-find-results.
+	ResultsLimited bool   `json:"results_limited,omitempty"`
+	Error          string `json:"error,omitempty"`
+	// Help is the --trace-server-no-trace-help message for NoTraceMatch errors.
+	Help string `json:"help,omitempty"`
+	// Snapshots are the object snapshots keyed by span ID if include_snapshots is requested.
+	Snapshots map[string][]objectSnapshot `json:"snapshots,omitempty"`
+	// Gaps are the coverage gaps of the matching spans if expected_interval is requested.
+	Gaps []coverageGap `json:"gaps,omitempty"`
+}
+
+// traceExtras are derived from the trace on request and returned in the envelope meta.
+type traceExtras struct {
+	snapshots map[string][]objectSnapshot
+	gaps      []coverageGap
+}
+
+func (extras traceExtras) requested() bool { return extras.snapshots != nil || extras.gaps != nil }
+
+// writeTrace writes the trace in the format registered for the format param.
+func (server *server) writeTrace(
+	ctx *gin.Context,
+	metric *requestMetric,
+	query traceQuery,
+	trace *model.Trace,
+	extras traceExtras,
+) (code int, err error) {
+	formatName := query.Format
+	if formatName == "" {
+		formatName = server.defaultFormat(ctx)
+	}
+
+	format, known := lookupFormat(formatName)
+	if !known {
+		return metric.fail(classInvalidFormat), fmt.Errorf("unknown format %q, supported formats are %q", formatName, registeredFormats())
+	}
+	if code, err := server.checkFormatEnabled(metric, formatName); err != nil {
+		return code, err
+	}
+
+	server.setResultsLimitedHeader(ctx)
+
+	contentType, body, err := format(trace, &FormatRequest{
+		Query:  ctx.Request.URL.Query(),
+		server: server,
+		ctx:    ctx,
+		query:  query,
+		extras: extras,
+	})
+	if err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			return server.responseTooLarge(metric)
+		}
+		return metric.fail(classMarshalError), fmt.Errorf("cannot write trace as %s: %w", formatName, err)
+	}
+
+	if code, err := server.checkResponseSize(metric, len(body)); err != nil {
+		return code, err
+	}
+	ctx.Data(200, contentType, body)
+	return 0, nil
+}
+
+// writeJSON writes the object as JSON, indented if pretty=true is requested.
+func (server *server) writeJSON(ctx *gin.Context, code int, obj any) {
+	jsonBytes, err := server.encodeJSON(ctx, obj, 0)
+	if err != nil {
+		ctx.Status(500)
+		_, _ = ctx.Writer.WriteString(fmt.Sprintf("cannot marshal response: %v", err))
+		return
+	}
+	ctx.Data(code, jsonContentType, jsonBytes)
+}
+
+// writeResponse writes the object as a JSON trace response limited by --trace-server-max-response-bytes,
+// wrapped in the response envelope if enabled.
+func (server *server) writeResponse(ctx *gin.Context, metric *requestMetric, obj any) (code int, err error) {
+	jsonBytes, err := server.encodeJSON(ctx, server.wrapEnvelope(ctx, obj), server.options.maxResponseBytes)
+	if err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			return server.responseTooLarge(metric)
+		}
+		return metric.fail(classMarshalError), fmt.Errorf("cannot marshal response: %w", err)
+	}
+
+	server.setResultsLimitedHeader(ctx)
+	ctx.Data(200, jsonContentType, jsonBytes)
+	return 0, nil
+}
+
+// wrapEnvelope wraps the data of a non-trace response in the response envelope if --trace-server-response-envelope is enabled.
+func (server *server) wrapEnvelope(ctx *gin.Context, data any) any {
+	if !server.options.responseEnvelope {
+		return data
+	}
+	return envelope{Data: data, Meta: envelopeMeta{ResultsLimited: requestStatsFrom(ctx.Request.Context()).isResultsLimited()}}
+}
+
+func (server *server) setResultsLimitedHeader(ctx *gin.Context) {
+	if requestStatsFrom(ctx.Request.Context()).isResultsLimited() {
+		ctx.Header(resultsLimitedHeader, "true")
+	}
+}
+
+const jsonContentType = "application/json; charset=utf-8"
+
+var errResponseTooLarge = errors.New("response too large")
+
+// encodeJSON marshals the object as JSON, indented if pretty=true is requested.
+// Returns errResponseTooLarge as soon as the output exceeds limit bytes if limit is positive.
+func (server *server) encodeJSON(ctx *gin.Context, obj any, limit int64) ([]byte, error) {
+	writer := &cappedBuffer{limit: limit}
+	encoder := json.NewEncoder(writer)
+	if pretty, _ := strconv.ParseBool(ctx.Query("pretty")); pretty {
+		encoder.SetIndent("", strings.Repeat(" ", server.options.prettyIndent))
+	}
+
+	if err := encoder.Encode(obj); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(writer.buf.Bytes(), []byte("\n")), nil
+}
+
+// cappedBuffer is a buffer failing writes beyond the limit, or unbounded if the limit is not positive.
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	limit int64
+}
+
+func (writer *cappedBuffer) Write(data []byte) (int, error) {
+	if writer.limit > 0 && int64(writer.buf.Len()+len(data)) > writer.limit {
+		return 0, errResponseTooLarge
+	}
+	return writer.buf.Write(data)
+}
+
+// checkResponseSize returns an error if a non-JSON response body exceeds --trace-server-max-response-bytes.
+func (server *server) checkResponseSize(metric *requestMetric, size int) (code int, err error) {
+	if limit := server.options.maxResponseBytes; limit > 0 && int64(size) > limit {
+		return server.responseTooLarge(metric)
+	}
+	return 0, nil
+}
+
+func (server *server) responseTooLarge(metric *requestMetric) (code int, err error) {
+	return metric.fail(classResponseTooLarge), fmt.Errorf(
+		"response exceeds %d bytes, narrow down the trace with filters such as span_type or select fewer fields with the fields param",
+		server.options.maxResponseBytes,
+	)
+}
+
+// writeError writes the error message as plain text, or in the response envelope if enabled.
+func (server *server) writeError(ctx *gin.Context, code int, err error) {
+	if server.options.responseEnvelope {
+		meta := envelopeMeta{Error: err.Error()}
+
+		var noMatchErr *noTraceMatchError
+		if errors.As(err, &noMatchErr) {
+			meta.Error = noMatchErr.err.Error()
+			meta.Help = noMatchErr.help
+		}
+
+		server.writeJSON(ctx, code, envelope{Meta: meta})
+	} else {
+		ctx.Status(code)
+		_, _ = ctx.Writer.WriteString(err.Error())
+	}
+	ctx.Abort()
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestListResponseEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-response-envelope")
+	assert.NoError(err)
+
+	response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web"+
+		"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z&list=true", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var body struct {
+		Data []struct {
+			Spans []json.RawMessage `json:"spans"`
+		} `json:"data"`
+		Meta *struct{} `json:"meta"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+	assert.NotNil(body.Meta)
+	if assert.Len(body.Data, 1) {
+		assert.Len(body.Data[0].Spans, 2)
+	}
+}
+
+func TestTagDenylistAppliesToEveryTraceResponse(t *testing.T) {
+	const target = "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&relative=-1h"
+	const streamTarget = "/extensions/api/v1/trace/stream?cluster=test&resource=pods&namespace=default&name=web&relative=-1h"
+
+	for name, target := range map[string]string{
+		"trace":     target,
+		"list":      target + "&list=true",
+		"root_only": target + "&root_only=true",
+		"stream":    streamTarget,
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			span := auditSpan(1, "create", time.Now().Add(-10*time.Minute))
+			span.Tags = append(span.Tags, model.String("secret", "hunter2"))
+			reader := newFakeReader()
+			reader.addObject("web", span)
+			pseudo := reader.objects["web"][0]
+			pseudo.Tags = append(pseudo.Tags, model.String("secret", "hunter2"))
+
+			// the real clock lets the stream end by its lifetime after the first update
+			mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"},
+				"--trace-server-tag-denylist=secret", "--trace-server-stream-max-lifetime=10ms")
+			assert.NoError(err)
+
+			response := mock.Request("GET", target, nil)
+			assert.Equal(200, response.Code, response.Body.String())
+			assert.Contains(response.Body.String(), "pods web")
+			assert.NotContains(response.Body.String(), "hunter2")
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// PhaseTag is the tag of spans recording the lifecycle phase of the object, e.g. `Pending`, `Running` or `Failed`.
+// The aggregator does not record phases by itself; `?phase=` only matches spans and logs with this tag,
+// which requires an aggregator decorator or a custom span source to record status transitions.
+// Similar to UserTag, the tag must be mapped into a log field of the same name
+// to match the logs of collapsed spans.
+const PhaseTag = "phase"
+
+// filterByPhase keeps the spans and logs with a PhaseTag equal to any of the phases and their ancestors.
+// Phases are compared case-insensitively.
+func filterByPhase(trace *model.Trace, phases []string) {
+	filterSpansAndLogs(trace, func(kvs []model.KeyValue) bool {
+		kv, ok := model.KeyValues(kvs).FindByKey(PhaseTag)
+		if !ok {
+			return false
+		}
+
+		value := kv.AsString()
+		for _, phase := range phases {
+			if strings.EqualFold(value, phase) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
+)
+
+const projectedTagPrefix = "tags."
+
+// projectableFields are the span fields selectable by the fields param, named after their JSON keys.
+// Individual tags are selected with `tags.<key>`.
+var projectableFields = map[string]func(span *uimodel.Span) any{
+	"traceID":       func(span *uimodel.Span) any { return span.TraceID },
+	"spanID":        func(span *uimodel.Span) any { return span.SpanID },
+	"operationName": func(span *uimodel.Span) any { return span.OperationName },
+	"references":    func(span *uimodel.Span) any { return span.References },
+	"startTime":     func(span *uimodel.Span) any { return span.StartTime },
+	"duration":      func(span *uimodel.Span) any { return span.Duration },
+	"tags":          func(span *uimodel.Span) any { return span.Tags },
+	"logs":          func(span *uimodel.Span) any { return span.Logs },
+	"processID":     func(span *uimodel.Span) any { return span.ProcessID },
+	"warnings":      func(span *uimodel.Span) any { return span.Warnings },
+}
+
+// projectedTrace is the response of `?fields=...`.
+type projectedTrace struct {
+	TraceId uimodel.TraceID  `json:"traceID"`
+	Spans   []map[string]any `json:"spans"`
+}
+
+// parseFields validates a comma-separated list of field paths.
+func parseFields(value string) (fields []string, tagKeys []string, err error) {
+	for _, path := range strings.Split(value, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		if tagKey, isTag := strings.CutPrefix(path, projectedTagPrefix); isTag {
+			if tagKey == "" {
+				return nil, nil, fmt.Errorf("empty tag key in field %q", path)
+			}
+			tagKeys = append(tagKeys, tagKey)
+			continue
+		}
+
+		if _, known := projectableFields[path]; !known {
+			return nil, nil, fmt.Errorf("unknown field %q", path)
+		}
+		fields = append(fields, path)
+	}
+
+	if len(fields) == 0 && len(tagKeys) == 0 {
+		return nil, nil, fmt.Errorf("no fields selected")
+	}
+
+	return fields, tagKeys, nil
+}
+
+// projectTrace keeps only the selected fields of each span.
+// Selected tags are returned as a list under `tags` unless all tags are selected.
+func projectTrace(trace *model.Trace, fields []string, tagKeys []string) *projectedTrace {
+	uiTrace := uiconv.FromDomain(trace)
+
+	projected := &projectedTrace{
+		TraceId: uiTrace.TraceID,
+		Spans:   make([]map[string]any, 0, len(uiTrace.Spans)),
+	}
+
+	for i := range uiTrace.Spans {
+		span := &uiTrace.Spans[i]
+
+		out := make(map[string]any, len(fields)+1)
+		for _, field := range fields {
+			out[field] = projectableFields[field](span)
+		}
+
+		if _, allTags := out["tags"]; !allTags && len(tagKeys) > 0 {
+			tags := []uimodel.KeyValue{}
+			for _, tag := range span.Tags {
+				for _, tagKey := range tagKeys {
+					if tag.Key == tagKey {
+						tags = append(tags, tag)
+						break
+					}
+				}
+			}
+			out["tags"] = tags
+		}
+
+		projected.Spans = append(projected.Spans, out)
+	}
+
+	return projected
+}
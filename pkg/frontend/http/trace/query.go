@@ -0,0 +1,183 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// paramUsageMetric counts requests using each query param.
+// Only params declared in traceQuery are counted so that the cardinality is bounded.
+type paramUsageMetric struct {
+	Param string
+}
+
+func (*paramUsageMetric) MetricName() string { return "extension_trace_param_usage" }
+
+// knownParams lists the names of the params accepted by traceQuery.
+var knownParams = formParams(reflect.TypeOf(traceQuery{}), false)
+
+// multiValuedParams lists the params that may be repeated, i.e. the slice fields of traceQuery.
+var multiValuedParams = formParams(reflect.TypeOf(traceQuery{}), true)
+
+func formParams(queryType reflect.Type, multiValuedOnly bool) []string {
+	names := make([]string, 0, queryType.NumField())
+	for i := 0; i < queryType.NumField(); i++ {
+		field := queryType.Field(i)
+		if multiValuedOnly && field.Type.Kind() != reflect.Slice {
+			continue
+		}
+		if name := field.Tag.Get("form"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validateParamMultiplicity returns an error if any of the named params is repeated but not multi-valued,
+// since the binding silently uses the first value.
+// Multi-valued params are the slice fields of traceQuery. Params not in names are ignored.
+func validateParamMultiplicity(values url.Values, names []string) error {
+	for _, name := range names {
+		if len(values[name]) > 1 && !containsString(multiValuedParams, name) {
+			return fmt.Errorf("param %s must not be repeated", name)
+		}
+	}
+	return nil
+}
+
+// checkStrictQuery rejects params not in names if --trace-server-strict-query is enabled,
+// since the binding silently ignores unknown params, e.g. a typo of a required param.
+func (server *server) checkStrictQuery(metric *requestMetric, values url.Values, names []string) (code int, err error) {
+	if !server.options.strictQuery {
+		return 0, nil
+	}
+
+	var unknown []string
+	for name := range values {
+		if !containsString(names, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return 0, nil
+	}
+
+	sort.Strings(unknown)
+	allowed := append([]string(nil), names...)
+	sort.Strings(allowed)
+	return metric.fail(classUnknownParam), fmt.Errorf("unknown params %q, allowed params are %q", unknown, allowed)
+}
+
+// countParamUsage records the presence (not the value) of each known param in the request.
+func (server *server) countParamUsage(values url.Values) {
+	for _, name := range presentParams(values, knownParams) {
+		server.ParamUsageMetric.With(&paramUsageMetric{Param: name}).Count(1)
+	}
+}
+
+// paramConflict declares that none of the params in `left` may be used together with any param in `right`.
+type paramConflict struct {
+	left  []string
+	right []string
+}
+
+// singleTraceParams are the params that only filter or annotate single trace responses,
+// so they are ignored by the list and root_only responses.
+var singleTraceParams = []string{
+	"include_events", "user", "component", "phase", "rv_min", "rv_max", "self_time", "collapse_repeats", "critical_path",
+	"max_per_span_type", "max_logs_per_span", "search", "include_snapshots", "expected_interval", "since", "since_span_ids",
+	"also_cluster",
+}
+
+// The list, summary and projection responses are always JSON, so they conflict with the format param,
+// which only selects the format of single trace responses.
+var paramConflicts = []paramConflict{
+	{left: []string{"relative"}, right: []string{"start", "end"}},
+	{left: []string{"ts"}, right: []string{"relative", "start", "end"}},
+	{left: []string{"list", "root_only", "recent", "all_in_namespace"}, right: singleTraceParams},
+	{left: []string{"list"}, right: []string{"root_only", "also_name", "format"}},
+	{left: []string{"root_only"}, right: []string{"format"}},
+	{left: []string{"group_by"}, right: []string{"list", "root_only", "format"}},
+	{left: []string{"fields"}, right: []string{"group_by", "list", "root_only", "recent", "all_in_namespace", "format"}},
+	{
+		left:  []string{"recent"},
+		right: []string{"relative", "start", "end", "list", "root_only", "also_name", "all_in_namespace", "group_by", "format"},
+	},
+	{left: []string{"all_in_namespace"}, right: []string{"name", "also_name", "list", "root_only", "group_by", "format"}},
+	{left: []string{"subtree"}, right: []string{"list", "root_only", "recent", "all_in_namespace"}},
+}
+
+// validateParamConflicts returns an error naming the conflicting params if the request uses mutually exclusive params.
+// Boolean params set to false are not considered used.
+func validateParamConflicts(values url.Values) error {
+	for _, conflict := range paramConflicts {
+		leftPresent := enabledParams(values, conflict.left)
+		rightPresent := enabledParams(values, conflict.right)
+		if len(leftPresent) > 0 && len(rightPresent) > 0 {
+			return fmt.Errorf(
+				"conflicting params: %s cannot be used with %s",
+				strings.Join(leftPresent, ", "),
+				strings.Join(rightPresent, ", "),
+			)
+		}
+	}
+
+	return nil
+}
+
+func presentParams(values url.Values, names []string) []string {
+	var present []string
+	for _, name := range names {
+		if values.Has(name) {
+			present = append(present, name)
+		}
+	}
+	return present
+}
+
+// boolParams lists the params of the bool fields of traceQuery, which are disabled by default.
+var boolParams = func() []string {
+	queryType := reflect.TypeOf(traceQuery{})
+	names := []string{}
+	for i := 0; i < queryType.NumField(); i++ {
+		field := queryType.Field(i)
+		if name := field.Tag.Get("form"); name != "" && field.Type.Kind() == reflect.Bool {
+			names = append(names, name)
+		}
+	}
+	return names
+}()
+
+// enabledParams is presentParams excluding the boolean params that are empty or false, which the binding treats as false.
+// Invalid boolean values are considered enabled and rejected by the binding.
+func enabledParams(values url.Values, names []string) []string {
+	var enabled []string
+	for _, name := range presentParams(values, names) {
+		if containsString(boolParams, name) {
+			value := values.Get(name)
+			if parsed, err := strconv.ParseBool(value); value == "" || err == nil && !parsed {
+				continue
+			}
+		}
+		enabled = append(enabled, name)
+	}
+	return enabled
+}
@@ -0,0 +1,67 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestParamConflicts(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-10*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(t, err)
+
+	for _, testCase := range []struct {
+		name     string
+		params   string
+		conflict bool
+	}{
+		{name: "list with format", params: "&list=true&format=html", conflict: true},
+		{name: "root_only with format", params: "&root_only=true&format=json", conflict: true},
+		{name: "group_by with format", params: "&group_by=verb&format=html", conflict: true},
+		{name: "list with user", params: "&list=true&user=alice", conflict: true},
+		{name: "root_only with include_events", params: "&root_only=true&include_events=true", conflict: true},
+		{name: "root_only with phase", params: "&root_only=true&phase=Running", conflict: true},
+		{name: "list with also_cluster", params: "&list=true&also_cluster=other", conflict: true},
+		{name: "ts with start", params: "&ts=2023-01-01T11:30:00Z", conflict: true},
+		{name: "false list with root_only", params: "&list=false&root_only=true", conflict: false},
+		{name: "empty list with root_only", params: "&list=&root_only=true", conflict: false},
+		{name: "list with false include_events", params: "&list=true&include_events=false", conflict: false},
+		{name: "list only", params: "&list=true", conflict: false},
+		{name: "format only", params: "&format=json", conflict: false},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web"+
+				"&start=2023-01-01T11:00:00Z&end=2023-01-01T12:00:00Z"+testCase.params, nil)
+			if testCase.conflict {
+				assert.Equal(400, response.Code)
+				assert.Contains(response.Body.String(), "conflicting params")
+			} else {
+				assert.Equal(200, response.Code, response.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// findRecentTraces walks backward from query.Ts (or now) one aggregator bucket at a time,
+// collecting distinct traces until query.Recent traces are found or --trace-server-recent-max-buckets is reached.
+func (server *server) findRecentTraces(
+	ctx context.Context,
+	metric *requestMetric,
+	query traceQuery,
+) (traces []*model.Trace, code int, err error) {
+	if query.Recent < 0 {
+		return nil, metric.fail(classInvalidParam), fmt.Errorf("recent must not be negative")
+	}
+
+	windows, err := server.recentWindows(query.Ts)
+	if err != nil {
+		return nil, metric.fail(classInvalidTimestamp), err
+	}
+
+	cutoff := server.retentionCutoff()
+	if len(windows) > 0 {
+		if code, err := server.checkRetention(metric, windows[0].end); err != nil {
+			return nil, code, err
+		}
+	}
+
+	seen := map[recentTraceKey]struct{}{}
+	for _, window := range windows {
+		if len(traces) >= query.Recent || window.end.Before(cutoff) {
+			break
+		}
+		if window.start.Before(cutoff) {
+			// only search the retained part of the earliest bucket
+			window.start = cutoff.Truncate(time.Second).Add(time.Second)
+		}
+
+		bucketQuery := query
+		bucketQuery.Start = window.start.Format(time.RFC3339)
+		bucketQuery.End = window.end.Format(time.RFC3339)
+
+		bucketTraces, code, err := server.findTraces(ctx, metric, query.DisplayMode, bucketQuery)
+		if err != nil {
+			if code != 404 {
+				return nil, code, err
+			}
+			// no traces in this bucket
+			metric.Error = nil
+		}
+
+		for _, trace := range bucketTraces {
+			if len(trace.Spans) == 0 || len(traces) >= query.Recent {
+				continue
+			}
+
+			key := server.recentTraceKeyOf(trace)
+			if _, duplicate := seen[key]; !duplicate {
+				seen[key] = struct{}{}
+				traces = append(traces, trace)
+			}
+		}
+	}
+
+	if len(traces) == 0 {
+		err := fmt.Errorf("could not find traces within %d buckets", server.options.recentMaxBuckets)
+		code, err := server.noTraceMatch(metric, query, err)
+		return nil, code, err
+	}
+
+	return traces, 200, nil
+}
+
+// recentTraceKey identifies a trace found in multiple buckets.
+// The trace ID cannot be used since the reader assigns a new cache ID to the trace on every query.
+type recentTraceKey struct {
+	object utilobject.Key
+	spanId model.SpanID
+}
+
+// recentTraceKeyOf returns the key of the root span of the trace, or of its first span if it has no root span.
+func (server *server) recentTraceKeyOf(trace *model.Trace) recentTraceKey {
+	root := findRootSpan(trace, server.rootTag)
+	if root == nil {
+		root = trace.Spans[0]
+	}
+	return recentTraceKey{object: zconstants.ObjectKeyFromSpan(root), spanId: root.SpanID}
+}
+
+// timeWindow is an inclusive range of query timestamps.
+type timeWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// recentWindows returns the aggregator bucket windows searched by findRecentTraces,
+// starting from the bucket containing ts (or the current time if empty) and walking backward.
+func (server *server) recentWindows(ts string) ([]timeWindow, error) {
+	anchor := server.Clock.Now()
+	if ts != "" {
+		var err error
+		anchor, err = time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp for ts param %w", err)
+		}
+	}
+
+	bucket := server.options.bucketDuration
+	window := server.bucketWindow(anchor)
+
+	windows := make([]timeWindow, 0, server.options.recentMaxBuckets)
+	for i := 0; i < server.options.recentMaxBuckets; i++ {
+		windows = append(windows, window)
+		window = timeWindow{start: window.start.Add(-bucket), end: window.end.Add(-bucket)}
+	}
+	return windows, nil
+}
+
+// bucketWindow returns the --trace-server-bucket-duration aggregator bucket containing the timestamp.
+func (server *server) bucketWindow(ts time.Time) timeWindow {
+	bucket := server.options.bucketDuration
+	bucketStart := ts.Add(-time.Duration(ts.Unix()%int64(bucket.Seconds())) * time.Second).Truncate(time.Second)
+	return timeWindow{start: bucketStart, end: bucketStart.Add(bucket - time.Second)}
+}
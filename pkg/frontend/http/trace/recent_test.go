@@ -0,0 +1,132 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestRecentWindowsAtBucketBoundary(t *testing.T) {
+	assert := assert.New(t)
+
+	boundary := time.Date(2023, 1, 1, 10, 30, 0, 0, time.UTC)
+	clock := clocktesting.NewFakeClock(boundary)
+	mock, err := trace.NewMockServer(clock, "--trace-server-bucket-duration=30m", "--trace-server-recent-max-buckets=3")
+	assert.NoError(err)
+
+	windows, err := mock.RecentWindows("")
+	assert.NoError(err)
+	assert.Equal([][2]time.Time{
+		{boundary, boundary.Add(30*time.Minute - time.Second)},
+		{boundary.Add(-30 * time.Minute), boundary.Add(-time.Second)},
+		{boundary.Add(-60 * time.Minute), boundary.Add(-30*time.Minute - time.Second)},
+	}, windows)
+
+	clock.Step(-time.Nanosecond)
+	windows, err = mock.RecentWindows("")
+	assert.NoError(err)
+	assert.Equal(boundary.Add(-30*time.Minute), windows[0][0], "the instant before a boundary is in the previous bucket")
+	assert.Equal(boundary.Add(-time.Second), windows[0][1])
+
+	clock.Step(30*time.Minute - time.Second)
+	windows, err = mock.RecentWindows("")
+	assert.NoError(err)
+	assert.Equal(boundary, windows[0][0], "the last second of a bucket is in the same bucket")
+}
+
+func TestRecentWindowsFromTs(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC))
+	mock, err := trace.NewMockServer(clock, "--trace-server-bucket-duration=1h", "--trace-server-recent-max-buckets=2")
+	assert.NoError(err)
+
+	windows, err := mock.RecentWindows("2023-01-01T10:59:59Z")
+	assert.NoError(err)
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal([][2]time.Time{
+		{start, start.Add(time.Hour - time.Second)},
+		{start.Add(-time.Hour), start.Add(-time.Second)},
+	}, windows)
+
+	_, err = mock.RecentWindows("yesterday")
+	assert.Error(err)
+}
+
+func TestRelativeWindowFollowsClock(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := clocktesting.NewFakeClock(now)
+	mock, err := trace.NewMockServer(clock)
+	assert.NoError(err)
+
+	start, end, err := mock.ResolveWindow("-15m", "", "")
+	assert.NoError(err)
+	assert.Equal(now.Add(-15*time.Minute), start)
+	assert.Equal(now, end)
+
+	clock.Step(time.Hour)
+	start, end, err = mock.ResolveWindow("-15m", "", "")
+	assert.NoError(err)
+	assert.Equal(now.Add(45*time.Minute), start)
+	assert.Equal(now.Add(time.Hour), end)
+}
+
+func TestNegativeCacheExpiresWithClock(t *testing.T) {
+	assert := assert.New(t)
+
+	clock := clocktesting.NewFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	mock, err := trace.NewMockServer(clock, "--trace-server-negative-cache-ttl=3s")
+	assert.NoError(err)
+
+	mock.AddNegativeCache("query")
+	assert.True(mock.NegativeCacheContains("query"))
+
+	clock.Step(3*time.Second - time.Nanosecond)
+	assert.True(mock.NegativeCacheContains("query"))
+
+	clock.Step(time.Nanosecond)
+	assert.False(mock.NegativeCacheContains("query"), "entries expire exactly at the ttl")
+}
+
+func TestRecentDeduplicatesObjectAcrossBuckets(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web",
+		auditSpan(1, "create", now.Add(-50*time.Minute)),
+		auditSpan(2, "update", now.Add(-10*time.Minute)),
+	)
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"}, "--trace-server-bucket-duration=30m")
+	assert.NoError(err)
+
+	response := mock.Request("GET", "/extensions/api/v1/trace?cluster=test&resource=pods&namespace=default&name=web&recent=5", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var traces []json.RawMessage
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &traces))
+	assert.Len(traces, 1, "the object is found in both buckets with a different trace ID each time")
+	assert.GreaterOrEqual(reader.findCount(), 2)
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"strconv"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// ResourceVersionTag is the tag of audit spans emitted by the audit consumer with the resourceVersion of the object.
+// Similar to UserTag, the tag must be mapped into a log field of the same name for `?rv_min=` and `?rv_max=`
+// to match the logs of collapsed audit spans.
+const ResourceVersionTag = "resourceVersion"
+
+// filterByResourceVersion keeps the spans and logs with ResourceVersionTag in [rvMin, rvMax] and their ancestors.
+// An empty bound is unbounded.
+//
+// Values are compared numerically if both the value and the bound are integers, i.e. etcd revisions,
+// and lexicographically otherwise since resourceVersion is opaque to clients.
+func filterByResourceVersion(trace *model.Trace, rvMin string, rvMax string) {
+	filterSpansAndLogs(trace, func(kvs []model.KeyValue) bool {
+		kv, ok := model.KeyValues(kvs).FindByKey(ResourceVersionTag)
+		if !ok {
+			return false
+		}
+
+		rv := kv.AsString()
+		if rv == "" {
+			return false
+		}
+		return (rvMin == "" || compareResourceVersions(rv, rvMin) >= 0) &&
+			(rvMax == "" || compareResourceVersions(rv, rvMax) <= 0)
+	})
+}
+
+func compareResourceVersions(left string, right string) int {
+	leftInt, leftErr := strconv.ParseUint(left, 10, 64)
+	rightInt, rightErr := strconv.ParseUint(right, 10, 64)
+	if leftErr == nil && rightErr == nil {
+		switch {
+		case leftInt < rightInt:
+			return -1
+		case leftInt > rightInt:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	switch {
+	case left < right:
+		return -1
+	case left > right:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LabelTagPrefix is the prefix of span tags that record object labels.
+//
+// The aggregator does not record labels by default.
+// To make a label queryable with `?labels=key=value`,
+// configure the resource tagger to emit it as a tag with this prefix, e.g.
+// `--resource-tag-mapping='deployments.apps#label.app:metadata.labels.app'`.
+const LabelTagPrefix = "label."
+
+// AnnotationTagPrefix is the prefix of span tags that record object annotations.
+// It is distinct from LabelTagPrefix so that a label and an annotation with the same key do not collide.
+//
+// Similar to labels, the aggregator only records annotations configured in the resource tagger, e.g.
+// `--resource-tag-mapping='pods#annotation.incident-id:metadata.annotations.incident-id'`.
+const AnnotationTagPrefix = "annotation."
+
+// parseSelector parses a comma-separated list of `key=value` pairs into span tags with the given prefix.
+func parseSelector(selector string, tagPrefix string) (map[string]string, error) {
+	tags := map[string]string{}
+	if selector == "" {
+		return tags, nil
+	}
+
+	for _, term := range strings.Split(selector, ",") {
+		key, value, ok := strings.Cut(term, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid selector term %q, expected key=value", term)
+		}
+
+		tags[tagPrefix+key] = strings.TrimSpace(value)
+	}
+
+	return tags, nil
+}
+
+// parseQueryTags parses the values of the tag param in the form `key:value` into span tags.
+// Only keys in --trace-server-queryable-tags are accepted so that internal tags cannot be probed.
+func parseQueryTags(values []string, queryable map[string]struct{}) (map[string]string, error) {
+	tags := make(map[string]string, len(values))
+	for _, term := range values {
+		key, value, ok := strings.Cut(term, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key:value", term)
+		}
+
+		if _, allowed := queryable[key]; !allowed {
+			return nil, fmt.Errorf("tag %q is not queryable, see --trace-server-queryable-tags", key)
+		}
+
+		if existing, exists := tags[key]; exists && existing != value {
+			return nil, fmt.Errorf("tag %q is specified with different values %q and %q", key, existing, value)
+		}
+		tags[key] = value
+	}
+
+	return tags, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
+)
+
+// selfTestResource is the resource queried by the startup self-test, chosen to match no traces.
+const selfTestResource = "kelemetry-self-test"
+
+// selfTest issues a FindTraces query bounded to the last minute and one trace
+// to fail startup if the storage backend is misconfigured or unreachable.
+// The query matches no objects, so an empty result is expected.
+func (server *server) selfTest(ctx context.Context) error {
+	ctx, cancelFunc := context.WithTimeout(ctx, server.options.selfTestTimeout)
+	defer cancelFunc()
+
+	var cluster string
+	if clusters := server.ClusterList.List(); len(clusters) > 0 {
+		cluster = clusters[0]
+	}
+
+	now := server.Clock.Now()
+	parameters := QueryParameters(server.options.defaultDisplayMode, utilobject.Key{
+		Cluster:  cluster,
+		Resource: selfTestResource,
+		Name:     selfTestResource,
+	}, now.Add(-time.Minute), now)
+	parameters.NumTraces = 1
+
+	start := server.Clock.Now()
+	if _, err := server.SpanReader.FindTraces(ctx, parameters); err != nil && !errors.Is(err, spanstore.ErrTraceNotFound) {
+		return fmt.Errorf("storage self-test failed, check the storage backend flags: %w", err)
+	}
+
+	server.Logger.WithField("latency", server.Clock.Since(start)).Info("storage self-test passed")
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// selfTimeTag is the exclusive duration of a span in microseconds.
+const selfTimeTag = "self_time_micros"
+
+// addSelfTime tags each span with its duration minus the union of the intervals of its ChildOf children,
+// clipped to the span itself.
+func addSelfTime(trace *model.Trace) {
+	children := map[model.SpanID][]*model.Span{}
+	for _, span := range trace.Spans {
+		if parentId := span.ParentSpanID(); parentId != 0 {
+			children[parentId] = append(children[parentId], span)
+		}
+	}
+
+	for _, span := range trace.Spans {
+		covered := coveredDuration(span.StartTime, spanEnd(span), children[span.SpanID])
+		span.Tags = append(span.Tags, model.Int64(selfTimeTag, (span.Duration-covered).Microseconds()))
+	}
+}
+
+// coveredDuration returns the total duration within [start, end) covered by at least one of the spans.
+func coveredDuration(start, end time.Time, spans []*model.Span) time.Duration {
+	type interval struct{ start, end time.Time }
+
+	intervals := make([]interval, 0, len(spans))
+	for _, span := range spans {
+		clipped := interval{start: span.StartTime, end: spanEnd(span)}
+		if clipped.start.Before(start) {
+			clipped.start = start
+		}
+		if clipped.end.After(end) {
+			clipped.end = end
+		}
+		if clipped.start.Before(clipped.end) {
+			intervals = append(intervals, clipped)
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].start.Before(intervals[j].start) })
+
+	var covered time.Duration
+	var current *interval
+	for i := range intervals {
+		next := &intervals[i]
+		if current != nil && !next.start.After(current.end) {
+			if next.end.After(current.end) {
+				current.end = next.end
+			}
+			continue
+		}
+
+		if current != nil {
+			covered += current.end.Sub(current.start)
+		}
+		current = next
+	}
+	if current != nil {
+		covered += current.end.Sub(current.start)
+	}
+	return covered
+}
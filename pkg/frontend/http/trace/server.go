@@ -16,13 +16,22 @@ package trace
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jaegertracing/jaeger/model"
 	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	uimodel "github.com/jaegertracing/jaeger/model/json"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -34,6 +43,7 @@ import (
 	pkghttp "github.com/kubewharf/kelemetry/pkg/http"
 	"github.com/kubewharf/kelemetry/pkg/manager"
 	"github.com/kubewharf/kelemetry/pkg/metrics"
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
 	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
 )
 
@@ -41,12 +51,709 @@ func init() {
 	manager.Global.Provide("trace-server", manager.Ptr(&server{}))
 }
 
+// DefaultDisplayMode is the transform config name used when a request does not specify displayMode.
+// FindTraces interprets the service name as a transform config name,
+// so this must match a config name registered in the transform config provider (e.g. hack/tfconfig.yaml).
+const DefaultDisplayMode = "tracing"
+
 type options struct {
-	enable bool
+	enable                bool
+	defaultDisplayMode    string
+	maxConcurrentRequests int
+	maxQueueWait          time.Duration
+	perIpConcurrency      int
+	strictQuery           bool
+	maxFanout             int
+
+	disableGetTraceFallback bool
+	clusterRefreshCooldown  time.Duration
+	clusterRefreshTimeout   time.Duration
+	emptyClusterListMode    string
+	zeroDurationMode        string
+	timeConsistencyMode     string
+	danglingRefs            string
+	zeroDurationMinWidth    time.Duration
+	emptyClusterListTimeout time.Duration
+
+	spanTypeColors map[string]string
+
+	negativeCacheTtl  time.Duration
+	negativeCacheSize int
+
+	tlsCertFile     string
+	tlsKeyFile      string
+	tlsClientCaFile string
+	tlsMinVersion   string
+	tlsCipherPolicy string
+
+	queryTimeout    time.Duration
+	clusterTimeouts map[string]string
+	logWindows      map[string]string
+	clusterConfigs  map[string]string
+
+	streamInterval    time.Duration
+	streamMaxLifetime time.Duration
+	streamIdleTimeout time.Duration
+	maxStreams        int
+
+	responseEnvelope bool
+	enabledFormats   []string
+	defaultFormat    string
+	selfTest         bool
+	selfTestTimeout  time.Duration
+	clientHeader     string
+	clientFormats    map[string]string
+	histogramBuckets []time.Duration
+	spanTypeField    string
+	spanTypeCase     string
+	snapshotRedact   string
+	resourceAliases  map[string]string
+
+	slowQueryThreshold time.Duration
+	logSampleRate      float64
+
+	listOrder string
+
+	shareTtl        time.Duration
+	shareMaxEntries int
+	deltaTtl        time.Duration
+	deltaMaxEntries int
+
+	maxTagValueBytes int
+	tagAllowlist     []string
+	tagDenylist      []string
+	queryableTags    []string
+	prettyIndent     int
+	eventsService    string
+
+	enableAdmin        bool
+	maintenanceMessage string
+
+	exportDestination   string
+	exportDir           string
+	exportS3Endpoint    string
+	exportS3Bucket      string
+	exportS3Region      string
+	exportS3AccessKeyId string
+	exportS3SecretFile  string
+
+	userGroups map[string]string
+
+	spanNameTemplate string
+	noTraceHelp      string
+	mergeRootName    string
+	mergeRootTags    map[string]string
+	mergeClusterTag  string
+
+	maxNamespaceTraces int
+	maxFindResults     int
+
+	otlpLinkTags  []string
+	otlpKindRules []string
+
+	maxRequestBodyBytes      int64
+	maxResponseBytes         int64
+	maxDecompressedBodyBytes int64
+	coalesceQueries          bool
+	emptyRetryAttempts       int
+	emptyRetryDelay          time.Duration
+	emptyRetryRecency        time.Duration
+	errorStatsMaxTraces      int
+	objectsMaxTraces         int
+	objectsMaxResults        int
+	gzip                     bool
+	gzipLevel                int
+	rootTag                  string
+	componentTags            []string
+	collapseKeys             []string
+
+	bucketDuration   time.Duration
+	maxLookback      time.Duration
+	recentMaxBuckets int
+
+	shutdownDrainTimeout time.Duration
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.BoolVar(&options.enable, "trace-server-enable", false, "enable trace server for frontend")
+	fs.StringVar(
+		&options.defaultDisplayMode,
+		"trace-server-default-display-mode",
+		DefaultDisplayMode,
+		"transform config name used when the request does not specify displayMode",
+	)
+	fs.BoolVar(
+		&options.selfTest,
+		"trace-server-startup-self-test",
+		false,
+		"query the storage backend on startup and fail startup if the query fails",
+	)
+	fs.DurationVar(
+		&options.selfTestTimeout,
+		"trace-server-startup-self-test-timeout",
+		time.Second*10,
+		"timeout of the storage query with --trace-server-startup-self-test",
+	)
+	fs.IntVar(
+		&options.maxConcurrentRequests,
+		"trace-server-max-concurrent-requests",
+		0,
+		"maximum number of trace requests handled concurrently (0 for unlimited)",
+	)
+	fs.DurationVar(
+		&options.maxQueueWait,
+		"trace-server-max-queue-wait",
+		time.Second*10,
+		"maximum duration a request waits for admission before returning 503",
+	)
+	fs.DurationVar(
+		&options.shutdownDrainTimeout,
+		"trace-server-shutdown-drain-timeout",
+		time.Second*10,
+		"maximum duration to wait for in-flight trace requests on shutdown before flushing metrics (0 to flush immediately)",
+	)
+	fs.IntVar(
+		&options.maxFanout,
+		"trace-server-max-fanout",
+		0,
+		"maximum number of backend queries issued by a single request across all fan-out params "+
+			"such as also_name and recent, including GetTrace fallbacks but not retries of empty results; "+
+			"larger requests return 400 FanoutTooLarge (0 for unlimited)",
+	)
+	fs.BoolVar(
+		&options.strictQuery,
+		"trace-server-strict-query",
+		false,
+		"reject requests with unknown query params with 400 instead of ignoring them",
+	)
+	fs.IntVar(
+		&options.perIpConcurrency,
+		"trace-server-per-ip-concurrency",
+		0,
+		"maximum number of trace requests handled concurrently for each client IP, "+
+			"resolved from X-Forwarded-For only for proxies in --http-trusted-proxies; further requests return 429 (0 for unlimited)",
+	)
+	fs.BoolVar(
+		&options.disableGetTraceFallback,
+		"trace-server-disable-gettrace-fallback",
+		false,
+		"do not re-fetch the trace with GetTrace when the FindTraces result has no logs; "+
+			"traces may lack logs depending on the FindTraces behavior of the storage backend",
+	)
+	fs.DurationVar(
+		&options.clusterRefreshCooldown,
+		"trace-server-cluster-refresh-cooldown",
+		time.Second*30,
+		"minimum interval after a successful cluster list refresh before requests for unknown clusters trigger another refresh",
+	)
+	fs.DurationVar(
+		&options.clusterRefreshTimeout,
+		"trace-server-cluster-refresh-timeout",
+		time.Second*30,
+		"timeout for each cluster list refresh, which is shared by all requests waiting for it",
+	)
+	fs.StringVar(
+		&options.emptyClusterListMode,
+		"trace-server-empty-cluster-list",
+		emptyClusterListServe,
+		fmt.Sprintf(
+			"behavior if the cluster list is empty at startup; %q logs an error and serves anyway, "+
+				"%q waits up to --trace-server-empty-cluster-list-timeout for clusters and fails startup otherwise. "+
+				"/readyz fails while the cluster list is empty in either mode",
+			emptyClusterListServe, emptyClusterListFail,
+		),
+	)
+	fs.StringVar(
+		&options.zeroDurationMode,
+		"trace-server-zero-duration-mode",
+		zeroDurationKeep,
+		fmt.Sprintf(
+			"handling of spans with zero duration in responses; %q returns them unchanged, "+
+				"%q widens them to --trace-server-zero-duration-min-width, "+
+				"%q converts leaf spans into logs on their parent spans",
+			zeroDurationKeep, zeroDurationMinWidth, zeroDurationToLog,
+		),
+	)
+	fs.StringVar(
+		&options.timeConsistencyMode,
+		"trace-server-time-consistency-mode",
+		timeConsistencyKeep,
+		fmt.Sprintf(
+			"handling of child spans outside the time range of their parent spans in responses; "+
+				"%q returns them unchanged, %q clamps them into the parent range, %q widens the parent to encompass them",
+			timeConsistencyKeep, timeConsistencyClamp, timeConsistencyExpand,
+		),
+	)
+	fs.StringVar(
+		&options.danglingRefs,
+		"trace-server-dangling-refs",
+		danglingRefsWarn,
+		fmt.Sprintf(
+			"handling of spans whose parent is missing from the trace returned by the storage, e.g. due to truncation; "+
+				"%q ignores them, %q adds a %q trace warning, %q also re-parents them to the root span",
+			danglingRefsKeep, danglingRefsWarn, truncatedByBackendWarning, danglingRefsReparent,
+		),
+	)
+	fs.DurationVar(
+		&options.zeroDurationMinWidth,
+		"trace-server-zero-duration-min-width",
+		time.Millisecond,
+		"duration of zero-duration spans in responses with --trace-server-zero-duration-mode=min-width",
+	)
+	fs.DurationVar(
+		&options.emptyClusterListTimeout,
+		"trace-server-empty-cluster-list-timeout",
+		time.Minute,
+		"duration to wait for a non-empty cluster list with --trace-server-empty-cluster-list=fail",
+	)
+	fs.StringToStringVar(
+		&options.spanTypeColors,
+		"trace-server-span-type-colors",
+		map[string]string{},
+		"map of span type to display color, served at /extensions/api/v1/span-type-colors for custom viewers",
+	)
+	fs.DurationVar(
+		&options.negativeCacheTtl,
+		"trace-server-negative-cache-ttl",
+		time.Second*3,
+		"duration for which a query matching no traces returns 404 without querying the storage (0 to disable)",
+	)
+	fs.IntVar(
+		&options.negativeCacheSize,
+		"trace-server-negative-cache-size",
+		1024,
+		"maximum number of queries remembered in the negative cache",
+	)
+	fs.StringVar(
+		&options.tlsCertFile,
+		"trace-server-tls-cert-file",
+		"",
+		"TLS certificate file; if set with --trace-server-tls-key-file, the shared HTTP server serves HTTPS. "+
+			"The files are reloaded when they change. Do not combine with --http-tls-cert",
+	)
+	fs.StringVar(&options.tlsKeyFile, "trace-server-tls-key-file", "", "TLS key file, see --trace-server-tls-cert-file")
+	fs.StringVar(
+		&options.tlsClientCaFile,
+		"trace-server-tls-client-ca",
+		"",
+		"CA bundle for verifying client certificates; if set, clients must present a certificate signed by it",
+	)
+	fs.StringVar(&options.tlsMinVersion, "trace-server-tls-min-version", tlsVersion12, "minimum TLS version, one of \"1.2\", \"1.3\"")
+	fs.StringVar(
+		&options.tlsCipherPolicy,
+		"trace-server-tls-cipher-policy",
+		tlsPolicyIntermediate,
+		fmt.Sprintf(
+			"cipher suite policy; %q allows TLS 1.3 only and requires --trace-server-tls-min-version=1.3, "+
+				"%q allows ECDHE AEAD cipher suites for TLS 1.2",
+			tlsPolicyModern, tlsPolicyIntermediate,
+		),
+	)
+	fs.DurationVar(&options.queryTimeout, "trace-server-query-timeout", 0, "timeout for each storage query (0 for no timeout)")
+	fs.StringToStringVar(
+		&options.clusterTimeouts,
+		"trace-server-cluster-timeouts",
+		map[string]string{},
+		"map of cluster name to storage query timeout, overriding --trace-server-query-timeout for the cluster",
+	)
+	fs.StringToStringVar(
+		&options.logWindows,
+		"trace-server-span-type-log-window",
+		map[string]string{},
+		"map of span type to duration; logs of the span type earlier than the trace end minus the duration are dropped",
+	)
+	fs.StringToStringVar(
+		&options.clusterConfigs,
+		"trace-server-cluster-configs",
+		map[string]string{},
+		"map of cluster name to the transform config name used when the request does not specify displayMode, "+
+			"overriding --trace-server-default-display-mode for the cluster",
+	)
+	fs.DurationVar(&options.streamInterval, "trace-server-stream-interval", time.Second*10, "interval between re-queries in trace streams")
+	fs.DurationVar(
+		&options.streamMaxLifetime,
+		"trace-server-stream-max-lifetime",
+		time.Minute*30,
+		"maximum duration of a trace stream connection",
+	)
+	fs.DurationVar(
+		&options.streamIdleTimeout,
+		"trace-server-stream-idle-timeout",
+		time.Minute*5,
+		"close a trace stream if no new spans or logs were found for this duration (0 to disable)",
+	)
+	fs.IntVar(&options.maxStreams, "trace-server-max-streams", 100, "maximum number of concurrent trace streams (0 for unlimited)")
+	fs.BoolVar(
+		&options.responseEnvelope,
+		"trace-server-response-envelope",
+		false,
+		"wrap trace and error responses as {data: ..., meta: ...}, with trace_id, span_count, warnings and error under meta",
+	)
+	fs.StringVar(
+		&options.spanTypeField,
+		"trace-server-span-type-field",
+		"",
+		"name of the log field or span tag whose value is matched against the span_type param "+
+			"(empty to match logs with a field keyed by the span_type value)",
+	)
+	fs.StringVar(
+		&options.spanTypeCase,
+		"trace-server-span-type-case",
+		spanTypeCaseInsensitive,
+		fmt.Sprintf(
+			"how span_type values are matched against the span types from transform configs, "+
+				"--trace-server-span-type-colors and --trace-server-span-type-log-window; "+
+				"%q matches them verbatim, %q maps them case-insensitively to the known span type",
+			spanTypeCaseExact, spanTypeCaseInsensitive,
+		),
+	)
+	fs.StringVar(
+		&options.snapshotRedact,
+		"trace-server-snapshot-redact-pattern",
+		"$this matches nothing^",
+		"objects matching this regexp pattern in the form g/v/r/ns/name are redacted from include_snapshots, "+
+			"in addition to the objects redacted by the diff controller",
+	)
+	fs.StringToStringVar(
+		&options.resourceAliases,
+		"trace-server-resource-aliases",
+		map[string]string{},
+		"map of resource alias to the plural resource name, in addition to the built-in kubectl short names (e.g. deploy=deployments)",
+	)
+	fs.StringSliceVar(
+		&options.enabledFormats,
+		"trace-server-enabled-formats",
+		[]string{},
+		fmt.Sprintf("formats accepted in the format param, any of %q (empty to enable all)", registeredFormats()),
+	)
+	fs.StringVar(
+		&options.defaultFormat,
+		"trace-server-default-format",
+		formatJson,
+		"format of single trace responses without the format param, list and summary responses are always JSON",
+	)
+	fs.StringVar(
+		&options.clientHeader,
+		"trace-server-client-header",
+		"X-Kelemetry-Client",
+		"request header identifying the client for --trace-server-client-formats",
+	)
+	fs.StringToStringVar(
+		&options.clientFormats,
+		"trace-server-client-formats",
+		map[string]string{},
+		"map of --trace-server-client-header value to the format of responses without the format param, "+
+			"e.g. grafana=otlp; other clients use --trace-server-default-format",
+	)
+	fs.DurationSliceVar(
+		&options.histogramBuckets,
+		"trace-server-duration-histogram-buckets",
+		defaultHistogramBuckets,
+		"increasing upper bounds of the buckets for format=duration_histogram; longer spans are counted in a +Inf bucket",
+	)
+	fs.DurationVar(
+		&options.slowQueryThreshold,
+		"trace-server-slow-query-threshold",
+		time.Second*10,
+		"log trace requests taking longer than this duration at WARN level (0 to disable)",
+	)
+	fs.Float64Var(
+		&options.logSampleRate,
+		"trace-server-log-sample-rate",
+		1,
+		fmt.Sprintf(
+			"fraction of requests logged at INFO level, sampled by the %s header or the query; errors are always logged",
+			requestIdHeader,
+		),
+	)
+	fs.StringVar(
+		&options.listOrder,
+		"trace-server-list-order",
+		listOrderStartDesc,
+		fmt.Sprintf(
+			"order of traces returned with list=true, one of %q, %q, %q",
+			listOrderStartAsc, listOrderStartDesc, listOrderSpanCountDesc,
+		),
+	)
+	fs.DurationVar(&options.shareTtl, "trace-server-share-ttl", time.Hour*24*7, "duration for which a shared trace token remains valid")
+	fs.IntVar(
+		&options.shareMaxEntries,
+		"trace-server-share-max-entries",
+		10000,
+		"maximum number of shared trace tokens kept in memory; the tokens expiring first are evicted",
+	)
+	fs.DurationVar(
+		&options.deltaTtl,
+		"trace-server-delta-ttl",
+		time.Minute*10,
+		"duration for which a delta token of the since param remains valid",
+	)
+	fs.IntVar(
+		&options.deltaMaxEntries,
+		"trace-server-delta-max-entries",
+		1000,
+		"maximum number of delta tokens kept in memory; the tokens expiring first are evicted",
+	)
+	fs.StringToStringVar(
+		&options.userGroups,
+		"trace-server-user-groups",
+		map[string]string{},
+		"map of group name to semicolon-separated users, allowing the user param to select all users in a group (e.g. sre=alice;bob)",
+	)
+	fs.DurationVar(
+		&options.bucketDuration,
+		"trace-server-bucket-duration",
+		time.Minute*30,
+		"duration of each object span bucket, must be consistent with --aggregator-span-ttl",
+	)
+	fs.DurationVar(
+		&options.maxLookback,
+		"trace-server-max-lookback",
+		0,
+		"reject queries starting earlier than this duration before now, e.g. 720h for a 30-day retention (0 for unlimited)",
+	)
+	fs.IntVar(
+		&options.recentMaxBuckets,
+		"trace-server-recent-max-buckets",
+		48,
+		"maximum number of buckets queried backwards with the recent param",
+	)
+	fs.StringSliceVar(
+		&options.componentTags,
+		"trace-server-component-tags",
+		defaultComponentTags,
+		"span tags and log fields identifying the acting component for the component param; "+
+			"values are truncated before the first slash to match user agents",
+	)
+	fs.StringSliceVar(
+		&options.collapseKeys,
+		"trace-server-collapse-keys",
+		defaultCollapseKeys,
+		fmt.Sprintf(
+			"span tags identifying repeated spans merged with collapse_repeats=true; %q selects the operation name",
+			CollapseKeyOperationName,
+		),
+	)
+	fs.StringVar(
+		&options.rootTag,
+		"trace-server-root-tag",
+		"",
+		"span tag in the form key=value marking root spans, e.g. kelemetry.root=true; "+
+			"spans without ChildOf references are treated as roots if no span has the tag",
+	)
+	fs.IntVar(
+		&options.errorStatsMaxTraces,
+		"trace-server-error-stats-max-traces",
+		100,
+		"maximum number of traces scanned by /extensions/api/v1/error-stats",
+	)
+	fs.IntVar(
+		&options.objectsMaxTraces,
+		"trace-server-objects-max-traces",
+		100,
+		"maximum number of traces scanned by /extensions/api/v1/objects",
+	)
+	fs.IntVar(
+		&options.objectsMaxResults,
+		"trace-server-objects-max-results",
+		50,
+		"maximum number of objects returned by /extensions/api/v1/objects; the limit param can only lower it",
+	)
+	fs.BoolVar(&options.gzip, "trace-server-gzip", false, "compress responses with gzip for clients sending Accept-Encoding: gzip")
+	fs.IntVar(
+		&options.gzipLevel,
+		"trace-server-gzip-level",
+		-1,
+		"gzip compression level of responses from 1 (fastest) to 9 (smallest), or -1 for the default level",
+	)
+	fs.IntVar(
+		&options.emptyRetryAttempts,
+		"trace-server-empty-retry-attempts",
+		0,
+		"number of retries when a window ending near now matches no traces, see --trace-server-empty-retry-recency",
+	)
+	fs.DurationVar(
+		&options.emptyRetryDelay,
+		"trace-server-empty-retry-delay",
+		time.Millisecond*500,
+		"delay before each retry of an empty result",
+	)
+	fs.DurationVar(
+		&options.emptyRetryRecency,
+		"trace-server-empty-retry-recency",
+		time.Minute,
+		"only retry empty results of windows ending within this duration before now, so that historical queries are never delayed",
+	)
+	fs.BoolVar(
+		&options.coalesceQueries,
+		"trace-server-coalesce-queries",
+		false,
+		"share one storage query among concurrent requests with identical resolved query parameters; "+
+			"relative windows are truncated to whole seconds so that concurrent requests resolve to the same window",
+	)
+	fs.Int64Var(
+		&options.maxRequestBodyBytes,
+		"trace-server-max-request-body-bytes",
+		1<<20,
+		"maximum body size of POST requests; larger requests return 413 (0 for unlimited)",
+	)
+	fs.Int64Var(
+		&options.maxResponseBytes,
+		"trace-server-max-response-bytes",
+		0,
+		"maximum body size of trace responses; larger responses return 413 suggesting filters or field projection (0 for unlimited)",
+	)
+	fs.Int64Var(
+		&options.maxDecompressedBodyBytes,
+		"trace-server-max-decompressed-body-bytes",
+		8<<20,
+		"maximum decompressed body size of POST requests with Content-Encoding: gzip; larger requests return 413 (0 for unlimited)",
+	)
+	fs.StringSliceVar(
+		&options.otlpLinkTags,
+		"trace-server-otlp-link-tags",
+		[]string{"linked_trace_id:linked_span_id"},
+		"pairs of span tags in the form traceIdTag:spanIdTag that are converted into span links with format=otlp",
+	)
+	fs.StringSliceVar(
+		&options.otlpKindRules,
+		"trace-server-otlp-span-kind-rules",
+		defaultOtlpKindRules,
+		"rules in the form tag=value:kind inferring the span kind with format=otlp, where kind is one of "+
+			"internal, server, client, producer and consumer; the first matching rule applies, spans matching no rules are internal",
+	)
+	fs.IntVar(
+		&options.maxNamespaceTraces,
+		"trace-server-max-namespace-traces",
+		50,
+		"maximum number of traces returned with all_in_namespace=true; more matches return 400",
+	)
+	fs.IntVar(
+		&options.maxFindResults,
+		"trace-server-max-find-results",
+		20,
+		"maximum number of traces requested from the storage in each query; "+
+			"responses reaching the limit set the "+resultsLimitedHeader+" header (0 for the storage default)",
+	)
+	fs.StringVar(
+		&options.spanNameTemplate,
+		"trace-server-span-name-template",
+		"",
+		"Go template over span tags rewriting span names in responses, e.g. '{{.verb}} {{.resource}}/{{.name}}'; "+
+			"the original name is available as {{.operationName}} (empty to keep names unchanged)",
+	)
+	fs.StringVar(
+		&options.noTraceHelp,
+		"trace-server-no-trace-help",
+		"",
+		"Go template of a help message appended to NoTraceMatch responses, e.g. a link to onboarding docs; "+
+			"{{.Cluster}}, {{.Resource}}, {{.Namespace}} and {{.Name}} are the queried object",
+	)
+	fs.StringVar(
+		&options.mergeRootName,
+		"trace-server-merge-root-name-template",
+		defaultMergeRootTemplate,
+		"Go template rendering the name of the synthetic root span of merged traces; "+
+			"available fields are .Cluster, .Clusters, .Resource, .Namespace, .Names, .Reason and .Traces",
+	)
+	fs.StringToStringVar(
+		&options.mergeRootTags,
+		"trace-server-merge-root-tag-templates",
+		map[string]string{},
+		"map of tag key to Go template rendering the tags of the synthetic root span of merged traces, "+
+			"with the same fields as --trace-server-merge-root-name-template",
+	)
+	fs.StringVar(
+		&options.mergeClusterTag,
+		"trace-server-merge-cluster-tag",
+		defaultMergeClusterTag,
+		"tag key added to each span with its cluster when also_cluster merges traces from multiple clusters, "+
+			"unless the span already has the tag (empty to disable)",
+	)
+	fs.BoolVar(
+		&options.enableAdmin,
+		"trace-server-enable-admin",
+		false,
+		"serve admin endpoints under /extensions/api/v1/admin; only enable if the HTTP port is not exposed to untrusted clients",
+	)
+	fs.StringVar(
+		&options.maintenanceMessage,
+		"trace-server-maintenance-message",
+		"trace queries are unavailable during storage maintenance, please retry later",
+		"default message of 503 responses while maintenance mode is enabled through /extensions/api/v1/admin/maintenance",
+	)
+	fs.StringVar(
+		&options.exportDestination,
+		"trace-server-export-destination",
+		"",
+		fmt.Sprintf(
+			"destination of traces exported through /extensions/api/v1/admin/export; "+
+				"%q for a local directory, %q for an S3-compatible bucket, empty to disable exports",
+			exportDestinationDir, exportDestinationS3,
+		),
+	)
+	fs.StringVar(&options.exportDir, "trace-server-export-dir", "", "local directory to write exported traces to")
+	fs.StringVar(
+		&options.exportS3Endpoint,
+		"trace-server-export-s3-endpoint",
+		"https://s3.amazonaws.com",
+		"endpoint of the S3-compatible service for exported traces, addressed with path-style requests",
+	)
+	fs.StringVar(&options.exportS3Bucket, "trace-server-export-s3-bucket", "", "bucket to upload exported traces to")
+	fs.StringVar(
+		&options.exportS3Region,
+		"trace-server-export-s3-region",
+		"us-east-1",
+		"region of the export bucket used for request signing",
+	)
+	fs.StringVar(
+		&options.exportS3AccessKeyId,
+		"trace-server-export-s3-access-key-id",
+		"",
+		"access key ID for the export bucket (defaults to the AWS_ACCESS_KEY_ID environment variable)",
+	)
+	fs.StringVar(
+		&options.exportS3SecretFile,
+		"trace-server-export-s3-secret-access-key-file",
+		"",
+		"file containing the secret access key for the export bucket (defaults to the AWS_SECRET_ACCESS_KEY environment variable)",
+	)
+	fs.StringSliceVar(
+		&options.tagAllowlist,
+		"trace-server-tag-allowlist",
+		[]string{},
+		"span tag keys returned in responses, dropping all other tags (empty to return all tags)",
+	)
+	fs.StringSliceVar(
+		&options.tagDenylist,
+		"trace-server-tag-denylist",
+		[]string{},
+		"span tag keys dropped from responses; ignored if --trace-server-tag-allowlist is set",
+	)
+	fs.StringSliceVar(
+		&options.queryableTags,
+		"trace-server-queryable-tags",
+		[]string{},
+		"span tag keys that can be queried with the tag param in the form key:value (empty to disable the tag param)",
+	)
+	fs.IntVar(
+		&options.maxTagValueBytes,
+		"trace-server-max-tag-value-bytes",
+		0,
+		"truncate string tag and log field values longer than this number of bytes unless raw=true is requested (0 to disable)",
+	)
+	fs.StringVar(
+		&options.eventsService,
+		"trace-server-events-service",
+		"",
+		"service name under which the aggregator writes event spans, merged into traces with include_events=true",
+	)
+	fs.IntVar(
+		&options.prettyIndent,
+		"trace-server-pretty-indent",
+		2,
+		"number of spaces to indent JSON responses with when pretty=true is requested",
+	)
 }
 
 func (options *options) EnableFlag() *bool { return &options.enable }
@@ -59,8 +766,52 @@ type server struct {
 	SpanReader       jaegerreader.Interface
 	ClusterList      clusterlist.Lister
 	TransformConfigs tfconfig.Provider
+	Metrics          metrics.Client
+
+	RequestMetric          *metrics.Metric[*requestMetric]
+	AdmissionRejectMetric  *metrics.Metric[*admissionRejectMetric]
+	AdmissionWaitMetric    *metrics.Metric[*admissionWaitMetric]
+	TraceSourceMetric      *metrics.Metric[*traceSourceMetric]
+	ClusterRefreshMetric   *metrics.Metric[*clusterRefreshMetric]
+	NegativeCacheMetric    *metrics.Metric[*negativeCacheHitMetric]
+	QueryTimeoutMetric     *metrics.Metric[*queryTimeoutMetric]
+	ParamUsageMetric       *metrics.Metric[*paramUsageMetric]
+	TruncateMetric         *metrics.Metric[*truncateMetric]
+	OversizedRequestMetric *metrics.Metric[*oversizedRequestMetric]
+	CoalescedQueryMetric   *metrics.Metric[*coalescedQueryMetric]
+	EmptyRetryMetric       *metrics.Metric[*emptyRetryMetric]
+	DanglingRefMetric      *metrics.Metric[*danglingRefMetric]
 
-	RequestMetric *metrics.Metric[*requestMetric]
+	admission        *admission
+	clientAdmission  *clientAdmission
+	snapshotRedact   *regexp.Regexp
+	negativeCache    *negativeCache
+	certReloader     *certReloader
+	inflight         inflightTracker
+	flushOnce        sync.Once
+	flushMetrics     func(ctx context.Context) error
+	clusterTimeouts  map[string]time.Duration
+	logWindows       map[string]time.Duration
+	spanTypes        spanTypeIndex
+	clusterConfigs   map[string]string
+	resourceAliases  map[string]string
+	userGroups       map[string]map[string]struct{}
+	tagAllowlist     map[string]struct{}
+	tagDenylist      map[string]struct{}
+	queryableTags    map[string]struct{}
+	spanNameTemplate *template.Template
+	noTraceHelp      *template.Template
+	mergeRoot        mergeRootTemplates
+	otlpLinkTags     []otlpLinkTags
+	otlpKindRules    []otlpKindRule
+	rootTag          rootTag
+	activeStreams    atomic.Int64
+	shareStore       shareStore
+	deltaStore       *deltaStore
+	exportStore      exportStore
+	coalescer        *coalescer
+	clusterRefresher clusterRefresher
+	maintenance      maintenanceState
 }
 
 type requestMetric struct {
@@ -69,82 +820,839 @@ type requestMetric struct {
 
 func (*requestMetric) MetricName() string { return "extension_trace_request" }
 
+// traceSourceMetric counts which code path served the trace, either traceSourceFind or traceSourceGet.
+type traceSourceMetric struct {
+	Source string
+}
+
+func (*traceSourceMetric) MetricName() string { return "extension_trace_source" }
+
+const (
+	sourceHeader        = "X-Kelemetry-Source"
+	searchMatchesHeader = "X-Kelemetry-Search-Matches"
+	// Set to "true" if a storage query may have more matching traces than --trace-server-max-find-results.
+	resultsLimitedHeader = "X-Kelemetry-Results-Limited"
+
+	// The trace was served from the FindTraces result directly.
+	traceSourceFind = "find"
+	// The trace was re-fetched with GetTrace because the FindTraces result had no logs.
+	traceSourceGet = "get"
+)
+
+type queryTimeoutMetric struct {
+	Cluster string
+}
+
+func (*queryTimeoutMetric) MetricName() string { return "extension_trace_query_timeout" }
+
+type admissionRejectMetric struct{}
+
+func (*admissionRejectMetric) MetricName() string { return "extension_trace_admission_reject" }
+
+// admissionWaitMetric is the time a request waited for an admission slot before handling began,
+// which excludes the handling time measured by the request metric.
+type admissionWaitMetric struct {
+	// Result is "admitted" or "rejected".
+	Result string
+}
+
+func (*admissionWaitMetric) MetricName() string { return "extension_trace_admission_wait" }
+
+// admissionQueueMetric is the number of requests currently waiting for an admission slot.
+type admissionQueueMetric struct{}
+
+func (*admissionQueueMetric) MetricName() string { return "extension_trace_admission_queue" }
+
 func (server *server) Options() manager.Options {
 	return &server.options
 }
 
 func (server *server) Init() error {
-	server.Server.Routes().GET("/extensions/api/v1/trace", func(ctx *gin.Context) {
+	if server.TransformConfigs == nil {
+		server.Logger.Warn("transform config provider is unavailable, requests selecting a display mode will return 501")
+	}
+
+	if server.options.bucketDuration < time.Second {
+		return fmt.Errorf("--trace-server-bucket-duration must be at least 1s")
+	}
+
+	switch server.options.listOrder {
+	case listOrderStartAsc, listOrderStartDesc, listOrderSpanCountDesc:
+	default:
+		return fmt.Errorf("invalid --trace-server-list-order %q", server.options.listOrder)
+	}
+
+	switch server.options.emptyClusterListMode {
+	case emptyClusterListServe, emptyClusterListFail:
+	default:
+		return fmt.Errorf("invalid --trace-server-empty-cluster-list %q", server.options.emptyClusterListMode)
+	}
+
+	switch server.options.danglingRefs {
+	case danglingRefsKeep, danglingRefsWarn, danglingRefsReparent:
+	default:
+		return fmt.Errorf("invalid --trace-server-dangling-refs %q", server.options.danglingRefs)
+	}
+
+	switch server.options.spanTypeCase {
+	case spanTypeCaseExact, spanTypeCaseInsensitive:
+	default:
+		return fmt.Errorf("invalid --trace-server-span-type-case %q", server.options.spanTypeCase)
+	}
+
+	switch server.options.timeConsistencyMode {
+	case timeConsistencyKeep, timeConsistencyClamp, timeConsistencyExpand:
+	default:
+		return fmt.Errorf("invalid --trace-server-time-consistency-mode %q", server.options.timeConsistencyMode)
+	}
+
+	switch server.options.zeroDurationMode {
+	case zeroDurationKeep, zeroDurationToLog:
+	case zeroDurationMinWidth:
+		if server.options.zeroDurationMinWidth <= 0 {
+			return fmt.Errorf("--trace-server-zero-duration-min-width must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid --trace-server-zero-duration-mode %q", server.options.zeroDurationMode)
+	}
+
+	if err := server.validateEnabledFormats(); err != nil {
+		return err
+	}
+
+	if err := server.validateDefaultFormats(); err != nil {
+		return err
+	}
+
+	if server.options.clusterRefreshTimeout <= 0 {
+		return fmt.Errorf("--trace-server-cluster-refresh-timeout must be positive")
+	}
+
+	if server.options.selfTest && server.options.selfTestTimeout <= 0 {
+		return fmt.Errorf("--trace-server-startup-self-test-timeout must be positive")
+	}
+
+	if err := validateGzipLevel(server.options.gzipLevel); err != nil {
+		return err
+	}
+
+	if err := validateHistogramBuckets(server.options.histogramBuckets); err != nil {
+		return err
+	}
+
+	server.resourceAliases = buildResourceAliases(server.options.resourceAliases)
+	server.userGroups = parseUserGroups(server.options.userGroups)
+	server.tagAllowlist = stringSet(server.options.tagAllowlist)
+	server.tagDenylist = stringSet(server.options.tagDenylist)
+	server.queryableTags = stringSet(server.options.queryableTags)
+
+	spanNameTemplate, err := parseSpanNameTemplate(server.options.spanNameTemplate)
+	if err != nil {
+		return err
+	}
+	server.spanNameTemplate = spanNameTemplate
+
+	server.noTraceHelp, err = parseNoTraceHelpTemplate(server.options.noTraceHelp)
+	if err != nil {
+		return err
+	}
+
+	server.mergeRoot, err = parseMergeRootTemplates(server.options.mergeRootName, server.options.mergeRootTags)
+	if err != nil {
+		return err
+	}
+
+	server.otlpLinkTags, err = parseOtlpLinkTags(server.options.otlpLinkTags)
+	if err != nil {
+		return err
+	}
+
+	server.otlpKindRules, err = parseOtlpKindRules(server.options.otlpKindRules)
+	if err != nil {
+		return err
+	}
+
+	server.rootTag, err = parseRootTag(server.options.rootTag)
+	if err != nil {
+		return err
+	}
+
+	server.clusterTimeouts = make(map[string]time.Duration, len(server.options.clusterTimeouts))
+	for cluster, value := range server.options.clusterTimeouts {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid timeout %q for cluster %q: %w", value, cluster, err)
+		}
+		server.clusterTimeouts[strings.ToLower(cluster)] = timeout
+	}
+
+	server.logWindows = make(map[string]time.Duration, len(server.options.logWindows))
+	for spanType, value := range server.options.logWindows {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			return fmt.Errorf("invalid log window %q for span type %q, expected a positive duration", value, spanType)
+		}
+		server.logWindows[spanType] = window
+	}
+
+	server.spanTypes = server.buildSpanTypeIndex()
+
+	server.clusterConfigs = make(map[string]string, len(server.options.clusterConfigs))
+	for cluster, configName := range server.options.clusterConfigs {
+		if server.TransformConfigs != nil && server.TransformConfigs.GetByName(configName) == nil {
+			return fmt.Errorf("unknown transform config %q for cluster %q", configName, cluster)
+		}
+		server.clusterConfigs[strings.ToLower(cluster)] = configName
+	}
+
+	server.flushMetrics = func(ctx context.Context) error { return metrics.Flush(ctx, server.Metrics) }
+
+	server.admission = newAdmission(server.Clock, server.options.maxConcurrentRequests, server.options.maxQueueWait)
+	server.clientAdmission = newClientAdmission(server.options.perIpConcurrency)
+
+	server.snapshotRedact, err = regexp.Compile(server.options.snapshotRedact)
+	if err != nil {
+		return fmt.Errorf("cannot compile --trace-server-snapshot-redact-pattern value: %w", err)
+	}
+	if err := server.setupTls(); err != nil {
+		return err
+	}
+
+	if server.options.shareTtl <= 0 {
+		return fmt.Errorf("--trace-server-share-ttl must be positive")
+	}
+	if server.options.shareMaxEntries <= 0 {
+		return fmt.Errorf("--trace-server-share-max-entries must be positive")
+	}
+	server.shareStore = newMemoryShareStore(server.Clock, server.options.shareTtl, server.options.shareMaxEntries)
+
+	if server.options.deltaTtl <= 0 {
+		return fmt.Errorf("--trace-server-delta-ttl must be positive")
+	}
+	if server.options.deltaMaxEntries <= 0 {
+		return fmt.Errorf("--trace-server-delta-max-entries must be positive")
+	}
+	server.deltaStore = newDeltaStore(server.Clock, server.options.deltaTtl, server.options.deltaMaxEntries)
+
+	if server.options.enableAdmin {
+		exportStore, err := server.newExportStore()
+		if err != nil {
+			return err
+		}
+		server.exportStore = exportStore
+	}
+
+	if server.options.coalesceQueries {
+		server.coalescer = newCoalescer()
+	}
+
+	server.negativeCache = newNegativeCache(server.Clock, server.options.negativeCacheTtl, server.options.negativeCacheSize)
+	metrics.NewMonitor(server.Metrics, &admissionQueueMetric{}, func() float64 { return float64(server.admission.queueDepth()) })
+	metrics.NewMonitor(server.Metrics, &activeStreamMetric{}, func() float64 { return float64(server.activeStreams.Load()) })
+
+	server.Server.Routes().GET("/extensions/api/v1/trace", server.serveTrace)
+	server.Server.Routes().HEAD("/extensions/api/v1/trace", func(ctx *gin.Context) { server.serveAdmitted(ctx, server.handleTraceHead) })
+	server.Server.Routes().GET("/extensions/api/v1/trace/by-token/:token", func(ctx *gin.Context) {
+		server.serveAdmitted(ctx, server.handleTraceByToken)
+	})
+	server.Server.Routes().GET("/extensions/api/v1/error-stats", func(ctx *gin.Context) {
+		server.serveAdmitted(ctx, server.handleErrorStats)
+	})
+	server.Server.Routes().GET("/extensions/api/v1/objects", func(ctx *gin.Context) { server.serveAdmitted(ctx, server.handleObjects) })
+	server.Server.Routes().GET("/extensions/api/v1/trace/diff", func(ctx *gin.Context) { server.serveAdmitted(ctx, server.handleDiff) })
+	server.Server.Routes().GET("/extensions/api/v1/trace/span-path", func(ctx *gin.Context) {
+		server.serveAdmitted(ctx, server.handleSpanPath)
+	})
+	server.Server.Routes().POST("/extensions/api/v1/share", func(ctx *gin.Context) { server.serveAdmitted(ctx, server.handleShare) })
+
+	server.Server.Routes().GET("/extensions/api/v1/trace/stream", func(ctx *gin.Context) {
 		logger := server.Logger.WithField("source", ctx.Request.RemoteAddr)
 		defer shutdown.RecoverPanic(logger)
+		endRequest, accepted := server.inflight.begin()
+		if !accepted {
+			server.writeError(ctx, classShuttingDown.Status(), errShuttingDown)
+			return
+		}
+		defer endRequest()
 		metric := &requestMetric{}
 		defer server.RequestMetric.DeferCount(server.Clock.Now(), metric)
 
-		logger.WithField("query", ctx.Request.URL.RawQuery).Infof("GET /extensions/api/v1/trace %v", ctx.Request.URL.Query())
+		logger = logger.WithField("query", ctx.Request.URL.RawQuery)
+		if server.shouldLogRequest(ctx.Request) {
+			logger.Infof("GET /extensions/api/v1/trace/stream %v", ctx.Request.URL.Query())
+		}
 
-		if code, err := server.handleTrace(ctx, metric); err != nil {
+		if code, err := server.checkMaintenance(metric); err != nil {
+			server.writeError(ctx, code, err)
+			return
+		}
+
+		if code, err := server.handleStream(ctx, metric); err != nil {
 			logger.WithError(err).Error()
-			ctx.Status(code)
-			_, _ = ctx.Writer.WriteString(err.Error())
-			ctx.Abort()
+			server.writeError(ctx, code, err)
 		}
 	})
 
+	server.Server.Routes().GET("/extensions/api/v1/span-type-colors", func(ctx *gin.Context) {
+		server.writeJSON(ctx, 200, server.options.spanTypeColors)
+	})
+	if server.options.enableAdmin {
+		// admin requests are not subject to maintenance mode and admission control so that operators can recover the server
+		server.Server.Routes().POST("/extensions/api/v1/admin/reload-clusters", func(ctx *gin.Context) {
+			server.serveTracked(ctx, server.handleReloadClusters)
+		})
+		server.Server.Routes().POST("/extensions/api/v1/admin/maintenance", func(ctx *gin.Context) {
+			server.serveTracked(ctx, server.handleMaintenance)
+		})
+		server.Server.Routes().POST("/extensions/api/v1/admin/export", func(ctx *gin.Context) {
+			server.serveAdmitted(ctx, server.handleExport)
+		})
+	}
+	server.Server.Routes().GET("/readyz", server.handleReadyz)
+	server.Server.Routes().GET("/extensions/api/v1/openapi.json", func(ctx *gin.Context) {
+		server.writeJSON(ctx, 200, server.openapiSpec())
+	})
+
 	return nil
 }
 
-func (server *server) Start(ctx context.Context) error { return nil }
+func (server *server) serveTrace(ctx *gin.Context) { server.serveAdmitted(ctx, server.handleTrace) }
+
+// requestHandler handles a request, returning the HTTP status and the error if the request failed.
+type requestHandler func(ctx *gin.Context, metric *requestMetric) (code int, err error)
+
+// serveAdmitted wraps a handler with maintenance mode, admission control, logging and metrics.
+func (server *server) serveAdmitted(ctx *gin.Context, handler requestHandler) {
+	server.serveTracked(ctx, func(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+		if code, err := server.checkMaintenance(metric); err != nil {
+			return code, err
+		}
+
+		// checked before the global admission so that a client over its own limit does not wait for a global slot
+		releaseClient, admitted := server.clientAdmission.acquire(ctx.ClientIP())
+		if !admitted {
+			server.AdmissionRejectMetric.With(&admissionRejectMetric{}).Count(1)
+			return metric.fail(classClientOverloaded), fmt.Errorf("too many concurrent requests from %s", ctx.ClientIP())
+		}
+		defer releaseClient()
+
+		waitStart := server.Clock.Now()
+		release, admitted := server.admission.acquire(ctx.Request.Context())
+		server.observeAdmissionWait(waitStart, admitted)
+		if !admitted {
+			server.AdmissionRejectMetric.With(&admissionRejectMetric{}).Count(1)
+			return metric.fail(classOverloaded), fmt.Errorf("too many concurrent requests")
+		}
+		defer release()
+
+		return handler(ctx, metric)
+	})
+}
+
+// serveTracked wraps a handler with logging and metrics, draining it on shutdown.
+func (server *server) serveTracked(ctx *gin.Context, handler requestHandler) {
+	logger := server.Logger.WithField("source", ctx.Request.RemoteAddr)
+	defer shutdown.RecoverPanic(logger)
+	endRequest, accepted := server.inflight.begin()
+	if !accepted {
+		server.writeError(ctx, classShuttingDown.Status(), errShuttingDown)
+		return
+	}
+	// ends after the request metric is recorded so that shutdown flushes it
+	defer endRequest()
+	metric := &requestMetric{}
+	start := server.Clock.Now()
+	defer server.RequestMetric.DeferCount(start, metric)
+
+	stats := &requestStats{}
+	ctx.Request = ctx.Request.WithContext(withRequestStats(ctx.Request.Context(), stats))
+	defer server.compressResponse(ctx)()
+
+	logger = logger.WithField("query", ctx.Request.URL.RawQuery)
+	if server.shouldLogRequest(ctx.Request) {
+		logger.Infof("%s %s %v", ctx.Request.Method, ctx.Request.URL.Path, ctx.Request.URL.Query())
+	}
+	server.countParamUsage(ctx.Request.URL.Query())
+
+	code, err := handler(ctx, metric)
+	if err != nil {
+		logger.WithError(err).Error()
+		server.writeError(ctx, code, err)
+	}
+	server.logSlowQuery(logger, start, stats, ctx.Writer.Status())
+}
+
+// observeAdmissionWait records the wait time of a request for a slot of --trace-server-max-concurrent-requests.
+// Nothing is recorded if the concurrency is unbounded since requests never wait.
+func (server *server) observeAdmissionWait(start time.Time, admitted bool) {
+	if server.admission.slots == nil {
+		return
+	}
+
+	result := "admitted"
+	if !admitted {
+		result = "rejected"
+	}
+	server.AdmissionWaitMetric.With(&admissionWaitMetric{Result: result}).Defer(start)
+}
 
-func (server *server) Close(ctx context.Context) error { return nil }
+func (server *server) Start(ctx context.Context) error {
+	if server.certReloader != nil {
+		go server.certReloader.run(ctx)
+	}
+
+	if err := server.checkClusterList(ctx); err != nil {
+		return err
+	}
+
+	if server.options.selfTest {
+		return server.selfTest(ctx)
+	}
+
+	return nil
+}
+
+func (server *server) Close(ctx context.Context) error { return server.drainAndFlush(ctx) }
 
 func (server *server) handleTrace(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), knownParams); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), knownParams); err != nil {
+		return code, err
+	}
+
+	if err := validateParamConflicts(ctx.Request.URL.Query()); err != nil {
+		return metric.fail(classConflictingParams), err
+	}
+
 	query := traceQuery{}
 	err = ctx.BindQuery(&query)
 	if err != nil {
-		metric.Error = metrics.MakeLabeledError("InvalidParam")
-		return 400, fmt.Errorf("invalid param %w", err)
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
 	}
 
 	if query.DisplayMode == "" {
-		query.DisplayMode = "tracing"
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
 	}
 
-	trace, code, err := server.findTrace(metric, query.DisplayMode, query)
+	location, err := parseTimezone(query.Tz)
+	if err != nil {
+		return metric.fail(classUnknownTimezone), fmt.Errorf("invalid tz param: %w", err)
+	}
+
+	anchor, err := server.resolveAnchor(query)
+	if err != nil {
+		return metric.fail(classInvalidParam), err
+	}
+
+	if query.List {
+		traces, code, err := server.findTraces(ctx.Request.Context(), metric, query.DisplayMode, query)
+		if err != nil {
+			return code, err
+		}
+
+		return server.writeTraceList(ctx, metric, query, traces, server.options.listOrder)
+	}
+
+	if query.Recent > 0 {
+		traces, code, err := server.findRecentTraces(ctx.Request.Context(), metric, query)
+		if err != nil {
+			return code, err
+		}
+
+		return server.writeTraceList(ctx, metric, query, traces, listOrderStartDesc)
+	}
+
+	if query.AllInNamespace {
+		if query.Namespace == "" {
+			return metric.fail(classEmptyParam), fmt.Errorf("all_in_namespace requires the namespace param")
+		}
+
+		traces, code, err := server.findTraces(ctx.Request.Context(), metric, query.DisplayMode, query)
+		if err != nil {
+			return code, err
+		}
+
+		if len(traces) > server.options.maxNamespaceTraces {
+			return metric.fail(classTooManyTraces), fmt.Errorf(
+				"more than %d traces match all_in_namespace, narrow down the time window or the namespace",
+				server.options.maxNamespaceTraces,
+			)
+		}
+
+		return server.writeTraceList(ctx, metric, query, traces, server.options.listOrder)
+	}
+
+	if query.RootOnly {
+		trace, code, err := server.findTrace(ctx.Request.Context(), metric, query.DisplayMode, query)
+		if err != nil {
+			return code, err
+		}
+
+		root := findRootSpan(trace, server.rootTag)
+		if root == nil {
+			return metric.fail(classNoRootSpan), fmt.Errorf("trace has no root span")
+		}
+
+		server.prepareResponseTrace(trace, query.Raw)
+		summary := newRootSummary(root, location)
+		if !anchor.IsZero() {
+			offset := root.StartTime.Sub(anchor).Microseconds()
+			summary.AnchorOffset = &offset
+		}
+		return server.writeResponse(ctx, metric, summary)
+	}
+
+	if query.Format == "" {
+		query.Format = server.defaultFormat(ctx)
+	}
+
+	trace, code, err := server.fetchResponseTrace(ctx, metric, query)
 	if err != nil {
 		return code, err
 	}
 
+	// validated before the transformations, which only depend on the params of the same URL
+	if server.setCacheValidators(ctx, query.Format, trace) {
+		ctx.Status(http.StatusNotModified)
+		return 0, nil
+	}
+
+	if orphans := server.handleDanglingRefs(trace); orphans > 0 {
+		server.DanglingRefMetric.With(&danglingRefMetric{}).Count(float64(orphans))
+	}
+
+	if query.Subtree != "" {
+		spanId, err := model.SpanIDFromString(query.Subtree)
+		if err != nil {
+			return metric.fail(classInvalidParam), fmt.Errorf("invalid subtree param %w", err)
+		}
+		if !subtree(trace, spanId) {
+			return metric.fail(classUnknownSpan), fmt.Errorf("trace has no span %s", query.Subtree)
+		}
+	}
+
+	server.pruneTrace(trace, query.SpanType)
+	server.adjustZeroDuration(trace)
+	server.adjustTimeConsistency(trace)
+
+	if !anchor.IsZero() {
+		anchorTrace(trace, anchor)
+	}
+
+	if query.SelfTime {
+		addSelfTime(trace)
+	}
+
+	if query.User != "" {
+		filterByUser(trace, server.matchingUsers(query.User))
+	}
+
+	if len(query.Component) > 0 {
+		filterByComponent(trace, server.options.componentTags, query.Component)
+	}
+
+	if query.RvMin != "" || query.RvMax != "" {
+		filterByResourceVersion(trace, query.RvMin, query.RvMax)
+	}
+
+	if len(query.Phase) > 0 {
+		filterByPhase(trace, query.Phase)
+	}
+
+	if query.CollapseRepeats {
+		CollapseRepeats(trace, server.options.collapseKeys)
+	}
+
+	if query.CriticalPath {
+		criticalPath(trace, server.rootTag)
+	}
+
+	spanTypeCaps, err := parseSpanTypeCaps(query.MaxPerSpanType)
+	if err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid max_per_span_type param: %w", err)
+	}
+	limitLogsPerSpanType(trace, server.options.spanTypeField, spanTypeCaps)
+
+	if query.MaxLogsPerSpan != nil {
+		if *query.MaxLogsPerSpan < 0 {
+			return metric.fail(classInvalidParam), fmt.Errorf("max_logs_per_span must not be negative")
+		}
+		limitLogs(trace, *query.MaxLogsPerSpan)
+	}
+
+	if query.Search != "" {
+		matches := markSearchMatches(trace, query.Search)
+		ctx.Header(searchMatchesHeader, strconv.Itoa(matches))
+	}
+
+	// extracted before truncation, which would cut the snapshot content
+	extras := traceExtras{}
+	if query.IncludeSnapshots {
+		extras.snapshots = extractSnapshots(trace, server.snapshotRedact)
+	}
+
+	// computed before delta, which removes spans the client already has
+	if query.ExpectedInterval != "" {
+		interval, err := parseExpectedInterval(query.ExpectedInterval)
+		if err != nil {
+			return metric.fail(classInvalidParam), err
+		}
+		spanType := server.canonicalSpanType(query.SpanType)
+		extras.gaps = coverageGaps(trace, interval, server.options.spanTypeField, spanType, query.Verb)
+	}
+
+	server.prepareResponseTrace(trace, query.Raw)
+
+	if values := ctx.Request.URL.Query(); values.Has("since") || values.Has("since_span_ids") {
+		heldIds, err := parseSinceSpanIds(query.SinceSpanIds)
+		if err != nil {
+			return metric.fail(classInvalidParam), err
+		}
+
+		base := deltaBase{}
+		if query.Since != "" {
+			var found bool
+			if base, found = server.deltaStore.get(query.Since); !found {
+				// the full trace is returned, which the client should use to replace the trace it holds
+				ctx.Header(deltaResetHeader, "true")
+			}
+		}
+
+		sortLogs(trace)
+		token, err := server.deltaStore.put(applyDelta(trace, base, heldIds))
+		if err != nil {
+			return metric.fail(classTraceError), err
+		}
+		ctx.Header(deltaTokenHeader, token)
+	}
+
+	requestStatsFrom(ctx.Request.Context()).setSpanCount(len(trace.Spans))
+
+	if query.Fields != "" {
+		fields, tagKeys, err := parseFields(query.Fields)
+		if err != nil {
+			return metric.fail(classInvalidParam), fmt.Errorf("invalid fields param: %w", err)
+		}
+
+		return server.writeResponse(ctx, metric, projectTrace(trace, fields, tagKeys))
+	}
+
+	if query.GroupBy != "" {
+		grouped, err := groupTrace(trace, query.GroupBy)
+		if err != nil {
+			return metric.fail(classInvalidParam), err
+		}
+
+		return server.writeResponse(ctx, metric, grouped)
+	}
+
+	return server.writeTrace(ctx, metric, query, trace, extras)
+}
+
+// writeTraceList writes a JSON array of traces in the given order.
+func (server *server) writeTraceList(
+	ctx *gin.Context,
+	metric *requestMetric,
+	query traceQuery,
+	traces []*model.Trace,
+	order string,
+) (code int, err error) {
+	sortTraces(traces, order, server.rootTag)
+
+	uiTraces := make([]*uimodel.Trace, len(traces))
+	for i, trace := range traces {
+		server.pruneTrace(trace, query.SpanType)
+		server.prepareResponseTrace(trace, query.Raw)
+		uiTraces[i] = uiconv.FromDomain(trace)
+	}
+
+	return server.writeResponse(ctx, metric, uiTraces)
+}
+
+// fetchResponseTrace fetches the trace of a single trace response before the transformations,
+// including the traces merged by also_name and the spans of include_events.
+func (server *server) fetchResponseTrace(ctx *gin.Context, metric *requestMetric, query traceQuery) (*model.Trace, int, error) {
+	trace, source, code, err := server.fetchMergedTrace(ctx.Request.Context(), metric, query)
+	if err != nil {
+		return nil, code, err
+	}
+	server.TraceSourceMetric.With(&traceSourceMetric{Source: source}).Count(1)
+	ctx.Header(sourceHeader, source)
+
+	if query.IncludeEvents {
+		eventTraces, code, err := server.fetchEventTraces(ctx.Request.Context(), metric, query)
+		if err != nil {
+			return nil, code, err
+		}
+		mergeEventSpans(trace, eventTraces, server.rootTag)
+	}
+
+	return trace, 0, nil
+}
+
+// fetchMergedTrace fetches the trace matching the query,
+// merging it with the traces of each also_name and each also_cluster under a synthetic root.
+func (server *server) fetchMergedTrace(
+	ctx context.Context,
+	metric *requestMetric,
+	query traceQuery,
+) (trace *model.Trace, source string, code int, err error) {
+	names := append([]string{query.Name}, query.AlsoName...)
+	clusters := append([]string{query.Cluster}, query.AlsoCluster...)
+	if code, err := server.checkFanout(metric, len(names)*len(clusters)); err != nil {
+		return nil, "", code, err
+	}
+	for _, cluster := range query.AlsoCluster {
+		// checked before the queries since the merge skips the 404 responses of the other queries
+		if !server.ensureCluster(ctx, cluster) {
+			return nil, "", metric.fail(classUnknownCluster), fmt.Errorf("cluster %s not supported now", cluster)
+		}
+	}
+
+	trace, source, code, err = server.fetchTrace(ctx, metric, query)
+	if err != nil {
+		return nil, "", code, err
+	}
+
+	if len(names) == 1 && len(clusters) == 1 {
+		return trace, source, 0, nil
+	}
+
+	traces := []*model.Trace{trace}
+	traceClusters := []string{query.Cluster}
+	for _, cluster := range clusters {
+		for _, name := range names {
+			if cluster == query.Cluster && name == query.Name {
+				continue
+			}
+
+			alsoQuery := query
+			alsoQuery.Cluster = cluster
+			alsoQuery.Name = name
+			alsoTrace, _, code, err := server.fetchTrace(ctx, metric, alsoQuery)
+			if err != nil {
+				if code == 404 {
+					// the object has no trace under this name or in this cluster in the window
+					metric.Error = nil
+					continue
+				}
+				return nil, "", code, err
+			}
+			traces = append(traces, alsoTrace)
+			traceClusters = append(traceClusters, cluster)
+		}
+	}
+
+	reasons := []string{}
+	if len(names) > 1 {
+		reasons = append(reasons, mergeReasonNames)
+	}
+	if len(clusters) > 1 {
+		reasons = append(reasons, mergeReasonClusters)
+	}
+
+	trace, err = server.mergeTraces(traces, traceClusters, mergeDescription{
+		Cluster:   query.Cluster,
+		Clusters:  clusters,
+		Resource:  query.Resource,
+		Namespace: query.Namespace,
+		Names:     names,
+		Reason:    strings.Join(reasons, " and "),
+	})
+	if err != nil {
+		return nil, "", metric.fail(classTraceError), err
+	}
+
+	return trace, source, 0, nil
+}
+
+// fetchTrace finds the trace matching the query,
+// re-fetching it with GetTrace if the FindTraces result has no logs and the fallback is enabled.
+func (server *server) fetchTrace(
+	ctx context.Context,
+	metric *requestMetric,
+	query traceQuery,
+) (trace *model.Trace, source string, code int, err error) {
+	trace, code, err = server.findTrace(ctx, metric, query.DisplayMode, query)
+	if err != nil {
+		return nil, "", code, err
+	}
+
 	hasLogs := false
 	for _, span := range trace.Spans {
 		if len(span.Logs) > 0 {
 			hasLogs = true
 		}
 	}
-	if !hasLogs && len(trace.Spans) > 0 {
-		trace, err = server.SpanReader.GetTrace(context.Background(), trace.Spans[0].TraceID)
+
+	source = traceSourceFind
+	fallback := !server.options.disableGetTraceFallback && (query.Full == nil || *query.Full)
+	if fallback && !hasLogs && len(trace.Spans) > 0 {
+		source = traceSourceGet
+		if err := server.reserveBackendCall(ctx); err != nil {
+			return nil, "", metric.fail(classFanoutTooLarge), err
+		}
+		getStart := server.Clock.Now()
+		trace, err = server.SpanReader.GetTrace(ctx, trace.Spans[0].TraceID)
+		requestStatsFrom(ctx).addBackendCall(nil, server.Clock.Since(getStart))
 		if err != nil {
-			metric.Error = metrics.MakeLabeledError("TraceError")
-			return 500, fmt.Errorf("failed to find trace ids %w", err)
+			return nil, "", metric.fail(classTraceError), fmt.Errorf("failed to find trace ids %w", err)
 		}
 	}
 
-	pruneTrace(trace, query.SpanType)
+	return trace, source, 200, nil
+}
+
+// defaultDisplayMode returns the display mode of requests to the cluster that do not specify displayMode.
+func (server *server) defaultDisplayMode(cluster string) string {
+	if configName, exists := server.clusterConfigs[strings.ToLower(cluster)]; exists {
+		return configName
+	}
+	return server.options.defaultDisplayMode
+}
+
+// validateDisplayMode checks that an explicitly requested display mode is a known transform config.
+// Returns 501 instead of panicking if the transform config provider is unavailable.
+func (server *server) validateDisplayMode(metric *requestMetric, displayMode string) (code int, err error) {
+	if server.TransformConfigs == nil {
+		return metric.fail(classConfigUnavailable),
+			fmt.Errorf("transform configs are unavailable, cannot select display mode %q", displayMode)
+	}
+
+	// consistent with the span reader, which accepts the "* " prefix used by the Jaeger UI
+	if server.TransformConfigs.GetByName(strings.TrimPrefix(displayMode, "* ")) == nil {
+		return metric.fail(classUnknownDisplayMode), fmt.Errorf("unknown display mode %q", displayMode)
+	}
 
-	uiTrace := uiconv.FromDomain(trace)
-	ctx.JSON(200, uiTrace)
 	return 0, nil
 }
 
-func pruneTrace(trace *model.Trace, spanType string) {
+// pruneTrace removes logs that are not of the span type
+// and logs older than the --trace-server-span-type-log-window of their span type.
+// The span type is normalized to the known span type according to --trace-server-span-type-case.
+func (server *server) pruneTrace(trace *model.Trace, spanType string) {
+	PruneTrace(trace, server.options.spanTypeField, server.canonicalSpanType(spanType))
+	PruneLogsByWindow(trace, server.options.spanTypeField, server.logWindows)
+}
+
+// PruneTrace removes logs that are not of the span type.
+// If spanTypeField is empty, a log is of the span type if it has a field keyed by the span type.
+// Otherwise, a log is of the span type if its field or its span's tag named spanTypeField equals the span type.
+func PruneTrace(trace *model.Trace, spanTypeField string, spanType string) {
 	if len(spanType) == 0 {
 		return
 	}
 
 	for _, span := range trace.Spans {
+		spanMatches := spanTypeField != "" && hasValue(span.Tags, spanTypeField, spanType)
+
 		var newLogs []model.Log
 		for _, log := range span.Logs {
-			_, ok := model.KeyValues(log.Fields).FindByKey(spanType)
-			if ok {
+			if spanMatches || logIsOfSpanType(log, spanTypeField, spanType) {
 				newLogs = append(newLogs, log)
 			}
 		}
@@ -152,6 +1660,20 @@ func pruneTrace(trace *model.Trace, spanType string) {
 	}
 }
 
+func logIsOfSpanType(log model.Log, spanTypeField string, spanType string) bool {
+	if spanTypeField == "" {
+		_, ok := model.KeyValues(log.Fields).FindByKey(spanType)
+		return ok
+	}
+
+	return hasValue(log.Fields, spanTypeField, spanType)
+}
+
+func hasValue(kvs []model.KeyValue, key string, value string) bool {
+	kv, ok := model.KeyValues(kvs).FindByKey(key)
+	return ok && kv.AsString() == value
+}
+
 type traceQuery struct {
 	Cluster     string `form:"cluster"`
 	Resource    string `form:"resource"`
@@ -161,71 +1683,370 @@ type traceQuery struct {
 	End         string `form:"end"`
 	SpanType    string `form:"span_type"`
 	DisplayMode string `form:"displayMode"`
+	// Relative is a negative duration such as "-10m".
+	// If set, the query window ends at the current time and starts at the current time plus this offset.
+	Relative string `form:"relative"`
+	// Full=false skips the GetTrace fallback for this request.
+	Full *bool `form:"full"`
+	// Format is the output format, one of "json" (default), "yaml", "otlp", "folded" or "duration_histogram".
+	Format string `form:"format"`
+	// Search marks spans containing the term with a `matched=true` tag.
+	// The number of matched spans is returned in the X-Kelemetry-Search-Matches header.
+	Search string `form:"search"`
+	// Labels is a comma-separated list of `key=value` label requirements, combined with AND semantics.
+	// The name param is optional if labels are specified. See LabelTagPrefix.
+	Labels string `form:"labels"`
+	// Tag is a storage span tag in the form `key:value`, repeatable and combined with AND semantics.
+	// Only keys in --trace-server-queryable-tags are accepted. The name param is optional if tags are specified.
+	Tag []string `form:"tag"`
+	// MaxLogsPerSpan keeps only the most recent logs of each span after span type pruning.
+	MaxLogsPerSpan *int `form:"max_logs_per_span"`
+	// AlsoName lists previous names of the object.
+	// Their traces are merged with the trace of Name under one synthetic root.
+	AlsoName []string `form:"also_name"`
+	// AlsoCluster lists other clusters with the same object, e.g. federated or migrated objects.
+	// Their traces are merged with the trace of Cluster under one synthetic root, with each span tagged with its cluster.
+	AlsoCluster []string `form:"also_cluster"`
+	// Annotations is a comma-separated list of `key=value` annotation requirements, combined with AND semantics.
+	// See AnnotationTagPrefix.
+	Annotations string `form:"annotations"`
+	// MaxPerSpanType caps the number of most recent logs kept per span for each span type,
+	// e.g. `event:50,audit:200`. Span types not listed are not capped.
+	MaxPerSpanType string `form:"max_per_span_type"`
+	// RootOnly returns only the root span and its tags, skipping the GetTrace fallback and the UI conversion.
+	RootOnly bool `form:"root_only"`
+	// List returns all matched traces as an array instead of requiring exactly one match.
+	List bool `form:"list"`
+	// Raw disables truncation of long tag values.
+	Raw bool `form:"raw"`
+	// GroupBy returns the spans grouped by a tag instead of the trace.
+	GroupBy string `form:"group_by"`
+	// CriticalPath returns only the spans on the critical path.
+	CriticalPath bool `form:"critical_path"`
+	// User keeps only the spans and logs with a matching UserTag.
+	User string `form:"user"`
+	// Component keeps only the spans and logs from any of the components.
+	Component []string `form:"component"`
+	// RvMin and RvMax keep only the spans and logs with a ResourceVersionTag in the inclusive range.
+	// Either bound may be omitted.
+	RvMin string `form:"rv_min"`
+	RvMax string `form:"rv_max"`
+	// Phase keeps only the spans and logs with a PhaseTag matching any of the phases.
+	Phase []string `form:"phase"`
+	// AllInNamespace returns the traces of all objects of the resource in the namespace.
+	AllInNamespace bool `form:"all_in_namespace"`
+	// Recent returns up to this number of the most recent traces before Ts.
+	Recent int `form:"recent"`
+	// Ts is the RFC3339 timestamp to search backwards from with Recent; defaults to now.
+	Ts string `form:"ts"`
+	// Fields is a comma-separated list of span fields to return.
+	Fields string `form:"fields"`
+	// Subtree keeps only the span with this ID and its descendants.
+	Subtree string `form:"subtree"`
+	// SelfTime tags each span with its duration excluding the time covered by its children.
+	SelfTime bool `form:"self_time"`
+	// CollapseRepeats merges consecutive sibling spans with identical --trace-server-collapse-keys.
+	CollapseRepeats bool `form:"collapse_repeats"`
+	// IncludeEvents merges the spans of the object in --trace-server-events-service into the trace.
+	IncludeEvents bool `form:"include_events"`
+	// Pretty indents JSON responses.
+	Pretty bool `form:"pretty"`
+	// Anchor is the origin of the timeline, "trace_start" (default) or "window_start".
+	// With window_start, spans starting before the query window are clipped to the window start.
+	Anchor string `form:"anchor"`
+	// Since is the delta token of the trace held by the client, from the X-Kelemetry-Delta-Token header of the previous poll.
+	// If since or since_span_ids is present, only the spans and logs not held by the client are returned,
+	// and the token of the full trace is returned in the X-Kelemetry-Delta-Token header.
+	// An empty since returns the full trace with its token.
+	// Tokens are kept in the memory of the replica for --trace-server-delta-ttl;
+	// an unknown or expired token returns the full trace with the X-Kelemetry-Delta-Reset header.
+	Since string `form:"since"`
+	// SinceSpanIds are comma-separated span IDs held by the client with all their logs.
+	SinceSpanIds []string `form:"since_span_ids"`
+	// Verb keeps only the spans with the verb tag for format=duration_histogram and expected_interval.
+	Verb string `form:"verb"`
+	// Tz is an IANA timezone in which the root_only summary and the yaml format also render timestamps.
+	// The epoch timestamps are preserved for the UI.
+	Tz string `form:"tz"`
+	// IncludeSnapshots returns the object snapshots logged in the trace in the envelope, keyed by span ID.
+	IncludeSnapshots bool `form:"include_snapshots"`
+	// ExpectedInterval returns the windows longer than the duration without spans matching span_type and verb
+	// in the envelope.
+	ExpectedInterval string `form:"expected_interval"`
+}
+
+// findTrace finds the only trace matching the query.
+func (server *server) findTrace(
+	ctx context.Context,
+	metric *requestMetric,
+	serviceName string,
+	query traceQuery,
+) (trace *model.Trace, code int, err error) {
+	traces, code, err := server.findTraces(ctx, metric, serviceName, query)
+	if err != nil {
+		return nil, code, err
+	}
+
+	if len(traces) > 1 {
+		return nil, metric.fail(classMultiTraceMatch), fmt.Errorf("trace ids match query length is %d, not 1", len(traces))
+	}
+	return traces[0], 200, nil
 }
 
-func (server *server) findTrace(metric *requestMetric, serviceName string, query traceQuery) (trace *model.Trace, code int, err error) {
+// findTraces finds all traces matching the query. Returns 404 if there are no matching traces.
+func (server *server) findTraces(
+	ctx context.Context,
+	metric *requestMetric,
+	serviceName string,
+	query traceQuery,
+) (traces []*model.Trace, code int, err error) {
 	cluster := query.Cluster
-	resource := query.Resource
+	resource := server.canonicalResource(query.Resource)
 	namespace := query.Namespace
 	name := query.Name
 
-	if len(cluster) == 0 || len(resource) == 0 || len(name) == 0 {
-		metric.Error = metrics.MakeLabeledError("EmptyParam")
-		return nil, 400, fmt.Errorf("cluster or resource or name is empty")
+	labelTags, err := parseSelector(query.Labels, LabelTagPrefix)
+	if err != nil {
+		return nil, metric.fail(classInvalidParam), fmt.Errorf("invalid labels param: %w", err)
+	}
+
+	annotationTags, err := parseSelector(query.Annotations, AnnotationTagPrefix)
+	if err != nil {
+		return nil, metric.fail(classInvalidParam), fmt.Errorf("invalid annotations param: %w", err)
+	}
+
+	queryTags, err := parseQueryTags(query.Tag, server.queryableTags)
+	if err != nil {
+		return nil, metric.fail(classInvalidParam), fmt.Errorf("invalid tag param: %w", err)
+	}
+
+	hasObjectSelector := len(name) > 0 || query.AllInNamespace || len(labelTags) > 0 || len(annotationTags) > 0 || len(queryTags) > 0
+	if len(cluster) == 0 || len(resource) == 0 || !hasObjectSelector {
+		return nil, metric.fail(classEmptyParam), fmt.Errorf("cluster or resource or name is empty")
+	}
+
+	if !server.ensureCluster(ctx, cluster) {
+		return nil, metric.fail(classUnknownCluster), fmt.Errorf("cluster %s not supported now", cluster)
 	}
 
-	var hasCluster bool
-	for _, knownCluster := range server.ClusterList.List() {
-		if strings.EqualFold(strings.ToLower(knownCluster), strings.ToLower(cluster)) {
-			hasCluster = true
+	startTimestamp, endTimestamp, err := server.resolveWindow(query)
+	if err != nil {
+		return nil, metric.fail(classInvalidTimestamp), err
+	}
+	if code, err := server.checkRetention(metric, startTimestamp); err != nil {
+		return nil, code, err
+	}
+
+	parameters := QueryParameters(serviceName, utilobject.Key{
+		Cluster:   cluster,
+		Resource:  resource,
+		Namespace: namespace,
+		Name:      name,
+	}, startTimestamp, endTimestamp)
+	for _, selectorTags := range []map[string]string{labelTags, annotationTags, queryTags} {
+		for tagKey, tagValue := range selectorTags {
+			parameters.Tags[tagKey] = tagValue
 		}
 	}
-	if !hasCluster {
-		metric.Error = metrics.MakeLabeledError("UnknownCluster")
-		return nil, 404, fmt.Errorf("cluster %s not supported now", cluster)
+	if server.options.maxFindResults > 0 {
+		parameters.NumTraces = server.options.maxFindResults
+	}
+	if query.AllInNamespace {
+		// one more than the limit to detect overflow
+		parameters.NumTraces = server.options.maxNamespaceTraces + 1
 	}
 
-	startTimestamp, err := time.Parse(time.RFC3339, query.Start)
+	// keyed by the raw query instead of the resolved parameters so that relative windows are also cached
+	queryJson, err := json.Marshal(query)
 	if err != nil {
-		metric.Error = metrics.MakeLabeledError("InvalidTimestamp")
-		return nil, 400, fmt.Errorf("invalid timestamp for start param %w", err)
+		return nil, metric.fail(classInvalidParam), fmt.Errorf("cannot marshal query: %w", err)
+	}
+	negativeCacheKey := serviceName + "\x00" + string(queryJson)
+	if server.negativeCache.contains(negativeCacheKey) {
+		server.NegativeCacheMetric.With(&negativeCacheHitMetric{}).Count(1)
+		code, err := server.noTraceMatch(metric, query, fmt.Errorf("could not find trace ids that match query"))
+		return nil, code, err
 	}
 
-	endTimestamp, err := time.Parse(time.RFC3339, query.End)
+	queryCtx, cancelFunc := server.queryContext(ctx, cluster)
+	defer cancelFunc()
+
+	traces, err = server.queryStorage(ctx, queryCtx, cluster, parameters)
+	for attempt := 0; err == nil && len(traces) == 0 && server.shouldRetryEmpty(attempt, endTimestamp); attempt++ {
+		select {
+		case <-queryCtx.Done():
+			err = queryCtx.Err()
+		case <-server.Clock.After(server.options.emptyRetryDelay):
+			server.EmptyRetryMetric.With(&emptyRetryMetric{}).Count(1)
+			traces, err = server.retryStorage(ctx, queryCtx, cluster, parameters)
+		}
+	}
 	if err != nil {
-		metric.Error = metrics.MakeLabeledError("InvalidTimestamp")
-		return nil, 400, fmt.Errorf("invalid timestamp for end param %w", err)
+		if errors.Is(err, errFanoutTooLarge) {
+			return nil, metric.fail(classFanoutTooLarge), err
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			server.QueryTimeoutMetric.With(&queryTimeoutMetric{Cluster: cluster}).Count(1)
+			return nil, metric.fail(classTimeout), fmt.Errorf("storage query timed out: %w", err)
+		}
+
+		return nil, metric.fail(classTraceError), fmt.Errorf("failed to find trace ids %w", err)
 	}
 
-	tags := map[string]string{
-		"resource": resource,
-		"name":     name,
+	if len(traces) == 0 {
+		server.negativeCache.add(negativeCacheKey)
+		code, err := server.noTraceMatch(metric, query, fmt.Errorf("could not find trace ids that match query"))
+		return nil, code, err
 	}
-	if namespace != "" {
-		tags["namespace"] = namespace
+	if !query.AllInNamespace && len(traces) >= parameters.NumTraces {
+		requestStatsFrom(ctx).setResultsLimited()
 	}
+	return traces, 200, nil
+}
 
-	parameters := &spanstore.TraceQueryParameters{
-		ServiceName:   serviceName,
-		OperationName: cluster,
-		Tags:          tags,
-		StartTimeMin:  startTimestamp,
-		StartTimeMax:  endTimestamp,
-		NumTraces:     20,
+// queryStorage calls FindTraces, coalesced with identical concurrent calls if enabled.
+// Returns errFanoutTooLarge if the request has used up --trace-server-max-fanout.
+func (server *server) queryStorage(
+	ctx context.Context,
+	queryCtx context.Context,
+	cluster string,
+	parameters *spanstore.TraceQueryParameters,
+) (traces []*model.Trace, err error) {
+	if err := server.reserveBackendCall(ctx); err != nil {
+		return nil, err
+	}
+	return server.retryStorage(ctx, queryCtx, cluster, parameters)
+}
+
+// retryStorage is queryStorage without counting the call against --trace-server-max-fanout,
+// used to repeat a call with the same parameters.
+// Coalesced calls run on a context bounded by the query timeout of the cluster instead of queryCtx.
+func (server *server) retryStorage(
+	ctx context.Context,
+	queryCtx context.Context,
+	cluster string,
+	parameters *spanstore.TraceQueryParameters,
+) (traces []*model.Trace, err error) {
+	findStart := server.Clock.Now()
+	defer func() { requestStatsFrom(ctx).addBackendCall(parameters, server.Clock.Since(findStart)) }()
+
+	if server.coalescer == nil {
+		return server.SpanReader.FindTraces(queryCtx, parameters)
+	}
+
+	traces, shared, err := server.coalescer.do(
+		queryCtx,
+		coalesceKey(parameters),
+		func() (context.Context, context.CancelFunc) {
+			return server.queryContext(context.Background(), cluster)
+		},
+		func(callCtx context.Context) ([]*model.Trace, error) {
+			return server.SpanReader.FindTraces(callCtx, parameters)
+		},
+	)
+	if shared {
+		server.CoalescedQueryMetric.With(&coalescedQueryMetric{}).Count(1)
+	}
+	return traces, err
+}
+
+type emptyRetryMetric struct{}
+
+func (*emptyRetryMetric) MetricName() string { return "extension_trace_empty_retry" }
+
+// shouldRetryEmpty checks whether an empty result should be retried,
+// which is only the case for windows ending within --trace-server-empty-retry-recency
+// since the trace of a new object may not be persisted yet.
+func (server *server) shouldRetryEmpty(attempt int, endTime time.Time) bool {
+	if attempt >= server.options.emptyRetryAttempts {
+		return false
 	}
-	traces, err := server.SpanReader.FindTraces(context.Background(), parameters)
+	return !endTime.Before(server.Clock.Now().Add(-server.options.emptyRetryRecency))
+}
+
+// retentionCutoff returns the earliest queryable time, or the zero time if --trace-server-max-lookback is unlimited.
+func (server *server) retentionCutoff() time.Time {
+	if server.options.maxLookback <= 0 {
+		return time.Time{}
+	}
+	return server.Clock.Now().Add(-server.options.maxLookback)
+}
+
+// checkRetention rejects queries starting before --trace-server-max-lookback, which would scan for expired data.
+func (server *server) checkRetention(metric *requestMetric, startTime time.Time) (code int, err error) {
+	if cutoff := server.retentionCutoff(); startTime.Before(cutoff) {
+		return metric.fail(classBeyondRetention), fmt.Errorf(
+			"query starts at %s, which is beyond the retention of %s; data earlier than %s is not queryable",
+			startTime.Format(time.RFC3339), server.options.maxLookback, cutoff.Format(time.RFC3339),
+		)
+	}
+	return 0, nil
+}
+
+// queryContext returns a context bounded by the query timeout of the cluster.
+func (server *server) queryContext(ctx context.Context, cluster string) (context.Context, context.CancelFunc) {
+	timeout, exists := server.clusterTimeouts[strings.ToLower(cluster)]
+	if !exists {
+		timeout = server.options.queryTimeout
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (server *server) resolveWindow(query traceQuery) (startTime time.Time, endTime time.Time, err error) {
+	if query.Relative != "" {
+		offset, err := time.ParseDuration(query.Relative)
+		if err != nil {
+			return startTime, endTime, fmt.Errorf("invalid duration for relative param %w", err)
+		}
+		if offset >= 0 {
+			return startTime, endTime, fmt.Errorf("relative param must be a negative duration, got %q", query.Relative)
+		}
+
+		endTime = server.Clock.Now()
+		if server.coalescer != nil {
+			endTime = endTime.Truncate(coalesceGranularity)
+		}
+		return endTime.Add(offset), endTime, nil
+	}
+
+	startTime, err = time.Parse(time.RFC3339, query.Start)
 	if err != nil {
-		metric.Error = metrics.MakeLabeledError("TraceError")
-		return nil, 500, fmt.Errorf("failed to find trace ids %w", err)
+		return startTime, endTime, fmt.Errorf("invalid timestamp for start param %w", err)
 	}
 
-	if len(traces) > 1 {
-		metric.Error = metrics.MakeLabeledError("MultiTraceMatch")
-		return nil, 500, fmt.Errorf("trace ids match query length is %d, not 1", len(traces))
+	endTime, err = time.Parse(time.RFC3339, query.End)
+	if err != nil {
+		return startTime, endTime, fmt.Errorf("invalid timestamp for end param %w", err)
 	}
-	if len(traces) == 0 {
-		metric.Error = metrics.MakeLabeledError("NoTraceMatch")
-		return nil, 404, fmt.Errorf("could not find trace ids that match query")
+
+	return startTime, endTime, nil
+}
+
+// QueryParameters builds the FindTraces parameters that select the trace of an object.
+// The tags must be consistent with the object tags written by the aggregator (see zconstants.KeyToSpanTags).
+// The cluster is passed as the operation name, which the span reader converts into the "cluster" tag.
+func QueryParameters(displayMode string, key utilobject.Key, startTime, endTime time.Time) *spanstore.TraceQueryParameters {
+	tags := map[string]string{
+		"resource": key.Resource,
+	}
+	if key.Name != "" {
+		tags["name"] = key.Name
+	}
+	if key.Namespace != "" {
+		tags["namespace"] = key.Namespace
+	}
+
+	return &spanstore.TraceQueryParameters{
+		ServiceName:   displayMode,
+		OperationName: key.Cluster,
+		Tags:          tags,
+		StartTimeMin:  startTime,
+		StartTimeMax:  endTime,
+		NumTraces:     20,
 	}
-	return traces[0], 200, nil
 }
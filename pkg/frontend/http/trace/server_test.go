@@ -0,0 +1,229 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	utilobject "github.com/kubewharf/kelemetry/pkg/util/object"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func TestQueryParametersMatchAggregatorTags(t *testing.T) {
+	for _, key := range []utilobject.Key{
+		{Cluster: "test-cluster", Group: "apps", Resource: "deployments", Namespace: "default", Name: "foo"},
+		{Cluster: "test-cluster", Group: "", Resource: "nodes", Namespace: "", Name: "bar"},
+	} {
+		t.Run(key.String(), func(t *testing.T) {
+			assert := assert.New(t)
+
+			start := time.Unix(0, 0)
+			end := start.Add(time.Hour)
+			params := trace.QueryParameters(trace.DefaultDisplayMode, key, start, end)
+
+			assert.Equal(trace.DefaultDisplayMode, params.ServiceName)
+			assert.Equal(start, params.StartTimeMin)
+			assert.Equal(end, params.StartTimeMax)
+
+			aggregatorTags := zconstants.KeyToSpanTags(key)
+			assert.Equal(aggregatorTags["cluster"], params.OperationName)
+			for tagKey, tagValue := range params.Tags {
+				assert.Contains(aggregatorTags, tagKey)
+				assert.Equal(aggregatorTags[tagKey], tagValue, "tag %q", tagKey)
+			}
+		})
+	}
+}
+
+func TestDefaultDisplayModeIsConfigured(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlBytes, err := os.ReadFile("../../../../hack/tfconfig.yaml")
+	assert.NoError(err)
+
+	var file struct {
+		Configs []struct {
+			Name string `json:"name"`
+		} `json:"configs"`
+	}
+	assert.NoError(yaml.Unmarshal(yamlBytes, &file))
+
+	names := []string{}
+	for _, config := range file.Configs {
+		names = append(names, config.Name)
+	}
+	assert.Contains(names, trace.DefaultDisplayMode)
+}
+
+func TestPruneTraceBySpanTypeFieldKey(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := &model.Trace{Spans: []*model.Span{{
+		Logs: []model.Log{
+			{Fields: []model.KeyValue{model.String("audit", "create")}},
+			{Fields: []model.KeyValue{model.String("event", "Scheduled")}},
+		},
+	}}}
+
+	trace.PruneTrace(tr, "", "audit")
+
+	assert.Len(tr.Spans[0].Logs, 1)
+	assert.Equal("audit", tr.Spans[0].Logs[0].Fields[0].Key)
+}
+
+func TestPruneTraceByRenamedSpanTypeField(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := &model.Trace{Spans: []*model.Span{
+		{
+			Logs: []model.Log{
+				{Fields: []model.KeyValue{model.String("kind", "audit"), model.String("verb", "create")}},
+				{Fields: []model.KeyValue{model.String("kind", "event"), model.String("reason", "Scheduled")}},
+				{Fields: []model.KeyValue{model.String("audit", "legacy")}},
+			},
+		},
+		{
+			Tags: []model.KeyValue{model.String("kind", "audit")},
+			Logs: []model.Log{
+				{Fields: []model.KeyValue{model.String("message", "from a span tagged as audit")}},
+			},
+		},
+	}}
+
+	trace.PruneTrace(tr, "kind", "audit")
+
+	assert.Len(tr.Spans[0].Logs, 1)
+	assert.Equal("create", tr.Spans[0].Logs[0].Fields[1].VStr)
+	assert.Len(tr.Spans[1].Logs, 1)
+}
+
+func TestCollapsedAuditLogsHaveFilterFields(t *testing.T) {
+	assert := assert.New(t)
+
+	yamlBytes, err := os.ReadFile("../../../../hack/tfconfig.yaml")
+	assert.NoError(err)
+
+	var file struct {
+		Batches []struct {
+			Steps []struct {
+				Kind        string `json:"kind"`
+				TagMappings map[string][]struct {
+					FromSpanTag string `json:"fromSpanTag"`
+					ToLogField  string `json:"toLogField"`
+				} `json:"tagMappings"`
+			} `json:"steps"`
+		} `json:"batches"`
+	}
+	assert.NoError(yaml.Unmarshal(yamlBytes, &file))
+
+	mapped := map[string]string{}
+	for _, batch := range file.Batches {
+		for _, step := range batch.Steps {
+			if step.Kind == "CollapseNestingVisitor" {
+				for _, mapping := range step.TagMappings["audit"] {
+					mapped[mapping.FromSpanTag] = mapping.ToLogField
+				}
+			}
+		}
+	}
+
+	// the user, rv_min and rv_max params match these log fields of collapsed audit spans
+	for _, tag := range []string{trace.UserTag, trace.ResourceVersionTag} {
+		assert.Equal(tag, mapped[tag], "span tag %q", tag)
+	}
+}
+
+func TestMergedTraceHasRootProcess(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-20*time.Minute)))
+	reader.addObject("web-old", auditSpan(2, "delete", now.Add(-30*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test"})
+	assert.NoError(t, err)
+
+	for _, format := range []string{"json", "yaml", "otlp"} {
+		t.Run(format, func(t *testing.T) {
+			assert := assert.New(t)
+
+			response := mock.Request("GET", errorPathTarget+"&also_name=web-old&format="+format, nil)
+			assert.Equal(200, response.Code, response.Body.String())
+			assert.Contains(response.Body.String(), "merged names")
+		})
+	}
+}
+
+func TestAlsoClusterTagsSpansWithCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	// each cluster (queried as the operation name) stores its own spans of the object;
+	// the "empty" cluster has no trace in the window
+	spanIds := map[string]uint64{"test": 1, "other": 2}
+	reader := newFakeReader()
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		spanId, exists := spanIds[query.OperationName]
+		if !exists {
+			return nil, nil
+		}
+		return []*model.Trace{{Spans: []*model.Span{auditSpan(spanId, "create", now.Add(-10*time.Minute))}}}, nil
+	}
+
+	mock, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(now), reader, []string{"test", "other", "empty"})
+	assert.NoError(err)
+
+	response := mock.Request("GET", errorPathTarget+"&also_cluster=other&also_cluster=empty", nil)
+	assert.Equal(200, response.Code, response.Body.String())
+
+	var body struct {
+		Spans []struct {
+			OperationName string `json:"operationName"`
+			Tags          []struct {
+				Key   string `json:"key"`
+				Value any    `json:"value"`
+			} `json:"tags"`
+		} `json:"spans"`
+	}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &body))
+
+	clusters := []any{}
+	for _, span := range body.Spans {
+		if span.OperationName != "create" {
+			assert.Contains(span.OperationName, "merged clusters")
+			continue
+		}
+		for _, tag := range span.Tags {
+			if tag.Key == "cluster" {
+				clusters = append(clusters, tag.Value)
+			}
+		}
+	}
+	assert.ElementsMatch([]any{"test", "other"}, clusters, "each span is tagged with the cluster of its query")
+
+	response = mock.Request("GET", errorPathTarget+"&also_cluster=unknown", nil)
+	assert.Equal(404, response.Code, "unknown also_cluster values are rejected")
+	assert.Equal(1.0, mock.MetricsOutput().Get("extension_trace_request", map[string]string{"error": "UnknownCluster"}).Int)
+}
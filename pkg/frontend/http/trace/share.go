@@ -0,0 +1,155 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"k8s.io/utils/clock"
+)
+
+// shareStore stores trace queries behind opaque tokens.
+type shareStore interface {
+	// put stores the query and returns a new token.
+	put(query url.Values) (token string, err error)
+	// get returns the query of an unexpired token.
+	get(token string) (query url.Values, found bool)
+}
+
+type shareEntry struct {
+	query  url.Values
+	expiry time.Time
+}
+
+// memoryShareStore is a shareStore with a bounded number of entries in memory,
+// evicting the entry expiring first when full.
+type memoryShareStore struct {
+	clock      clock.Clock
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]shareEntry
+}
+
+func newMemoryShareStore(clock clock.Clock, ttl time.Duration, maxEntries int) *memoryShareStore {
+	return &memoryShareStore{
+		clock:      clock,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]shareEntry{},
+	}
+}
+
+func (store *memoryShareStore) put(query url.Values) (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", fmt.Errorf("cannot generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := store.clock.Now()
+
+	// evicting instead of rejecting new tokens so that a client cannot disable sharing by filling the store
+	for len(store.entries) >= store.maxEntries {
+		oldestToken := ""
+		var oldestExpiry time.Time
+		for otherToken, entry := range store.entries {
+			if oldestToken == "" || entry.expiry.Before(oldestExpiry) {
+				oldestToken, oldestExpiry = otherToken, entry.expiry
+			}
+		}
+		delete(store.entries, oldestToken)
+	}
+
+	store.entries[token] = shareEntry{query: query, expiry: now.Add(store.ttl)}
+	return token, nil
+}
+
+func (store *memoryShareStore) get(token string) (url.Values, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry, exists := store.entries[token]
+	if !exists {
+		return nil, false
+	}
+
+	if !store.clock.Now().Before(entry.expiry) {
+		delete(store.entries, token)
+		return nil, false
+	}
+
+	return entry.query, true
+}
+
+type shareRequest struct {
+	// Query is the URL-encoded query string of the trace endpoint.
+	Query string `json:"query"`
+}
+
+type shareResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// handleShare stores a trace query and returns a token for /extensions/api/v1/trace/by-token/:token.
+func (server *server) handleShare(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if class, err := server.checkRequestBody(ctx); err != nil {
+		return metric.fail(class), err
+	}
+
+	var request shareRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		if server.isBodyTooLarge(err) {
+			return metric.fail(classRequestTooLarge), err
+		}
+		return metric.fail(classInvalidBody), fmt.Errorf("invalid request body: %w", err)
+	}
+
+	query, err := url.ParseQuery(request.Query)
+	if err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid query: %w", err)
+	}
+
+	token, err := server.shareStore.put(query)
+	if err != nil {
+		return metric.fail(classTraceError), fmt.Errorf("cannot store shared query: %w", err)
+	}
+
+	response := shareResponse{Token: token, ExpiresAt: server.Clock.Now().Add(server.options.shareTtl)}
+	server.writeJSON(ctx, 200, server.wrapEnvelope(ctx, response))
+	return 200, nil
+}
+
+// handleTraceByToken serves the trace of a query stored with handleShare.
+func (server *server) handleTraceByToken(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	query, found := server.shareStore.get(ctx.Param("token"))
+	if !found {
+		return metric.fail(classUnknownToken), fmt.Errorf("unknown or expired token")
+	}
+
+	ctx.Request.URL.RawQuery = query.Encode()
+	return server.handleTrace(ctx, metric)
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+func TestShareEvictsOldestTokenWhenFull(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock := clocktesting.NewFakeClock(now)
+	reader := newFakeReader()
+	reader.addObject("web", auditSpan(1, "create", now.Add(-30*time.Minute)))
+
+	mock, err := trace.NewMockHttpServer(clock, reader, []string{"test"}, "--trace-server-share-max-entries=2")
+	assert.NoError(err)
+
+	body := fmt.Sprintf(`{"query":%q}`, strings.TrimPrefix(errorPathTarget, "/extensions/api/v1/trace?"))
+	tokens := []string{}
+	for i := 0; i < 3; i++ {
+		response := mock.Serve(httptest.NewRequest("POST", "/extensions/api/v1/share", strings.NewReader(body)))
+		assert.Equal(200, response.Code, "sharing is not rejected when the store is full: %s", response.Body.String())
+
+		var share struct {
+			Token string `json:"token"`
+		}
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &share))
+		tokens = append(tokens, share.Token)
+		clock.Step(time.Second)
+	}
+
+	assert.Equal(404, mock.Request("GET", "/extensions/api/v1/trace/by-token/"+tokens[0], nil).Code, "the oldest token is evicted")
+	for _, token := range tokens[1:] {
+		response := mock.Request("GET", "/extensions/api/v1/trace/by-token/"+token, nil)
+		assert.Equal(200, response.Code, response.Body.String())
+	}
+}
+
+func TestShareFlagsMustBePositive(t *testing.T) {
+	for _, arg := range []string{"--trace-server-share-max-entries=0", "--trace-server-share-ttl=0s", "--trace-server-share-ttl=-1h"} {
+		_, err := trace.NewMockHttpServer(clocktesting.NewFakeClock(time.Now()), newFakeReader(), []string{"test"}, arg)
+		assert.Error(t, err, arg)
+	}
+}
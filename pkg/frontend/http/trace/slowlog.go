@@ -0,0 +1,117 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/sirupsen/logrus"
+)
+
+// requestStats collects details of a request for the slow query log.
+type requestStats struct {
+	mu              sync.Mutex
+	parameters      []*spanstore.TraceQueryParameters
+	backendDuration time.Duration
+	backendCalls    int
+	spanCount       int
+	resultsLimited  bool
+}
+
+type requestStatsKey struct{}
+
+func withRequestStats(ctx context.Context, stats *requestStats) context.Context {
+	return context.WithValue(ctx, requestStatsKey{}, stats)
+}
+
+// requestStatsFrom returns the stats of the request, or a discarded value if ctx has no stats.
+func requestStatsFrom(ctx context.Context) *requestStats {
+	if stats, ok := ctx.Value(requestStatsKey{}).(*requestStats); ok {
+		return stats
+	}
+	return &requestStats{}
+}
+
+func (stats *requestStats) addBackendCall(parameters *spanstore.TraceQueryParameters, duration time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if parameters != nil {
+		stats.parameters = append(stats.parameters, parameters)
+	}
+	stats.backendDuration += duration
+}
+
+// reserveBackendCall counts a backend call, returning false without counting it if limit calls are reached.
+// A non-positive limit is unlimited.
+func (stats *requestStats) reserveBackendCall(limit int) bool {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if limit > 0 && stats.backendCalls >= limit {
+		return false
+	}
+	stats.backendCalls++
+	return true
+}
+
+func (stats *requestStats) setSpanCount(spanCount int) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.spanCount = spanCount
+}
+
+// setResultsLimited records that a storage query returned as many traces as --trace-server-max-find-results.
+func (stats *requestStats) setResultsLimited() {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.resultsLimited = true
+}
+
+func (stats *requestStats) isResultsLimited() bool {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	return stats.resultsLimited
+}
+
+// logSlowQuery logs the request at WARN level if it took longer than the slow query threshold.
+func (server *server) logSlowQuery(logger logrus.FieldLogger, start time.Time, stats *requestStats, status int) {
+	threshold := server.options.slowQueryThreshold
+	if threshold <= 0 {
+		return
+	}
+
+	duration := server.Clock.Since(start)
+	if duration < threshold {
+		return
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	logger.
+		WithField("duration", duration).
+		WithField("backendDuration", stats.backendDuration).
+		WithField("parameters", stats.parameters).
+		WithField("spanCount", stats.spanCount).
+		WithField("status", status).
+		Warn("slow trace query")
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/jaegertracing/jaeger/model"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+// snapshotLabelRedacted marks objects whose content must not be displayed,
+// the same label as the diff controller uses for redacting diffs.
+const snapshotLabelRedacted = "kelemetry.kubewharf.io/diff-redacted"
+
+const snapshotRedactedMessage = "Sensitive object content has been redacted"
+
+// objectSnapshot is the state of the object logged by the diff decorator at the time of a span log.
+type objectSnapshot struct {
+	Time uint64 `json:"time"`
+	// Yaml is empty if the snapshot is redacted.
+	Yaml     string `json:"yaml,omitempty"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// extractSnapshots returns the object snapshots in the span logs of the trace keyed by span ID, sorted by time.
+// Snapshots of objects with the redaction label or matching redactPattern in the form g/v/r/ns/name
+// are reported as redacted and their content is also removed from the logs.
+func extractSnapshots(trace *model.Trace, redactPattern *regexp.Regexp) map[string][]objectSnapshot {
+	snapshots := map[string][]objectSnapshot{}
+	for _, span := range trace.Spans {
+		for i := range span.Logs {
+			log := &span.Logs[i]
+			if !hasValue(log.Fields, zconstants.LogTypeAttr, string(zconstants.LogTypeObjectSnapshot)) {
+				continue
+			}
+
+			snapshot := objectSnapshot{Time: model.TimeAsEpochMicroseconds(log.Timestamp)}
+
+			for j := range log.Fields {
+				field := &log.Fields[j]
+				if field.Key != "event" {
+					continue
+				}
+
+				snapshotYaml, redacted, err := snapshotToYaml(span, field.AsString(), redactPattern)
+				if err != nil {
+					snapshotYaml = fmt.Sprintf("invalid snapshot: %v", err)
+				}
+				if redacted {
+					snapshot.Redacted = true
+					*field = model.String(field.Key, snapshotRedactedMessage)
+				} else {
+					snapshot.Yaml = snapshotYaml
+				}
+			}
+
+			spanId := span.SpanID.String()
+			snapshots[spanId] = append(snapshots[spanId], snapshot)
+		}
+	}
+
+	for _, list := range snapshots {
+		list := list
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Time < list[j].Time })
+	}
+	return snapshots
+}
+
+func snapshotToYaml(span *model.Span, snapshotJson string, redactPattern *regexp.Regexp) (snapshotYaml string, redacted bool, err error) {
+	object := &unstructured.Unstructured{}
+	if err := object.UnmarshalJSON([]byte(snapshotJson)); err != nil {
+		// redact undecodable snapshots since the object name cannot be checked
+		return "", true, err
+	}
+
+	if _, hasLabel := object.GetLabels()[snapshotLabelRedacted]; hasLabel {
+		return "", true, nil
+	}
+
+	var resource string
+	if resourceTag, hasResource := model.KeyValues(span.Tags).FindByKey("resource"); hasResource {
+		resource = resourceTag.AsString()
+	}
+	gv := object.GroupVersionKind().GroupVersion()
+	gvrnn := fmt.Sprintf("%s/%s/%s/%s/%s", gv.Group, gv.Version, resource, object.GetNamespace(), object.GetName())
+	if redactPattern != nil && redactPattern.MatchString(gvrnn) {
+		return "", true, nil
+	}
+
+	yamlBytes, err := yaml.JSONToYAML(json.RawMessage(snapshotJson))
+	if err != nil {
+		return "", false, err
+	}
+	return string(yamlBytes), false, nil
+}
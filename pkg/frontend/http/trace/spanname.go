@@ -0,0 +1,65 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// operationNameKey is the template key of the original span name.
+// Span tags with the same key are shadowed.
+const operationNameKey = "operationName"
+
+func parseSpanNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("span-name").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trace-server-span-name-template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renameSpans rewrites span names with --trace-server-span-name-template.
+// Spans for which the template fails or renders an empty string keep their names.
+func (server *server) renameSpans(trace *model.Trace) {
+	if server.spanNameTemplate == nil {
+		return
+	}
+
+	for _, span := range trace.Spans {
+		data := make(map[string]string, len(span.Tags)+1)
+		for _, tag := range span.Tags {
+			data[tag.Key] = tag.AsString()
+		}
+		data[operationNameKey] = span.OperationName
+
+		var buf strings.Builder
+		if err := server.spanNameTemplate.Execute(&buf, data); err != nil {
+			server.Logger.WithError(err).Debug("cannot render span name template")
+			continue
+		}
+
+		if name := strings.TrimSpace(buf.String()); name != "" {
+			span.OperationName = name
+		}
+	}
+}
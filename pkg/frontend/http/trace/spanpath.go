@@ -0,0 +1,168 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+)
+
+type spanPathQuery struct {
+	SpanId string `form:"span_id"`
+}
+
+// handleSpanPath returns the spans from the root of the trace to the span_id span.
+func (server *server) handleSpanPath(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	params := append([]string{"span_id"}, knownParams...)
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), params); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), params); err != nil {
+		return code, err
+	}
+
+	if err := validateParamConflicts(ctx.Request.URL.Query()); err != nil {
+		return metric.fail(classConflictingParams), err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	pathParams := spanPathQuery{}
+	if err := ctx.BindQuery(&pathParams); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if pathParams.SpanId == "" {
+		return metric.fail(classEmptyParam), fmt.Errorf("span_id param is required")
+	}
+	spanId, err := model.SpanIDFromString(pathParams.SpanId)
+	if err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid span_id param %w", err)
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	trace, _, code, err := server.fetchMergedTrace(ctx.Request.Context(), metric, query)
+	if err != nil {
+		return code, err
+	}
+
+	path := spanPath(trace, spanId, server.rootTag)
+	if path == nil {
+		return metric.fail(classUnknownSpan), fmt.Errorf("trace has no span %s", pathParams.SpanId)
+	}
+
+	pathTrace := &model.Trace{Spans: path, ProcessMap: trace.ProcessMap}
+	server.prepareResponseTrace(pathTrace, query.Raw)
+
+	return server.writeResponse(ctx, metric, uiconv.FromDomain(pathTrace))
+}
+
+// spanPath returns the spans from the root to the span with spanId following ChildOf references,
+// or nil if the trace has no such span.
+// If the ancestry ends at a missing parent, the root span found with the root tag starts the path.
+func spanPath(trace *model.Trace, spanId model.SpanID, tag rootTag) []*model.Span {
+	spans := make(map[model.SpanID]*model.Span, len(trace.Spans))
+	for _, span := range trace.Spans {
+		spans[span.SpanID] = span
+	}
+
+	span, exists := spans[spanId]
+	if !exists {
+		return nil
+	}
+
+	reversed := []*model.Span{span}
+	visited := map[model.SpanID]struct{}{spanId: {}}
+	for {
+		parentId := span.ParentSpanID()
+		if parentId == 0 {
+			break
+		}
+		if _, cyclic := visited[parentId]; cyclic {
+			break
+		}
+
+		parent, exists := spans[parentId]
+		if !exists {
+			if root := findRootSpan(trace, tag); root != nil {
+				if _, included := visited[root.SpanID]; !included {
+					reversed = append(reversed, root)
+				}
+			}
+			break
+		}
+
+		visited[parentId] = struct{}{}
+		reversed = append(reversed, parent)
+		span = parent
+	}
+
+	path := make([]*model.Span, len(reversed))
+	for i, span := range reversed {
+		path[len(reversed)-1-i] = span
+	}
+	return path
+}
+
+// subtree keeps only the span with spanId and its transitive ChildOf descendants.
+// Returns false without changing the trace if the trace has no such span.
+func subtree(trace *model.Trace, spanId model.SpanID) bool {
+	children := map[model.SpanID][]model.SpanID{}
+	found := false
+	for _, span := range trace.Spans {
+		if span.SpanID == spanId {
+			found = true
+		}
+		if parentId := span.ParentSpanID(); parentId != 0 {
+			children[parentId] = append(children[parentId], span.SpanID)
+		}
+	}
+	if !found {
+		return false
+	}
+
+	kept := map[model.SpanID]struct{}{spanId: {}}
+	queue := []model.SpanID{spanId}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, child := range children[current] {
+			if _, visited := kept[child]; !visited {
+				kept[child] = struct{}{}
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	spans := make([]*model.Span, 0, len(kept))
+	for _, span := range trace.Spans {
+		if _, isKept := kept[span.SpanID]; isKept {
+			spans = append(spans, span)
+		}
+	}
+	trace.Spans = spans
+	return true
+}
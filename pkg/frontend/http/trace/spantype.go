@@ -0,0 +1,117 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"sort"
+	"strings"
+
+	tfconfig "github.com/kubewharf/kelemetry/pkg/frontend/tf/config"
+	tfstep "github.com/kubewharf/kelemetry/pkg/frontend/tf/defaults/step"
+)
+
+const (
+	spanTypeCaseExact       = "exact"
+	spanTypeCaseInsensitive = "insensitive"
+)
+
+// spanTypeIndex maps the lowercase form of each known span type to its canonical key.
+// Span types that differ only by case are ambiguous and mapped to the empty string.
+type spanTypeIndex map[string]string
+
+// knownSpanTypes returns the log fields that the transform configs inject into collapsed spans,
+// which are the keys that logs of each span type are stored under.
+func knownSpanTypes(configs tfconfig.Provider) []string {
+	if configs == nil {
+		return nil
+	}
+
+	types := map[string]struct{}{}
+	for _, name := range configs.Names() {
+		config := configs.GetByName(name)
+		if config == nil {
+			continue
+		}
+		collectSpanTypes(config.Steps, types)
+	}
+
+	result := make([]string, 0, len(types))
+	for spanType := range types {
+		result = append(result, spanType)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func collectSpanTypes(steps []tfconfig.Step, types map[string]struct{}) {
+	for _, step := range steps {
+		switch step := step.(type) {
+		case *tfconfig.BatchStep:
+			collectSpanTypes(step.Steps, types)
+		case *tfconfig.VisitorStep[tfstep.CollapseNestingVisitor]:
+			for _, field := range step.Visitor.LogTypeMapping {
+				if field != "" {
+					types[field] = struct{}{}
+				}
+			}
+			for _, mappings := range step.Visitor.TagMappings {
+				for _, mapping := range mappings {
+					if mapping.ToLogField != "" {
+						types[mapping.ToLogField] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+}
+
+// buildSpanTypeIndex indexes the span types from the transform configs
+// and the span types configured in --trace-server-span-type-colors and --trace-server-span-type-log-window.
+func (server *server) buildSpanTypeIndex() spanTypeIndex {
+	spanTypes := knownSpanTypes(server.TransformConfigs)
+	for spanType := range server.options.spanTypeColors {
+		spanTypes = append(spanTypes, spanType)
+	}
+	for spanType := range server.options.logWindows {
+		spanTypes = append(spanTypes, spanType)
+	}
+
+	index := spanTypeIndex{}
+	for _, spanType := range spanTypes {
+		lower := strings.ToLower(spanType)
+		if canonical, exists := index[lower]; exists && canonical != spanType {
+			server.Logger.WithField("spanType", spanType).
+				WithField("conflict", canonical).
+				Warn("span types differ only by case, span_type values matching them are not normalized")
+			index[lower] = ""
+			continue
+		}
+		index[lower] = spanType
+	}
+	return index
+}
+
+// canonicalSpanType maps a span_type value to the known span type that equals it case-insensitively.
+// Unknown and ambiguous values are returned unchanged.
+func (server *server) canonicalSpanType(spanType string) string {
+	if server.options.spanTypeCase != spanTypeCaseInsensitive {
+		return spanType
+	}
+
+	if canonical := server.spanTypes[strings.ToLower(spanType)]; canonical != "" {
+		return canonical
+	}
+	return spanType
+}
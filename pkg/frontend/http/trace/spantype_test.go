@@ -0,0 +1,106 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	tfconfig "github.com/kubewharf/kelemetry/pkg/frontend/tf/config"
+	tfstep "github.com/kubewharf/kelemetry/pkg/frontend/tf/defaults/step"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+type staticConfigs struct {
+	config *tfconfig.Config
+}
+
+func (configs staticConfigs) Names() []string        { return []string{configs.config.Name} }
+func (configs staticConfigs) DefaultName() string    { return configs.config.Name }
+func (configs staticConfigs) DefaultId() tfconfig.Id { return configs.config.Id }
+
+func (configs staticConfigs) GetByName(name string) *tfconfig.Config {
+	if name == configs.config.Name {
+		return configs.config
+	}
+	return nil
+}
+
+func (configs staticConfigs) GetById(id tfconfig.Id) *tfconfig.Config {
+	if id == configs.config.Id {
+		return configs.config
+	}
+	return nil
+}
+
+func spanTypeTestTrace() *model.Trace {
+	return &model.Trace{Spans: []*model.Span{{
+		Logs: []model.Log{
+			{Fields: []model.KeyValue{model.String("audit", "create")}},
+			{Fields: []model.KeyValue{model.String("event", "Scheduled")}},
+		},
+	}}}
+}
+
+func spanTypeTestServer(t *testing.T, args ...string) *trace.MockServer {
+	mock, err := trace.NewMockServer(clock.RealClock{}, args...)
+	assert.NoError(t, err)
+
+	collapse := &tfconfig.VisitorStep[tfstep.CollapseNestingVisitor]{
+		Visitor: tfstep.CollapseNestingVisitor{
+			LogTypeMapping: map[zconstants.LogType]string{zconstants.LogTypeObjectSnapshot: "audit"},
+		},
+	}
+	mock.SetTransformConfigs(staticConfigs{config: &tfconfig.Config{
+		Name:  "tree",
+		Steps: []tfconfig.Step{&tfconfig.BatchStep{Steps: []tfconfig.Step{collapse}}},
+	}})
+	return mock
+}
+
+func TestSpanTypeCaseInsensitive(t *testing.T) {
+	for _, spanType := range []string{"Audit", "AUDIT", "audit"} {
+		assert := assert.New(t)
+
+		tr := spanTypeTestTrace()
+		spanTypeTestServer(t).PruneTrace(tr, spanType)
+
+		assert.Len(tr.Spans[0].Logs, 1, spanType)
+		assert.Equal("audit", tr.Spans[0].Logs[0].Fields[0].Key, spanType)
+	}
+}
+
+func TestSpanTypeCaseExact(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := spanTypeTestTrace()
+	spanTypeTestServer(t, "--trace-server-span-type-case=exact").PruneTrace(tr, "Audit")
+
+	assert.Empty(tr.Spans[0].Logs)
+}
+
+func TestSpanTypeCaseUnknown(t *testing.T) {
+	assert := assert.New(t)
+
+	// "Event" is not a known span type, so it is matched verbatim
+	tr := spanTypeTestTrace()
+	spanTypeTestServer(t).PruneTrace(tr, "Event")
+
+	assert.Empty(tr.Spans[0].Logs)
+}
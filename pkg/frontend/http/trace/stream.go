@@ -0,0 +1,223 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jaegertracing/jaeger/model"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+)
+
+// activeStreamMetric is the number of open trace streams.
+type activeStreamMetric struct{}
+
+func (*activeStreamMetric) MetricName() string { return "extension_trace_active_streams" }
+
+const (
+	// The stream reached --trace-server-stream-max-lifetime.
+	streamCloseLifetime = "lifetime"
+	// No new data was found within --trace-server-stream-idle-timeout.
+	streamCloseIdle = "idle"
+	// The server is shutting down.
+	streamCloseShutdown = "shutdown"
+)
+
+// handleStream periodically re-queries the trace over a relative window
+// and pushes the spans and logs that were not sent before as server-sent events.
+func (server *server) handleStream(ctx *gin.Context, metric *requestMetric) (code int, err error) {
+	if err := validateParamMultiplicity(ctx.Request.URL.Query(), knownParams); err != nil {
+		return metric.fail(classDuplicateParam), err
+	}
+	if code, err := server.checkStrictQuery(metric, ctx.Request.URL.Query(), knownParams); err != nil {
+		return code, err
+	}
+
+	if err := validateParamConflicts(ctx.Request.URL.Query()); err != nil {
+		return metric.fail(classConflictingParams), err
+	}
+
+	query := traceQuery{}
+	if err := ctx.BindQuery(&query); err != nil {
+		return metric.fail(classInvalidParam), fmt.Errorf("invalid param %w", err)
+	}
+
+	if query.Relative == "" {
+		return metric.fail(classEmptyParam), fmt.Errorf("stream requires the relative param")
+	}
+
+	if query.DisplayMode == "" {
+		query.DisplayMode = server.defaultDisplayMode(query.Cluster)
+	} else if code, err := server.validateDisplayMode(metric, query.DisplayMode); err != nil {
+		return code, err
+	}
+
+	if streams := server.activeStreams.Add(1); server.options.maxStreams > 0 && streams > int64(server.options.maxStreams) {
+		server.activeStreams.Add(-1)
+		return metric.fail(classTooManyStreams), fmt.Errorf("too many concurrent streams")
+	}
+	defer server.activeStreams.Add(-1)
+
+	// streams are bounded by --trace-server-stream-max-lifetime instead of --http-write-timeout
+	if err := http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		server.Logger.WithError(err).Warn("cannot clear write deadline for trace stream")
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+
+	lifetime := server.Clock.NewTimer(server.options.streamMaxLifetime)
+	defer lifetime.Stop()
+
+	state := newStreamState()
+	lastUpdate := server.Clock.Now()
+
+	for {
+		trace, _, code, err := server.fetchTrace(ctx.Request.Context(), metric, query)
+		if err != nil && code != 404 {
+			ctx.SSEvent("error", err.Error())
+			ctx.Writer.Flush()
+			return 0, nil
+		}
+
+		if trace != nil {
+			server.pruneTrace(trace, query.SpanType)
+			server.prepareResponseTrace(trace, query.Raw)
+
+			if delta := state.delta(trace); delta != nil {
+				ctx.SSEvent("update", uiconv.FromDomain(delta))
+				ctx.Writer.Flush()
+				lastUpdate = server.Clock.Now()
+			}
+		}
+
+		if server.options.streamIdleTimeout > 0 && server.Clock.Since(lastUpdate) >= server.options.streamIdleTimeout {
+			closeStream(ctx, streamCloseIdle)
+			return 0, nil
+		}
+
+		select {
+		case <-ctx.Request.Context().Done():
+			return 0, nil
+		case <-lifetime.C():
+			closeStream(ctx, streamCloseLifetime)
+			return 0, nil
+		case <-server.inflight.shutdown():
+			closeStream(ctx, streamCloseShutdown)
+			return 0, nil
+		case <-server.Clock.After(server.options.streamInterval):
+		}
+	}
+}
+
+// closeStream sends a final "close" event so that clients can distinguish a server-side close from a network error.
+func closeStream(ctx *gin.Context, reason string) {
+	ctx.SSEvent("close", reason)
+	ctx.Writer.Flush()
+}
+
+// streamState records the spans and logs already sent to a stream client.
+//
+// Spans are tracked by their identity since pseudo and virtual spans get a new ID on every query.
+// Updates reuse the trace ID and span IDs of the first update so that clients can attach new spans to sent ones.
+// Only the spans and logs of the latest query are kept, so the state is bounded by the trace size.
+type streamState struct {
+	traceId model.TraceID
+	// sentSpans maps the identity of each sent span to the span ID it was sent with.
+	sentSpans map[spanIdentity]model.SpanID
+	// sentLogs are the keys of the sent logs of each span.
+	sentLogs map[spanIdentity]map[string]struct{}
+}
+
+func newStreamState() *streamState {
+	return &streamState{
+		sentSpans: map[spanIdentity]model.SpanID{},
+		sentLogs:  map[spanIdentity]map[string]struct{}{},
+	}
+}
+
+// delta returns a trace containing the new spans and, for previously sent spans, only the new logs.
+// Returns nil if there is nothing new.
+func (state *streamState) delta(trace *model.Trace) *model.Trace {
+	if len(trace.Spans) == 0 {
+		return nil
+	}
+	if state.traceId == (model.TraceID{}) {
+		state.traceId = trace.Spans[0].TraceID
+	}
+
+	identities := spanIdentities(trace)
+	sentIds := make(map[model.SpanID]model.SpanID, len(trace.Spans))
+	sentSpans := make(map[spanIdentity]model.SpanID, len(trace.Spans))
+	for _, span := range trace.Spans {
+		identity := identities[span.SpanID]
+		sentId, sent := state.sentSpans[identity]
+		if !sent {
+			sentId = span.SpanID
+		}
+		sentIds[span.SpanID] = sentId
+		sentSpans[identity] = sentId
+	}
+
+	var spans []*model.Span
+	sentLogs := make(map[spanIdentity]map[string]struct{}, len(trace.Spans))
+	for _, span := range trace.Spans {
+		identity := identities[span.SpanID]
+		_, spanSent := state.sentSpans[identity]
+
+		logKeys := make(map[string]struct{}, len(span.Logs))
+		var newLogs []model.Log
+		for _, log := range span.Logs {
+			logKey := fmt.Sprintf("%d/%v", log.Timestamp.UnixNano(), log.Fields)
+			logKeys[logKey] = struct{}{}
+			if _, logSent := state.sentLogs[identity][logKey]; !logSent {
+				newLogs = append(newLogs, log)
+			}
+		}
+		sentLogs[identity] = logKeys
+
+		if !spanSent || len(newLogs) > 0 {
+			spanCopy := *span
+			spanCopy.TraceID = state.traceId
+			spanCopy.SpanID = sentIds[span.SpanID]
+			spanCopy.Logs = newLogs
+			spanCopy.References = make([]model.SpanRef, len(span.References))
+			for i, ref := range span.References {
+				ref.TraceID = state.traceId
+				if sentId, exists := sentIds[ref.SpanID]; exists {
+					ref.SpanID = sentId
+				}
+				spanCopy.References[i] = ref
+			}
+			spans = append(spans, &spanCopy)
+		}
+	}
+
+	state.sentSpans = sentSpans
+	state.sentLogs = sentLogs
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	return &model.Trace{
+		ProcessMap: trace.ProcessMap,
+		Spans:      spans,
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/clock"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+	"github.com/kubewharf/kelemetry/pkg/util/zconstants"
+)
+
+func TestStreamTracksPseudoSpansWithNewIds(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	var calls int32
+	reader := newFakeReader()
+	reader.find = func(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+		call := atomic.AddInt32(&calls, 1)
+
+		// like the reader, every query returns a new trace ID and pseudo span ID
+		traceId := model.NewTraceID(rand.Uint64(), rand.Uint64())
+		pseudo := &model.Span{
+			TraceID:       traceId,
+			SpanID:        model.SpanID(rand.Uint64()),
+			OperationName: "pods web",
+			StartTime:     query.StartTimeMin,
+			Duration:      query.StartTimeMax.Sub(query.StartTimeMin),
+			Tags: []model.KeyValue{
+				model.String(zconstants.PseudoType, string(zconstants.PseudoTypeObject)),
+				model.String("resource", "pods"),
+				model.String("name", "web"),
+			},
+			Process: &model.Process{ServiceName: "test"},
+		}
+		spans := []*model.Span{pseudo, auditSpan(1, "create", now.Add(-10*time.Minute))}
+		if call >= 3 {
+			spans = append(spans, auditSpan(2, "update", now.Add(-5*time.Minute)))
+		}
+		for _, span := range spans[1:] {
+			span.TraceID = traceId
+			span.References = []model.SpanRef{model.NewChildOfRef(traceId, pseudo.SpanID)}
+		}
+		return []*model.Trace{{Spans: spans}}, nil
+	}
+
+	mock, err := trace.NewMockHttpServer(clock.RealClock{}, reader, []string{"test"},
+		"--trace-server-stream-interval=1ms", "--trace-server-stream-max-lifetime=100ms")
+	assert.NoError(err)
+
+	target := "/extensions/api/v1/trace/stream?cluster=test&resource=pods&namespace=default&name=web&relative=-1h"
+	response := mock.Request("GET", target, nil)
+	assert.Equal(200, response.Code, response.Body.String())
+	assert.Greater(atomic.LoadInt32(&calls), int32(3))
+
+	type update struct {
+		TraceId string `json:"traceID"`
+		Spans   []struct {
+			SpanId        string `json:"spanID"`
+			OperationName string `json:"operationName"`
+			References    []struct {
+				SpanId string `json:"spanID"`
+			} `json:"references"`
+		} `json:"spans"`
+	}
+	updates := []update{}
+	lines := strings.Split(response.Body.String(), "\n")
+	for i, line := range lines {
+		if line == "event:update" && i+1 < len(lines) {
+			var data update
+			assert.NoError(json.Unmarshal([]byte(strings.TrimPrefix(lines[i+1], "data:")), &data))
+			updates = append(updates, data)
+		}
+	}
+
+	if assert.Len(updates, 2, "pseudo spans with new IDs are not sent again") {
+		first, second := updates[0], updates[1]
+		assert.Len(first.Spans, 2)
+		var pseudoId string
+		for _, span := range first.Spans {
+			if span.OperationName == "pods web" {
+				pseudoId = span.SpanId
+			}
+		}
+
+		assert.Equal(first.TraceId, second.TraceId, "updates reuse the first trace ID")
+		if assert.Len(second.Spans, 1) {
+			assert.Equal("update", second.Spans[0].OperationName)
+			assert.Equal(pseudoId, second.Spans[0].References[0].SpanId, "new spans reference the sent pseudo span")
+		}
+	}
+}
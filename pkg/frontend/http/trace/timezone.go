@@ -0,0 +1,59 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// localTimeTag is the tag (or log field) with the start time of a span (or the timestamp of a log) in the tz param timezone.
+const localTimeTag = "localTime"
+
+// parseTimezone parses the tz param as an IANA timezone name. Returns nil if tz is empty.
+func parseTimezone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return nil, nil
+	}
+
+	// "Local" depends on the server environment, which is not what the user means
+	if tz == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q", tz)
+	}
+
+	location, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", tz, err)
+	}
+	return location, nil
+}
+
+// localizeTimestamps adds the localTimeTag to spans and logs for text outputs.
+// The epoch timestamps are preserved.
+func localizeTimestamps(trace *model.Trace, location *time.Location) {
+	for _, span := range trace.Spans {
+		span.Tags = append(span.Tags, model.String(localTimeTag, formatLocalTime(span.StartTime, location)))
+		for i := range span.Logs {
+			log := &span.Logs[i]
+			log.Fields = append(log.Fields, model.String(localTimeTag, formatLocalTime(log.Timestamp, location)))
+		}
+	}
+}
+
+func formatLocalTime(t time.Time, location *time.Location) string {
+	return t.In(location).Format(time.RFC3339Nano)
+}
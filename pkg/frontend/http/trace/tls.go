@@ -0,0 +1,203 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/kubewharf/kelemetry/pkg/util/shutdown"
+)
+
+const certReloadInterval = time.Second * 30
+
+// certReloader serves the certificate from certFile and keyFile,
+// reloading it when the modification time of either file changes.
+type certReloader struct {
+	logger   logrus.FieldLogger
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(logger logrus.FieldLogger, certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		logger:   logger,
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reload loads the key pair if either file has changed since the last load.
+func (reloader *certReloader) reload() (changed bool, err error) {
+	certStat, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot stat TLS certificate: %w", err)
+	}
+	keyStat, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot stat TLS key: %w", err)
+	}
+
+	reloader.mu.RLock()
+	unchanged := reloader.cert != nil &&
+		certStat.ModTime().Equal(reloader.certModTime) &&
+		keyStat.ModTime().Equal(reloader.keyModTime)
+	reloader.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load TLS key pair: %w", err)
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.cert = &cert
+	reloader.certModTime = certStat.ModTime()
+	reloader.keyModTime = keyStat.ModTime()
+
+	return true, nil
+}
+
+func (reloader *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+func (reloader *certReloader) run(ctx context.Context) {
+	defer shutdown.RecoverPanic(reloader.logger)
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		changed, err := reloader.reload()
+		if err != nil {
+			reloader.logger.WithError(err).Error("cannot reload TLS certificate, keep serving the previous one")
+		} else if changed {
+			reloader.logger.Info("reloaded TLS certificate")
+		}
+	}, certReloadInterval)
+}
+
+// setupTls configures the shared HTTP server to serve HTTPS with the trace server certificates.
+const (
+	tlsVersion12 = "1.2"
+	tlsVersion13 = "1.3"
+
+	// Only TLS 1.3, whose cipher suites are all considered secure.
+	tlsPolicyModern = "modern"
+	// TLS 1.2 with forward-secret AEAD cipher suites only, and TLS 1.3.
+	tlsPolicyIntermediate = "intermediate"
+)
+
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+func applyTlsPolicy(tlsConfig *tls.Config, minVersion string, policy string) error {
+	switch minVersion {
+	case tlsVersion12:
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case tlsVersion13:
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return fmt.Errorf("invalid --trace-server-tls-min-version %q, must be %q or %q", minVersion, tlsVersion12, tlsVersion13)
+	}
+
+	switch policy {
+	case tlsPolicyModern:
+		if tlsConfig.MinVersion != tls.VersionTLS13 {
+			return fmt.Errorf("--trace-server-tls-cipher-policy=%s requires --trace-server-tls-min-version=%s", policy, tlsVersion13)
+		}
+	case tlsPolicyIntermediate:
+		// ignored by Go for TLS 1.3
+		tlsConfig.CipherSuites = intermediateCipherSuites
+	default:
+		return fmt.Errorf(
+			"invalid --trace-server-tls-cipher-policy %q, must be %q or %q",
+			policy, tlsPolicyModern, tlsPolicyIntermediate,
+		)
+	}
+
+	return nil
+}
+
+func (server *server) setupTls() error {
+	options := &server.options
+	if options.tlsCertFile == "" && options.tlsKeyFile == "" {
+		if options.tlsClientCaFile != "" {
+			return fmt.Errorf("--trace-server-tls-client-ca requires --trace-server-tls-cert-file and --trace-server-tls-key-file")
+		}
+		return nil
+	}
+	if options.tlsCertFile == "" || options.tlsKeyFile == "" {
+		return fmt.Errorf("--trace-server-tls-cert-file and --trace-server-tls-key-file must be set together")
+	}
+
+	reloader, err := newCertReloader(server.Logger.WithField("mod", "tls"), options.tlsCertFile, options.tlsKeyFile)
+	if err != nil {
+		return err
+	}
+	server.certReloader = reloader
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+	}
+	if err := applyTlsPolicy(tlsConfig, options.tlsMinVersion, options.tlsCipherPolicy); err != nil {
+		return err
+	}
+
+	if options.tlsClientCaFile != "" {
+		caBytes, err := os.ReadFile(options.tlsClientCaFile)
+		if err != nil {
+			return fmt.Errorf("cannot read TLS client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBytes) {
+			return fmt.Errorf("no certificates found in TLS client CA file %q", options.tlsClientCaFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	server.Server.AddServerModifier(func(hs *http.Server) { hs.TLSConfig = tlsConfig })
+	return nil
+}
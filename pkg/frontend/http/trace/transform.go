@@ -0,0 +1,313 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const searchMatchedTag = "matched"
+
+// markSearchMatches adds the tag `matched=true` to spans whose operation name, tags or log fields
+// contain the term case-insensitively, and returns the number of matched spans.
+// No spans are removed.
+func markSearchMatches(trace *model.Trace, term string) int {
+	term = strings.ToLower(term)
+
+	matches := 0
+	for _, span := range trace.Spans {
+		if spanContains(span, term) {
+			span.Tags = append(span.Tags, model.Bool(searchMatchedTag, true))
+			matches++
+		}
+	}
+
+	return matches
+}
+
+func spanContains(span *model.Span, lowerTerm string) bool {
+	if strings.Contains(strings.ToLower(span.OperationName), lowerTerm) {
+		return true
+	}
+
+	if keyValuesContain(span.Tags, lowerTerm) {
+		return true
+	}
+
+	for _, log := range span.Logs {
+		if keyValuesContain(log.Fields, lowerTerm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func keyValuesContain(kvs []model.KeyValue, lowerTerm string) bool {
+	for _, kv := range kvs {
+		if strings.Contains(strings.ToLower(kv.Key), lowerTerm) || strings.Contains(strings.ToLower(kv.AsString()), lowerTerm) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const droppedLogsTag = "droppedLogs"
+
+// limitLogs keeps only the `limit` most recent logs of each span.
+// Spans with dropped logs are tagged with the number of dropped logs.
+func limitLogs(trace *model.Trace, limit int) {
+	for _, span := range trace.Spans {
+		if len(span.Logs) <= limit {
+			continue
+		}
+
+		sort.SliceStable(span.Logs, func(i, j int) bool { return span.Logs[i].Timestamp.Before(span.Logs[j].Timestamp) })
+
+		dropped := len(span.Logs) - limit
+		span.Logs = span.Logs[dropped:]
+		addDroppedLogs(span, dropped)
+	}
+}
+
+// addDroppedLogs increments the dropped log count tag of the span.
+func addDroppedLogs(span *model.Span, dropped int) {
+	for i, tag := range span.Tags {
+		if tag.Key == droppedLogsTag {
+			span.Tags[i] = model.Int64(droppedLogsTag, tag.Int64()+int64(dropped))
+			return
+		}
+	}
+
+	span.Tags = append(span.Tags, model.Int64(droppedLogsTag, int64(dropped)))
+}
+
+// parseSpanTypeCaps parses a comma-separated list of `spanType:count` pairs.
+func parseSpanTypeCaps(value string) (map[string]int, error) {
+	caps := map[string]int{}
+	if value == "" {
+		return caps, nil
+	}
+
+	for _, term := range strings.Split(value, ",") {
+		spanType, countString, ok := strings.Cut(term, ":")
+		if !ok || spanType == "" {
+			return nil, fmt.Errorf("invalid term %q, expected spanType:count", term)
+		}
+
+		count, err := strconv.Atoi(countString)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid count in term %q", term)
+		}
+
+		caps[spanType] = count
+	}
+
+	return caps, nil
+}
+
+// PruneLogsByWindow drops the logs of each span type in windows earlier than the end of the trace minus the window.
+// The end of the trace is the latest span end or log timestamp.
+// Consistent with PruneTrace, a log is of a span type if it matches with logIsOfSpanType
+// or its span's tag named spanTypeField equals the span type.
+// Logs of span types without a window are kept.
+func PruneLogsByWindow(trace *model.Trace, spanTypeField string, windows map[string]time.Duration) {
+	if len(windows) == 0 {
+		return
+	}
+
+	var traceEnd time.Time
+	for _, span := range trace.Spans {
+		if end := spanEnd(span); end.After(traceEnd) {
+			traceEnd = end
+		}
+		for _, log := range span.Logs {
+			if log.Timestamp.After(traceEnd) {
+				traceEnd = log.Timestamp
+			}
+		}
+	}
+
+	for _, span := range trace.Spans {
+		var newLogs []model.Log
+		for _, log := range span.Logs {
+			keep := true
+			for spanType, window := range windows {
+				spanMatches := spanTypeField != "" && hasValue(span.Tags, spanTypeField, spanType)
+				if (spanMatches || logIsOfSpanType(log, spanTypeField, spanType)) && log.Timestamp.Before(traceEnd.Add(-window)) {
+					keep = false
+					break
+				}
+			}
+
+			if keep {
+				newLogs = append(newLogs, log)
+			}
+		}
+		span.Logs = newLogs
+	}
+}
+
+// limitLogsPerSpanType keeps only the most recent logs of each span type in each span.
+// Consistent with PruneTrace, span types are matched with logIsOfSpanType.
+// Logs of span types without a cap are kept.
+func limitLogsPerSpanType(trace *model.Trace, spanTypeField string, caps map[string]int) {
+	if len(caps) == 0 {
+		return
+	}
+
+	for _, span := range trace.Spans {
+		sort.SliceStable(span.Logs, func(i, j int) bool { return span.Logs[i].Timestamp.Before(span.Logs[j].Timestamp) })
+
+		remaining := make(map[string]int, len(caps))
+		for spanType, count := range caps {
+			remaining[spanType] = count
+		}
+
+		// iterate from the most recent log so that older logs are dropped first
+		kept := make([]bool, len(span.Logs))
+		dropped := 0
+		for i := len(span.Logs) - 1; i >= 0; i-- {
+			keep := true
+			for spanType := range caps {
+				if logIsOfSpanType(span.Logs[i], spanTypeField, spanType) {
+					if remaining[spanType] > 0 {
+						remaining[spanType]--
+					} else {
+						keep = false
+					}
+				}
+			}
+
+			kept[i] = keep
+			if !keep {
+				dropped++
+			}
+		}
+
+		if dropped == 0 {
+			continue
+		}
+
+		newLogs := make([]model.Log, 0, len(span.Logs)-dropped)
+		for i, log := range span.Logs {
+			if kept[i] {
+				newLogs = append(newLogs, log)
+			}
+		}
+		span.Logs = newLogs
+		addDroppedLogs(span, dropped)
+	}
+}
+
+// truncateMetric counts the number of tag and log field values truncated due to --trace-server-max-tag-value-bytes.
+type truncateMetric struct{}
+
+func (*truncateMetric) MetricName() string { return "extension_trace_truncate" }
+
+// prepareResponseTrace applies the transformations of every trace response right before conversion:
+// truncating long values unless raw is requested, renaming spans and filtering tag keys.
+func (server *server) prepareResponseTrace(trace *model.Trace, raw bool) {
+	server.truncateValues(trace, raw)
+	server.renameSpans(trace)
+	server.filterTagKeys(trace)
+}
+
+// truncateValues truncates long string values in span tags and log fields.
+func (server *server) truncateValues(trace *model.Trace, raw bool) {
+	limit := server.options.maxTagValueBytes
+	if limit <= 0 || raw {
+		return
+	}
+
+	truncated := 0
+	for _, span := range trace.Spans {
+		truncated += truncateKeyValues(span.Tags, limit)
+		for _, log := range span.Logs {
+			truncated += truncateKeyValues(log.Fields, limit)
+		}
+	}
+
+	if truncated > 0 {
+		server.TruncateMetric.With(&truncateMetric{}).Count(float64(truncated))
+	}
+}
+
+func truncateKeyValues(kvs []model.KeyValue, limit int) int {
+	truncated := 0
+	for i := range kvs {
+		kv := &kvs[i]
+		if kv.VType != model.StringType || len(kv.VStr) <= limit {
+			continue
+		}
+
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(kv.VStr[cut]) {
+			cut--
+		}
+
+		kv.VStr = fmt.Sprintf("%s…(truncated, %d bytes)", kv.VStr[:cut], len(kv.VStr))
+		truncated++
+	}
+	return truncated
+}
+
+// annotationTags are tags added by the trace server, which are never dropped by filterTagKeys.
+var annotationTags = stringSet([]string{
+	searchMatchedTag,
+	droppedLogsTag,
+	criticalPathContributionTag,
+	selfTimeTag,
+	CollapsedCountTag,
+	CollapsedRangeTag,
+})
+
+func stringSet(values []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, value := range values {
+		set[value] = struct{}{}
+	}
+	return set
+}
+
+// filterTagKeys drops span tags not in --trace-server-tag-allowlist,
+// or in --trace-server-tag-denylist if the allowlist is empty. Annotation tags are always kept.
+func (server *server) filterTagKeys(trace *model.Trace) {
+	allow, deny := server.tagAllowlist, server.tagDenylist
+	if len(allow) == 0 && len(deny) == 0 {
+		return
+	}
+
+	for _, span := range trace.Spans {
+		tags := span.Tags[:0]
+		for _, tag := range span.Tags {
+			_, allowed := allow[tag.Key]
+			_, denied := deny[tag.Key]
+			_, isAnnotation := annotationTags[tag.Key]
+			if isAnnotation || (len(allow) > 0 && allowed) || (len(allow) == 0 && !denied) {
+				tags = append(tags, tag)
+			}
+		}
+		span.Tags = tags
+	}
+}
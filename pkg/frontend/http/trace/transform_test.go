@@ -0,0 +1,125 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/kubewharf/kelemetry/pkg/frontend/http/trace"
+)
+
+var windowEnd = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func windowLog(age time.Duration, fields ...model.KeyValue) model.Log {
+	return model.Log{Timestamp: windowEnd.Add(-age), Fields: fields}
+}
+
+func logAges(span *model.Span) []time.Duration {
+	ages := []time.Duration{}
+	for _, log := range span.Logs {
+		ages = append(ages, windowEnd.Sub(log.Timestamp))
+	}
+	return ages
+}
+
+func TestPruneLogsByWindowMixedTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	span := &model.Span{
+		StartTime: windowEnd.Add(-2 * time.Hour),
+		Duration:  2 * time.Hour,
+		Logs: []model.Log{
+			windowLog(90*time.Minute, model.String("event", "Scheduled")),
+			windowLog(90*time.Minute, model.String("audit", "create")),
+			windowLog(20*time.Minute, model.String("event", "Pulled")),
+			windowLog(50*time.Minute, model.String("audit", "update")),
+			windowLog(5*time.Minute, model.String("event", "Started")),
+			windowLog(100*time.Minute, model.String("message", "no span type")),
+		},
+	}
+	tr := &model.Trace{Spans: []*model.Span{span}}
+
+	trace.PruneLogsByWindow(tr, "", map[string]time.Duration{
+		"event": 30 * time.Minute,
+		"audit": time.Hour,
+	})
+
+	assert.Equal([]time.Duration{20 * time.Minute, 50 * time.Minute, 5 * time.Minute, 100 * time.Minute}, logAges(span))
+}
+
+func TestPruneLogsByWindowUsesLatestSpanEnd(t *testing.T) {
+	assert := assert.New(t)
+
+	older := &model.Span{
+		StartTime: windowEnd.Add(-3 * time.Hour),
+		Duration:  time.Hour,
+		Logs: []model.Log{
+			windowLog(150*time.Minute, model.String("event", "Scheduled")),
+			windowLog(2*time.Hour, model.String("event", "Pulled")),
+		},
+	}
+	// the trace ends at windowEnd because of this span, although it has no logs of the span type
+	latest := &model.Span{StartTime: windowEnd.Add(-time.Minute), Duration: time.Minute}
+	tr := &model.Trace{Spans: []*model.Span{older, latest}}
+
+	trace.PruneLogsByWindow(tr, "", map[string]time.Duration{"event": 2 * time.Hour})
+
+	assert.Equal([]time.Duration{2 * time.Hour}, logAges(older), "logs exactly at the window start are kept")
+}
+
+func TestPruneLogsByWindowWithSpanTypeField(t *testing.T) {
+	assert := assert.New(t)
+
+	auditSpan := &model.Span{
+		StartTime: windowEnd.Add(-time.Hour),
+		Duration:  time.Hour,
+		Tags:      []model.KeyValue{model.String("kind", "audit")},
+		Logs: []model.Log{
+			windowLog(45*time.Minute, model.String("message", "from a span tagged as audit")),
+			windowLog(10*time.Minute, model.String("message", "recent")),
+		},
+	}
+	mixedSpan := &model.Span{
+		StartTime: windowEnd.Add(-time.Hour),
+		Duration:  time.Hour,
+		Logs: []model.Log{
+			windowLog(45*time.Minute, model.String("kind", "event")),
+			windowLog(45*time.Minute, model.String("kind", "audit")),
+			windowLog(45*time.Minute, model.String("audit", "not matched by key with a span type field")),
+		},
+	}
+	tr := &model.Trace{Spans: []*model.Span{auditSpan, mixedSpan}}
+
+	trace.PruneLogsByWindow(tr, "kind", map[string]time.Duration{"audit": 30 * time.Minute})
+
+	assert.Equal([]time.Duration{10 * time.Minute}, logAges(auditSpan))
+	assert.Equal([]time.Duration{45 * time.Minute, 45 * time.Minute}, logAges(mixedSpan))
+	assert.Equal("event", mixedSpan.Logs[0].Fields[0].VStr)
+}
+
+func TestPruneLogsByWindowWithoutWindows(t *testing.T) {
+	assert := assert.New(t)
+
+	span := &model.Span{Logs: []model.Log{windowLog(24*time.Hour, model.String("event", "Scheduled"))}}
+	tr := &model.Trace{Spans: []*model.Span{span}}
+
+	trace.PruneLogsByWindow(tr, "", nil)
+
+	assert.Len(span.Logs, 1)
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// rootTag is the tag configured by --trace-server-root-tag to mark root spans.
+// The zero value disables the tag.
+type rootTag struct {
+	key   string
+	value string
+}
+
+func parseRootTag(value string) (rootTag, error) {
+	if value == "" {
+		return rootTag{}, nil
+	}
+
+	key, tagValue, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return rootTag{}, fmt.Errorf("invalid --trace-server-root-tag %q, expected key=value", value)
+	}
+	return rootTag{key: key, value: tagValue}, nil
+}
+
+func (tag rootTag) matches(span *model.Span) bool {
+	return tag.key != "" && hasValue(span.Tags, tag.key, tag.value)
+}
+
+// findRootSpan returns the root span of the trace, or nil if there is none.
+// Spans with the root tag are preferred, in particular one without a ChildOf reference,
+// which is the case when root spans of multiple traces are merged under a synthetic root.
+// Without the root tag, the first span without a ChildOf reference is the root.
+func findRootSpan(trace *model.Trace, tag rootTag) *model.Span {
+	var tagged *model.Span
+	for _, span := range trace.Spans {
+		if tag.matches(span) {
+			if span.ParentSpanID() == 0 {
+				return span
+			}
+			if tagged == nil {
+				tagged = span
+			}
+		}
+	}
+	if tagged != nil {
+		return tagged
+	}
+
+	for _, span := range trace.Spans {
+		if span.ParentSpanID() == 0 {
+			return span
+		}
+	}
+
+	return nil
+}
+
+// rootSummary is the response of `?root_only=true`.
+type rootSummary struct {
+	TraceId       string            `json:"traceID"`
+	SpanId        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	StartTime     uint64            `json:"startTime"`
+	Duration      uint64            `json:"duration"`
+	Tags          map[string]string `json:"tags"`
+	// LocalTime is the start time in the tz param timezone.
+	LocalTime string `json:"localTime,omitempty"`
+	// AnchorOffset is the start time relative to the anchor param in microseconds, negative if before the anchor.
+	AnchorOffset *int64 `json:"anchorOffset,omitempty"`
+}
+
+func newRootSummary(span *model.Span, location *time.Location) rootSummary {
+	tags := make(map[string]string, len(span.Tags))
+	for _, tag := range span.Tags {
+		tags[tag.Key] = tag.AsString()
+	}
+
+	summary := rootSummary{
+		TraceId:       span.TraceID.String(),
+		SpanId:        span.SpanID.String(),
+		OperationName: span.OperationName,
+		StartTime:     model.TimeAsEpochMicroseconds(span.StartTime),
+		Duration:      model.DurationAsMicroseconds(span.Duration),
+		Tags:          tags,
+	}
+	if location != nil {
+		summary.LocalTime = formatLocalTime(span.StartTime, location)
+	}
+	return summary
+}
+
+const criticalPathContributionTag = "criticalPathContribution"
+
+// criticalPath reduces the trace to the chain of spans from the root to a leaf that determines the trace duration.
+// At each level, the child ending last is followed.
+// Each remaining span is tagged with its contribution in microseconds, i.e. the part of its duration
+// not covered by the next span on the path.
+func criticalPath(trace *model.Trace, tag rootTag) {
+	root := findRootSpan(trace, tag)
+	if root == nil {
+		return
+	}
+
+	children := map[model.SpanID][]*model.Span{}
+	for _, span := range trace.Spans {
+		if parent := span.ParentSpanID(); parent != 0 {
+			children[parent] = append(children[parent], span)
+		}
+	}
+
+	path := []*model.Span{root}
+	visited := map[model.SpanID]struct{}{root.SpanID: {}}
+	for current := root; ; {
+		var next *model.Span
+		for _, child := range children[current.SpanID] {
+			if _, seen := visited[child.SpanID]; seen {
+				continue
+			}
+
+			if next == nil || spanEnd(child).After(spanEnd(next)) ||
+				spanEnd(child).Equal(spanEnd(next)) && child.Duration > next.Duration {
+				next = child
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		path = append(path, next)
+		visited[next.SpanID] = struct{}{}
+		current = next
+	}
+
+	for i, span := range path {
+		contribution := span.Duration
+		if i+1 < len(path) {
+			contribution -= path[i+1].Duration
+			if contribution < 0 {
+				contribution = 0
+			}
+		}
+		span.Tags = append(span.Tags, model.Int64(criticalPathContributionTag, int64(model.DurationAsMicroseconds(contribution))))
+	}
+
+	trace.Spans = path
+}
+
+func spanEnd(span *model.Span) time.Time { return span.StartTime.Add(span.Duration) }
@@ -0,0 +1,61 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// UserTag is the tag of audit spans emitted by the audit consumer identifying the (impersonated) user.
+// When audit spans are collapsed into logs by CollapseNestingVisitor,
+// the tag must be mapped into a log field of the same name for `?user=` to match the logs.
+const UserTag = "username"
+
+// parseUserGroups parses --trace-server-user-groups values of the form `user1;user2`.
+func parseUserGroups(groups map[string]string) map[string]map[string]struct{} {
+	parsed := make(map[string]map[string]struct{}, len(groups))
+	for group, users := range groups {
+		members := map[string]struct{}{}
+		for _, user := range strings.Split(users, ";") {
+			if user = strings.TrimSpace(user); user != "" {
+				members[user] = struct{}{}
+			}
+		}
+		parsed[group] = members
+	}
+	return parsed
+}
+
+// matchingUsers returns the users matched by the user param, which is either a user name or a configured group.
+func (server *server) matchingUsers(user string) map[string]struct{} {
+	if members, isGroup := server.userGroups[user]; isGroup {
+		return members
+	}
+	return map[string]struct{}{user: {}}
+}
+
+// filterByUser keeps only the spans and logs attributable to one of the users, plus the ancestors of matched spans.
+func filterByUser(trace *model.Trace, users map[string]struct{}) {
+	filterSpansAndLogs(trace, func(kvs []model.KeyValue) bool {
+		kv, ok := model.KeyValues(kvs).FindByKey(UserTag)
+		if !ok {
+			return false
+		}
+		_, matches := users[kv.AsString()]
+		return matches
+	})
+}
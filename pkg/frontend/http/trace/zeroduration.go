@@ -0,0 +1,81 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trace
+
+import (
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+const (
+	zeroDurationKeep     = "keep"
+	zeroDurationMinWidth = "min-width"
+	zeroDurationToLog    = "to-log"
+)
+
+// zeroDurationTag marks the spans whose duration was widened by the min-width mode.
+const zeroDurationTag = "zeroDuration"
+
+// adjustZeroDuration handles instantaneous spans according to --trace-server-zero-duration-mode,
+// since they are invisible in the Jaeger UI.
+// Only the response is changed; the stored spans are not affected.
+func (server *server) adjustZeroDuration(trace *model.Trace) {
+	switch server.options.zeroDurationMode {
+	case zeroDurationMinWidth:
+		widenZeroDuration(trace, server.options.zeroDurationMinWidth)
+	case zeroDurationToLog:
+		zeroDurationToLogs(trace)
+	}
+}
+
+func widenZeroDuration(trace *model.Trace, minWidth time.Duration) {
+	for _, span := range trace.Spans {
+		if span.Duration == 0 {
+			span.Duration = minWidth
+			span.Tags = append(span.Tags, model.Bool(zeroDurationTag, true))
+		}
+	}
+}
+
+// zeroDurationToLogs converts leaf spans with zero duration into logs on their parents.
+// The operation name becomes the event field and the tags become the other fields.
+// Roots, spans with children and spans whose parent is not in the trace are kept.
+func zeroDurationToLogs(trace *model.Trace) {
+	spans := make(map[model.SpanID]*model.Span, len(trace.Spans))
+	hasChildren := map[model.SpanID]bool{}
+	for _, span := range trace.Spans {
+		spans[span.SpanID] = span
+		if parentId := span.ParentSpanID(); parentId != 0 {
+			hasChildren[parentId] = true
+		}
+	}
+
+	kept := make([]*model.Span, 0, len(trace.Spans))
+	for _, span := range trace.Spans {
+		parent, hasParent := spans[span.ParentSpanID()]
+		if span.Duration != 0 || hasChildren[span.SpanID] || !hasParent {
+			kept = append(kept, span)
+			continue
+		}
+
+		fields := make([]model.KeyValue, 0, len(span.Tags)+1)
+		fields = append(fields, model.String("event", span.OperationName))
+		fields = append(fields, span.Tags...)
+		parent.Logs = append(parent.Logs, model.Log{Timestamp: span.StartTime, Fields: fields})
+		parent.Logs = append(parent.Logs, span.Logs...)
+	}
+	trace.Spans = kept
+}
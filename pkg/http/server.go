@@ -37,6 +37,11 @@ func init() {
 type Server interface {
 	manager.Component
 	Routes() gin.IRoutes
+	// AddServerModifier registers a function that customizes the underlying http.Server before it starts serving.
+	// It must be called before Start, typically in the Init of a dependent component.
+	// If the modifier sets TLSConfig with certificates and HTTPS is not enabled by flags,
+	// the server serves HTTPS with the certificates from TLSConfig.
+	AddServerModifier(modifier func(*http.Server))
 }
 
 type options struct {
@@ -48,6 +53,10 @@ type options struct {
 
 	readTimeout       time.Duration
 	readHeaderTimeout time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	trustedProxies []string
 }
 
 func (options *options) Setup(fs *pflag.FlagSet) {
@@ -55,12 +64,36 @@ func (options *options) Setup(fs *pflag.FlagSet) {
 	fs.Uint16Var(&options.port, "http-port", 8080, "HTTP server port")
 	fs.StringVar(&options.cert, "http-tls-cert", "", "HTTP server TLS certificate (leave empty to disable HTTPS)")
 	fs.StringVar(&options.key, "http-tls-key", "", "HTTP server TLS key (leave empty to disable HTTPS)")
-	fs.DurationVar(&options.readTimeout, "http-read-timeout", 0, "HTTP server timeout for reading requests")
+	fs.DurationVar(
+		&options.readTimeout,
+		"http-read-timeout",
+		time.Second*30,
+		"HTTP server timeout for reading requests including the body (0 for no timeout)",
+	)
 	fs.DurationVar(
 		&options.readHeaderTimeout,
 		"http-read-header-timeout",
-		0,
-		"HTTP server timeout for reading request headers",
+		time.Second*10,
+		"HTTP server timeout for reading request headers (0 to use the read timeout)",
+	)
+	fs.DurationVar(
+		&options.writeTimeout,
+		"http-write-timeout",
+		time.Minute*5,
+		"HTTP server timeout for writing responses, counted from the end of the request headers (0 for no timeout)",
+	)
+	fs.DurationVar(
+		&options.idleTimeout,
+		"http-idle-timeout",
+		time.Minute*2,
+		"HTTP server timeout for idle keep-alive connections (0 to use the read timeout)",
+	)
+	fs.StringSliceVar(
+		&options.trustedProxies,
+		"http-trusted-proxies",
+		[]string{},
+		"IPs or CIDRs of proxies trusted to set X-Forwarded-For and X-Real-IP for the client IP; "+
+			"the remote address of the connection is used if empty",
 	)
 }
 
@@ -70,8 +103,9 @@ type server struct {
 	options options
 	Logger  logrus.FieldLogger
 
-	router *gin.Engine
-	server *http.Server
+	router    *gin.Engine
+	server    *http.Server
+	modifiers []func(*http.Server)
 }
 
 func (server *server) Options() manager.Options {
@@ -80,6 +114,9 @@ func (server *server) Options() manager.Options {
 
 func (server *server) Init() error {
 	server.router = gin.New()
+	if err := server.router.SetTrustedProxies(server.options.trustedProxies); err != nil {
+		return fmt.Errorf("invalid --http-trusted-proxies: %w", err)
+	}
 
 	return nil
 }
@@ -89,8 +126,13 @@ func (server *server) Start(ctx context.Context) error {
 		Addr:              net.JoinHostPort(server.options.address, fmt.Sprint(server.options.port)),
 		ReadHeaderTimeout: server.options.readHeaderTimeout,
 		ReadTimeout:       server.options.readTimeout,
+		WriteTimeout:      server.options.writeTimeout,
+		IdleTimeout:       server.options.idleTimeout,
 		Handler:           server.router,
 	}
+	for _, modifier := range server.modifiers {
+		modifier(hs)
+	}
 	server.server = hs
 
 	listener, err := net.Listen("tcp", hs.Addr)
@@ -101,6 +143,8 @@ func (server *server) Start(ctx context.Context) error {
 	var serveFunc func() error
 	if server.options.cert != "" && server.options.key != "" {
 		serveFunc = func() error { return hs.ServeTLS(listener, server.options.cert, server.options.key) }
+	} else if hs.TLSConfig != nil && (len(hs.TLSConfig.Certificates) > 0 || hs.TLSConfig.GetCertificate != nil) {
+		serveFunc = func() error { return hs.ServeTLS(listener, "", "") }
 	} else {
 		serveFunc = func() error { return hs.Serve(listener) }
 	}
@@ -131,3 +175,7 @@ func (server *server) Close(ctx context.Context) error {
 func (server *server) Routes() gin.IRoutes {
 	return server.router
 }
+
+func (server *server) AddServerModifier(modifier func(*http.Server)) {
+	server.modifiers = append(server.modifiers, modifier)
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 The Kelemetry Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIpIgnoresUntrustedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for name, tc := range map[string]struct {
+		args     []string
+		clientIp string
+	}{
+		"default": {clientIp: "192.0.2.1"},
+		"trusted": {args: []string{"--http-trusted-proxies=192.0.2.0/24"}, clientIp: "198.51.100.7"},
+		"other":   {args: []string{"--http-trusted-proxies=203.0.113.1"}, clientIp: "192.0.2.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			server := &server{}
+			fs := pflag.NewFlagSet("http", pflag.ContinueOnError)
+			server.options.Setup(fs)
+			assert.NoError(fs.Parse(tc.args))
+			assert.NoError(server.Init())
+
+			server.Routes().GET("/ip", func(ctx *gin.Context) { ctx.String(200, ctx.ClientIP()) })
+
+			request := httptest.NewRequest("GET", "/ip", nil)
+			request.RemoteAddr = "192.0.2.1:1234"
+			request.Header.Set("X-Forwarded-For", "198.51.100.7")
+			response := httptest.NewRecorder()
+			server.router.ServeHTTP(response, request)
+			assert.Equal(tc.clientIp, response.Body.String())
+		})
+	}
+}
+
+func TestInvalidTrustedProxies(t *testing.T) {
+	server := &server{}
+	fs := pflag.NewFlagSet("http", pflag.ContinueOnError)
+	server.options.Setup(fs)
+	assert.NoError(t, fs.Parse([]string{"--http-trusted-proxies=not-an-ip"}))
+	assert.Error(t, server.Init())
+}
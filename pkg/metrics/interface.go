@@ -270,6 +270,19 @@ type Impl interface {
 	New(name string, tagNames []string) MetricImpl
 }
 
+// Flusher is implemented by metrics implementations that buffer observations before exporting them.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush exports the buffered observations if the metrics implementation is a Flusher.
+func Flush(ctx context.Context, client Client) error {
+	if flusher, ok := client.impl().Impl().(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
 type MetricImpl interface {
 	Count(value float64, tags []string)
 	Histogram(value float64, tags []string)